@@ -1,18 +1,27 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/KL-Engineering/oauth2-server/internal/account"
 	"github.com/KL-Engineering/oauth2-server/internal/client"
 	"github.com/KL-Engineering/oauth2-server/internal/core"
 	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
 	"github.com/KL-Engineering/oauth2-server/internal/monitoring"
 	"github.com/KL-Engineering/oauth2-server/internal/oauth2"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/KL-Engineering/oauth2-server/internal/storage"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
+	"gopkg.in/square/go-jose.v2"
 )
 
 func NewServer(d *dynamodb.Client) *http.Server {
@@ -21,12 +30,151 @@ func NewServer(d *dynamodb.Client) *http.Server {
 	core.NewHandler().SetupRouter(router)
 	monitoring.NewHandler().SetupRouter(router)
 
-	oauth2Provider, err := oauth2.NewProvider(d)
+	// The CAs which issue the certificates of `tls_client_auth` Clients
+	var clientCAs *x509.CertPool
+	if path := os.Getenv("TLS_CLIENT_CA_FILE"); path != "" {
+		pool, err := crypto.LoadCertPool(path)
+		if err != nil {
+			log.Fatalf("ERROR: Setup of client CAs: %v", err)
+		}
+		clientCAs = pool
+	}
+
+	// The cap on every access token's lifespan, e.g. "12h", whatever its Client or account is configured with
+	var maxTokenLifespan time.Duration
+	if value := os.Getenv("MAX_TOKEN_LIFESPAN"); value != "" {
+		lifespan, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid MAX_TOKEN_LIFESPAN: %v", err)
+		}
+		maxTokenLifespan = lifespan
+	}
+
+	// The argon2id parameters of new Client secret hashes, e.g. "m=65536,t=3,p=2", where existing hashes
+	// are re-created with them when their Client next authenticates
+	if value := os.Getenv("SECRET_HASH_PARAMS"); value != "" {
+		params, err := crypto.ParseSecretHashParams(value)
+		if err == nil {
+			err = crypto.SetSecretHashParams(params)
+		}
+		if err != nil {
+			log.Fatalf("ERROR: Invalid SECRET_HASH_PARAMS: %v", err)
+		}
+	}
+
+	// Each secret hash allocates the argon2id memory, so only so many are computed at once, e.g. "4", where
+	// up to SECRET_HASH_QUEUE_SIZE more wait up to SECRET_HASH_QUEUE_TIMEOUT, e.g. "2s", before failing with a 503
+	hashLimits := crypto.DefaultHashLimits
+	if value := os.Getenv("SECRET_HASH_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid SECRET_HASH_CONCURRENCY: %v", err)
+		}
+		hashLimits.Concurrency = concurrency
+	}
+	if value := os.Getenv("SECRET_HASH_QUEUE_SIZE"); value != "" {
+		queueSize, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid SECRET_HASH_QUEUE_SIZE: %v", err)
+		}
+		hashLimits.MaxQueue = queueSize
+	}
+	if value := os.Getenv("SECRET_HASH_QUEUE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid SECRET_HASH_QUEUE_TIMEOUT: %v", err)
+		}
+		hashLimits.QueueTimeout = timeout
+	}
+	if err := crypto.SetHashLimits(hashLimits); err != nil {
+		log.Fatalf("ERROR: Invalid secret hash limits: %v", err)
+	}
+
+	// Whether tokens are still issued (without subscription claims) if the subscription can't be looked up
+	policy := oauth2.EntitlementFailurePolicy(os.Getenv("ENTITLEMENT_FAILURE_POLICY"))
+	switch policy {
+	case "":
+		policy = oauth2.EntitlementFailClosed
+	case oauth2.EntitlementFailClosed, oauth2.EntitlementOmitClaims:
+	default:
+		log.Fatalf("ERROR: Invalid ENTITLEMENT_FAILURE_POLICY: %s", policy)
+	}
+	entitlements := oauth2.WithEntitlementFailurePolicy(oauth2.NewDynamoDBEntitlementProvider(d), policy)
+
+	// Verified Client secrets are cached for a short time, e.g. "30s" (the default), or "0" to disable caching
+	secretCachePolicy := secretcache.DefaultPolicy
+	if value := os.Getenv("SECRET_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid SECRET_CACHE_TTL: %v", err)
+		}
+		secretCachePolicy.TTL = ttl
+	}
+	secretCache, err := secretcache.New(secretCachePolicy)
+	if err != nil {
+		log.Fatalf("ERROR: Setup of secret cache: %v", err)
+	}
+
+	lockouts := lockout.NewStore(d, lockout.DefaultPolicy)
+	// Only behind a proxy which sets X-Forwarded-For, otherwise clients could evade IP lockouts
+	trustForwardedFor := os.Getenv("TRUST_X_FORWARDED_FOR") == "true"
+
+	oauth2Provider, err := oauth2.NewProvider(d, oauth2.ProviderOptions{
+		ClientCAs:              clientCAs,
+		MaxAccessTokenLifespan: maxTokenLifespan,
+		SecretCache:            secretCache,
+		Lockout:                lockouts,
+		TrustForwardedFor:      trustForwardedFor,
+	})
 	if err != nil {
 		log.Fatalf("ERROR: Setup of fosite.OAuth2Provider: %v", err)
 	}
 
-	oauth2.NewHandler(oauth2Provider).SetupRouter(router)
+	// The public keys of publishers whose software statements are trusted by dynamic client registration
+	var softwareStatementKeys *jose.JSONWebKeySet
+	if path := os.Getenv("SOFTWARE_STATEMENT_JWKS_FILE"); path != "" {
+		softwareStatementKeys, err = crypto.LoadJWKS(path)
+		if err != nil {
+			log.Fatalf("ERROR: Setup of software statement keys: %v", err)
+		}
+	}
+
+	// The public keys of the platform's login, which sign the session (a JWT in the LOGIN_SESSION_COOKIE cookie,
+	// "access" by default) that end-users are authenticated by. End-users are sent to LOGIN_URL if they aren't logged in.
+	var sessionKeys *jose.JSONWebKeySet
+	if path := os.Getenv("LOGIN_SESSION_JWKS_FILE"); path != "" {
+		sessionKeys, err = crypto.LoadJWKS(path)
+		if err != nil {
+			log.Fatalf("ERROR: Setup of login session keys: %v", err)
+		}
+	}
+
+	hmacSecret, err := oauth2.LoadHMACSecret()
+	if err != nil {
+		log.Fatalf("ERROR: Setup of consent: %v", err)
+	}
+
+	consent := &oauth2.SessionConsentStrategy{
+		Login: &oauth2.LoginSession{
+			Keys:     sessionKeys,
+			Issuer:   os.Getenv("LOGIN_SESSION_ISSUER"),
+			Cookie:   os.Getenv("LOGIN_SESSION_COOKIE"),
+			LoginURL: os.Getenv("LOGIN_URL"),
+		},
+		CSRFKey: oauth2.ConsentCSRFKey(hmacSecret),
+	}
+
+	oauth2.NewHandler(oauth2Provider, d, oauth2.HandlerOptions{
+		Consent:            consent,
+		DeviceVerification: consent,
+		// Where end-users enter the code shown on their device, if not this server's `/oauth2/device/verify`
+		DeviceVerificationURI: os.Getenv("DEVICE_VERIFICATION_URL"),
+		Entitlements:          entitlements,
+		Lockout:               lockouts,
+		TrustForwardedFor:     trustForwardedFor,
+		SoftwareStatementKeys: softwareStatementKeys,
+		SecretCache:           secretCache,
+	}).SetupRouter(router)
 
 	jwks, err := crypto.JWKS()
 	if err != nil {
@@ -34,11 +182,17 @@ func NewServer(d *dynamodb.Client) *http.Server {
 	}
 
 	crypto.NewHandler(jwks).SetupRouter(router)
-	client.NewHandler(d).SetupRouter(router)
+	client.NewHandler(d, client.HandlerOptions{SecretCache: secretCache}).SetupRouter(router)
+	account.NewHandler(d).SetupRouter(router)
 
 	return &http.Server{
 		Addr:    "localhost:8080",
 		Handler: router,
+		// Client certificates are only requested, as they're verified per Client by oauth2.TLSClientAuthenticator
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequestClientCert,
+			MinVersion: tls.VersionTLS12,
+		},
 	}
 }
 
@@ -55,6 +209,13 @@ func main() {
 
 	s := NewServer(dynamodbClient)
 
+	// TLS is required for mutual TLS Clients, but otherwise may be terminated by a load balancer
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		log.Println("Listening for requests at https://localhost:8080")
+		log.Fatal(s.ListenAndServeTLS(certFile, keyFile))
+	}
+
 	log.Println("Listening for requests at http://localhost:8080")
 	log.Fatal(s.ListenAndServe())
 }
@@ -0,0 +1,156 @@
+package account
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/errorsx"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/julienschmidt/httprouter"
+)
+
+type Handler struct {
+	settings            *SettingsRepository
+	initialAccessTokens *InitialAccessTokenRepository
+}
+
+func NewHandler(client *dynamodb.Client) *Handler {
+	return &Handler{
+		settings:            NewSettingsRepository(client),
+		initialAccessTokens: NewInitialAccessTokenRepository(client),
+	}
+}
+
+func (h *Handler) SetupRouter(router *httprouter.Router) {
+	router.GET("/account/settings", h.GetSettings())
+	router.PUT("/account/settings", h.PutSettings())
+	router.POST("/account/initial-access-tokens", h.CreateInitialAccessToken())
+}
+
+func (h *Handler) GetSettings() httprouter.Handle {
+	return Middleware(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		accountID := GetAccountIdFromCtx(ctx)
+
+		settings, err := h.settings.Get(ctx, accountID)
+		if err != nil {
+			log.Printf("ERROR: Get Settings: %v", err)
+			core.InternalErrorResponse(w)
+			return
+		}
+
+		core.JSONResponse(w, settings)
+	})
+}
+
+func (h *Handler) PutSettings() httprouter.Handle {
+	return Middleware(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		accountID := GetAccountIdFromCtx(ctx)
+
+		var req Settings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_lifespan"),
+			)
+			return
+		}
+
+		if !ValidTokenLifespan(req.TokenLifespan) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_lifespan"),
+			)
+			return
+		}
+
+		if err := h.settings.Put(ctx, accountID, req); err != nil {
+			log.Printf("ERROR: Put Settings: %v", err)
+			core.InternalErrorResponse(w)
+			return
+		}
+
+		log.Printf("INFO: Updated Settings(account_id=%s)", accountID)
+
+		core.JSONResponse(w, req)
+	})
+}
+
+type CreateInitialAccessTokenRequest struct {
+	// Seconds, or 0 for `DefaultInitialAccessTokenLifespan`
+	ExpiresIn int64 `json:"expires_in"`
+	// Clients the token may register, or 0 for `DefaultInitialAccessTokenRegistrations`
+	MaxRegistrations int `json:"max_registrations"`
+}
+
+type CreateInitialAccessTokenResponse struct {
+	InitialAccessToken string `json:"initial_access_token"`
+	// Unix time
+	ExpiresAt        int64 `json:"expires_at"`
+	MaxRegistrations int   `json:"max_registrations"`
+}
+
+// Issues a token for partners to register a limited number of Clients in the account, at `/oauth2/register`
+func (h *Handler) CreateInitialAccessToken() httprouter.Handle {
+	return Middleware(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		accountID := GetAccountIdFromCtx(ctx)
+
+		var req CreateInitialAccessTokenRequest
+		// The body is optional
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				core.BadRequestResponse(
+					w,
+					errorsx.InvalidArgumentError("expires_in"),
+				)
+				return
+			}
+		}
+
+		if !ValidInitialAccessTokenLifespan(req.ExpiresIn) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("expires_in"),
+			)
+			return
+		}
+
+		if !ValidInitialAccessTokenRegistrations(req.MaxRegistrations) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("max_registrations"),
+			)
+			return
+		}
+
+		lifespan := DefaultInitialAccessTokenLifespan
+		if req.ExpiresIn != 0 {
+			lifespan = time.Duration(req.ExpiresIn) * time.Second
+		}
+		maxRegistrations := DefaultInitialAccessTokenRegistrations
+		if req.MaxRegistrations != 0 {
+			maxRegistrations = req.MaxRegistrations
+		}
+
+		token, initialAccessToken, err := h.initialAccessTokens.Create(ctx, accountID, lifespan, maxRegistrations)
+		if err != nil {
+			log.Printf("ERROR: Create InitialAccessToken: %v", err)
+			core.InternalErrorResponse(w)
+			return
+		}
+
+		log.Printf("INFO: Created InitialAccessToken(account_id=%s)", accountID)
+
+		w.WriteHeader(http.StatusCreated)
+		core.JSONResponse(w, CreateInitialAccessTokenResponse{
+			InitialAccessToken: token,
+			ExpiresAt:          initialAccessToken.ExpiresAt.Unix(),
+			MaxRegistrations:   initialAccessToken.Registrations,
+		})
+	})
+}
@@ -0,0 +1,158 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// Keyed by the hash of the token, see `crypto.HashToken`
+	initialAccessTokenNamespace = "InitialAccessToken"
+
+	DefaultInitialAccessTokenLifespan = time.Hour * 24
+	MaxInitialAccessTokenLifespan     = time.Hour * 24 * 30
+
+	DefaultInitialAccessTokenRegistrations = 1
+	MaxInitialAccessTokenRegistrations     = 100
+)
+
+// An `expires_in` is in seconds, where 0 is the default
+func ValidInitialAccessTokenLifespan(expiresIn int64) bool {
+	return expiresIn >= 0 && time.Duration(expiresIn)*time.Second <= MaxInitialAccessTokenLifespan
+}
+
+// Where 0 is the default
+func ValidInitialAccessTokenRegistrations(maxRegistrations int) bool {
+	return maxRegistrations >= 0 && maxRegistrations <= MaxInitialAccessTokenRegistrations
+}
+
+// Authorizes dynamic registration of Clients in an account, see
+// https://datatracker.ietf.org/doc/html/rfc7591#section-3
+//
+// A token may register a limited number of Clients until it expires, see `Use`
+type InitialAccessToken struct {
+	AccountID string    `dynamodbav:"account_id"`
+	ExpiresAt time.Time `dynamodbav:"expires_at"`
+	TTL       int64     `dynamodbav:"ttl"`
+	// How many more Clients the token may register
+	Registrations int `dynamodbav:"registrations"`
+}
+
+type InitialAccessTokenRepository struct {
+	dynamodb *dynamodb.Client
+}
+
+func NewInitialAccessTokenRepository(dynamodbClient *dynamodb.Client) *InitialAccessTokenRepository {
+	return &InitialAccessTokenRepository{
+		dynamodb: dynamodbClient,
+	}
+}
+
+func initialAccessTokenKey(token string) map[string]types.AttributeValue {
+	return storage.Key(initialAccessTokenNamespace, crypto.HashToken(token))
+}
+
+// Returns the new token, which is only known by the caller
+func (repo *InitialAccessTokenRepository) Create(ctx context.Context, accountID string, lifespan time.Duration, maxRegistrations int) (string, *InitialAccessToken, error) {
+	token, err := crypto.GenerateSecret()
+	if err != nil {
+		return "", nil, fmt.Errorf("crypto.GenerateSecret: %w", err)
+	}
+
+	expiresAt := time.Now().Add(lifespan)
+	initialAccessToken := &InitialAccessToken{
+		AccountID:     accountID,
+		ExpiresAt:     expiresAt,
+		TTL:           expiresAt.Unix(),
+		Registrations: maxRegistrations,
+	}
+
+	item, err := attributevalue.MarshalMap(initialAccessToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("attributevalue.MarshalMap InitialAccessToken: %w", err)
+	}
+	for k, v := range initialAccessTokenKey(token) {
+		item[k] = v
+	}
+
+	_, err = repo.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("dynamodb.PutItem InitialAccessToken: %w", err)
+	}
+
+	return token, initialAccessToken, nil
+}
+
+// Returns `core.ErrNotFound` if there is no such (unexpired) token, or it can't register any more Clients
+func (repo *InitialAccessTokenRepository) Get(ctx context.Context, token string) (*InitialAccessToken, error) {
+	output, err := repo.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       initialAccessTokenKey(token),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem InitialAccessToken: %w", err)
+	}
+
+	if output.Item == nil || storage.Expired(output.Item) {
+		return nil, core.ErrNotFound
+	}
+
+	var initialAccessToken InitialAccessToken
+	if err := attributevalue.UnmarshalMap(output.Item, &initialAccessToken); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap InitialAccessToken: %w", err)
+	}
+	if initialAccessToken.Registrations <= 0 {
+		return nil, core.ErrNotFound
+	}
+
+	return &initialAccessToken, nil
+}
+
+// Counts a registration against the token, returning `core.ErrNotFound` if it has expired or can't
+// register any more Clients
+//
+// Atomic, so concurrent registrations can't exceed the limit
+func (repo *InitialAccessTokenRepository) Use(ctx context.Context, token string) error {
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.Name("registrations").GreaterThan(expression.Value(0)).And(
+			expression.Name(storage.TTLAttribute).GreaterThanEqual(expression.Value(time.Now().Unix())),
+		),
+	).WithUpdate(
+		expression.Add(expression.Name("registrations"), expression.Value(-1)),
+	).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = repo.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       initialAccessTokenKey(token),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+			return core.ErrNotFound
+		}
+		return fmt.Errorf("dynamodb.UpdateItem InitialAccessToken: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package account
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidInitialAccessTokenLifespan(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidInitialAccessTokenLifespan(0))
+	a.True(ValidInitialAccessTokenLifespan(60))
+	a.True(ValidInitialAccessTokenLifespan(int64(MaxInitialAccessTokenLifespan.Seconds())))
+	a.False(ValidInitialAccessTokenLifespan(int64(MaxInitialAccessTokenLifespan.Seconds()) + 1))
+	a.False(ValidInitialAccessTokenLifespan(-1))
+}
+
+func TestValidInitialAccessTokenRegistrations(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidInitialAccessTokenRegistrations(0))
+	a.True(ValidInitialAccessTokenRegistrations(1))
+	a.True(ValidInitialAccessTokenRegistrations(MaxInitialAccessTokenRegistrations))
+	a.False(ValidInitialAccessTokenRegistrations(MaxInitialAccessTokenRegistrations + 1))
+	a.False(ValidInitialAccessTokenRegistrations(-1))
+}
@@ -0,0 +1,90 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	tableName = "authentication"
+	// Stored alongside the account's Clients, in the same partition
+	settingsSortKey = "Settings"
+)
+
+// The shortest `token_lifespan` (in seconds) which may be configured
+const MinTokenLifespan = 60
+
+// A `token_lifespan` is in seconds, where 0 is the default
+//
+// There's no maximum, as the server caps every access token's lifespan regardless
+func ValidTokenLifespan(lifespan int64) bool {
+	return lifespan == 0 || lifespan >= MinTokenLifespan
+}
+
+// Defaults for every Client of an account, which a Client may override
+type Settings struct {
+	// Seconds until an access token expires, or 0 for the server's default
+	TokenLifespan int64 `json:"token_lifespan" dynamodbav:"token_lifespan"`
+}
+
+type SettingsRepository struct {
+	dynamodb *dynamodb.Client
+}
+
+func NewSettingsRepository(dynamodbClient *dynamodb.Client) *SettingsRepository {
+	return &SettingsRepository{
+		dynamodb: dynamodbClient,
+	}
+}
+
+func settingsKey(accountID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", accountID)},
+		"sk": &types.AttributeValueMemberS{Value: settingsSortKey},
+	}
+}
+
+// Returns the zero value (i.e. the server's defaults) if the account has no settings
+func (repo *SettingsRepository) Get(ctx context.Context, accountID string) (*Settings, error) {
+	output, err := repo.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       settingsKey(accountID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem Settings: %w", err)
+	}
+
+	var settings Settings
+	if output.Item == nil {
+		return &settings, nil
+	}
+
+	err = attributevalue.UnmarshalMap(output.Item, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap Settings: %w", err)
+	}
+
+	return &settings, nil
+}
+
+// Replaces all of the account's settings
+func (repo *SettingsRepository) Put(ctx context.Context, accountID string, settings Settings) error {
+	item := settingsKey(accountID)
+	item["token_lifespan"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(settings.TokenLifespan, 10)}
+
+	_, err := repo.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.PutItem Settings: %w", err)
+	}
+
+	return nil
+}
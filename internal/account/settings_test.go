@@ -0,0 +1,17 @@
+package account
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTokenLifespan(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidTokenLifespan(0))
+	a.True(ValidTokenLifespan(MinTokenLifespan))
+	a.True(ValidTokenLifespan(60 * 60 * 24 * 7))
+	a.False(ValidTokenLifespan(MinTokenLifespan - 1))
+	a.False(ValidTokenLifespan(-1))
+}
@@ -1,10 +1,439 @@
 package client
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+)
+
 type Client struct {
-	ID           string `json:"id"`
-	Name         string `json:"name"`
-	SecretPrefix string `json:"secret_prefix" dynamodbav:"secret_prefix"`
-	SecretHash   string `json:"-" dynamodbav:"secret"`
-	AndroidID    string `json:"-" dynamodbav:"android_id"`
-	AccountID    string `json:"-" dynamodbav:"account_id"`
+	ID                          string         `json:"id"`
+	Name                        string         `json:"name"`
+	SecretPrefix                string         `json:"secret_prefix" dynamodbav:"secret_prefix"`
+	SecretHash                  string         `json:"-" dynamodbav:"secret"`
+	AndroidID                   string         `json:"-" dynamodbav:"android_id"`
+	AccountID                   string         `json:"-" dynamodbav:"account_id"`
+	AllowedScopes               []string       `json:"allowed_scopes" dynamodbav:"allowed_scopes"`
+	AllowedAudiences            []string       `json:"allowed_audiences" dynamodbav:"allowed_audiences"`
+	TokenEndpointAuthMethod     string         `json:"token_endpoint_auth_method,omitempty" dynamodbav:"token_endpoint_auth_method"`
+	TokenEndpointAuthSigningAlg string         `json:"token_endpoint_auth_signing_alg,omitempty" dynamodbav:"token_endpoint_auth_signing_alg"`
+	JWKS                        *JSONWebKeySet `json:"jwks,omitempty" dynamodbav:"jwks"`
+	JWKSURI                     string         `json:"jwks_uri,omitempty" dynamodbav:"jwks_uri"`
+	RedirectURIs                []string       `json:"redirect_uris" dynamodbav:"redirect_uris"`
+	// Empty for the defaults, see `DefaultGrantTypes`
+	GrantTypes []string `json:"grant_types,omitempty" dynamodbav:"grant_types"`
+	// The certificate a `tls_client_auth` or `self_signed_tls_client_auth` Client authenticates with
+	TLSClientAuthSubjectDN      string `json:"tls_client_auth_subject_dn,omitempty" dynamodbav:"tls_client_auth_subject_dn"`
+	TLSClientAuthSPKIThumbprint string `json:"tls_client_auth_spki_thumbprint,omitempty" dynamodbav:"tls_client_auth_spki_thumbprint"`
+	// Seconds until an access token expires, or 0 for the account's default, see `account.ValidTokenLifespan`
+	TokenLifespan int64 `json:"token_lifespan,omitempty" dynamodbav:"token_lifespan"`
+	// Extra claims of the Client's access tokens, see `ValidateCustomClaims`
+	CustomClaims map[string]string `json:"custom_claims,omitempty" dynamodbav:"custom_claims"`
+	// Empty for the default, see `ValidTokenFormat`
+	TokenFormat string `json:"token_format,omitempty" dynamodbav:"token_format"`
+	// Set for Clients registered at `/oauth2/register`, which manage their own configuration with
+	// this token, see https://datatracker.ietf.org/doc/html/rfc7592
+	RegistrationAccessTokenHash string `json:"-" dynamodbav:"registration_access_token"`
+	// Identifies the software of a dynamically registered Client, see https://datatracker.ietf.org/doc/html/rfc7591#section-2
+	SoftwareID      string `json:"software_id,omitempty" dynamodbav:"software_id"`
+	SoftwareVersion string `json:"software_version,omitempty" dynamodbav:"software_version"`
+	// The signed JWT which the software's metadata was registered with, if any
+	SoftwareStatement string `json:"-" dynamodbav:"software_statement"`
+	// The secret replaced by the last rotation, which is still accepted until it expires (unix seconds),
+	// see `ValidSecretGracePeriod`
+	PreviousSecretPrefix    string `json:"previous_secret_prefix,omitempty" dynamodbav:"previous_secret_prefix"`
+	PreviousSecretHash      string `json:"-" dynamodbav:"previous_secret"`
+	PreviousSecretExpiresAt int64  `json:"previous_secret_expires_at,omitempty" dynamodbav:"previous_secret_expires_at"`
+	// A disabled Client can't authenticate, and its tokens are inactive
+	Disabled bool `json:"disabled,omitempty" dynamodbav:"disabled"`
+}
+
+// Public Clients (e.g. mobile apps) can't keep a secret, so must use the `authorization_code` grant with PKCE
+func (c *Client) IsPublic() bool {
+	return c.TokenEndpointAuthMethod == None
+}
+
+// Whether `token` is the registration access token of a dynamically registered Client
+func (c *Client) ValidRegistrationAccessToken(token string) bool {
+	if c.RegistrationAccessTokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(crypto.HashToken(token)), []byte(c.RegistrationAccessTokenHash)) == 1
+}
+
+// The hash of the previous secret, unless there is none or it has expired
+func (c *Client) ValidPreviousSecretHash() string {
+	if c.PreviousSecretHash == "" || time.Now().Unix() >= c.PreviousSecretExpiresAt {
+		return ""
+	}
+	return c.PreviousSecretHash
+}
+
+func (c *Client) GetGrantTypes() []string {
+	if len(c.GrantTypes) > 0 {
+		return c.GrantTypes
+	}
+	return DefaultGrantTypes(c.TokenEndpointAuthMethod, c.RedirectURIs)
+}
+
+// Supported `token_endpoint_auth_method` values
+const (
+	// The default, where an empty value is treated as `client_secret_basic`
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	// https://datatracker.ietf.org/doc/html/rfc7523#section-2.2
+	PrivateKeyJWT = "private_key_jwt"
+	// A public Client, which has no secret
+	None = "none"
+	// Mutual TLS with a certificate issued by a trusted CA, identified by its subject DN,
+	// see https://datatracker.ietf.org/doc/html/rfc8705#section-2.1
+	TLSClientAuth = "tls_client_auth"
+	// Mutual TLS with a self-signed certificate, identified by its SPKI thumbprint,
+	// see https://datatracker.ietf.org/doc/html/rfc8705#section-2.2
+	SelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+)
+
+// Every supported `token_endpoint_auth_method`, e.g. for discovery
+var TokenEndpointAuthMethods = []string{ClientSecretBasic, ClientSecretPost, PrivateKeyJWT, None, TLSClientAuth, SelfSignedTLSClientAuth}
+
+// Whether a Client authenticates with a TLS client certificate
+func IsTLSClientAuth(method string) bool {
+	return method == TLSClientAuth || method == SelfSignedTLSClientAuth
+}
+
+// Public and mutual TLS Clients don't have a secret
+func HasSecret(method string) bool {
+	return method != None && !IsTLSClientAuth(method)
+}
+
+// How long the previous secret is still accepted after the secret is rotated, so that deployed
+// consumers can be updated without downtime
+const (
+	DefaultSecretGracePeriod = time.Hour * 24
+	MaxSecretGracePeriod     = time.Hour * 24 * 30
+)
+
+// A `grace_period` is in seconds, where 0 revokes the previous secret immediately
+func ValidSecretGracePeriod(gracePeriod int64) bool {
+	return gracePeriod >= 0 && time.Duration(gracePeriod)*time.Second <= MaxSecretGracePeriod
+}
+
+// Supported `token_format` values
+const (
+	// The default, where an empty value is treated as `jwt`
+	JWTTokenFormat = "jwt"
+	// Random (HMAC signed) access tokens, which reveal nothing (e.g. account IDs) to their holder, so
+	// can only be resolved by introspection
+	OpaqueTokenFormat = "opaque"
+)
+
+func ValidTokenFormat(format string) bool {
+	return format == "" || format == JWTTokenFormat || format == OpaqueTokenFormat
+}
+
+// Supported `grant_types` values
+const (
+	ClientCredentials = "client_credentials"
+	AuthorizationCode = "authorization_code"
+	RefreshToken      = "refresh_token"
+	// https://datatracker.ietf.org/doc/html/rfc8628#section-3.4
+	DeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+	// https://datatracker.ietf.org/doc/html/rfc8693#section-2.1
+	TokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+var supportedGrantTypes = map[string]bool{
+	ClientCredentials: true,
+	AuthorizationCode: true,
+	RefreshToken:      true,
+	DeviceCode:        true,
+	TokenExchange:     true,
+}
+
+// Every supported `grant_types` value, sorted
+func SupportedGrantTypes() []string {
+	return sortedKeys(supportedGrantTypes)
+}
+
+const DefaultTokenEndpointAuthSigningAlg = "RS256"
+
+var tokenEndpointAuthSigningAlgs = map[string]bool{
+	"RS256": true,
+	"RS384": true,
+	"RS512": true,
+	"PS256": true,
+	"PS384": true,
+	"PS512": true,
+	"ES256": true,
+	"ES384": true,
+	"ES512": true,
+}
+
+// Every supported `token_endpoint_auth_signing_alg` value, sorted
+func TokenEndpointAuthSigningAlgs() []string {
+	return sortedKeys(tokenEndpointAuthSigningAlgs)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Scopes must be a valid `scope-token` as defined by https://datatracker.ietf.org/doc/html/rfc6749#section-3.3
+func ValidScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope == "" {
+			return false
+		}
+		for _, c := range scope {
+			if c < 0x21 || c == 0x22 || c == 0x5C || c > 0x7E {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Audiences are space delimited in token requests, so can't contain whitespace
+func ValidAudiences(audiences []string) bool {
+	for _, audience := range audiences {
+		if audience == "" || strings.IndexFunc(audience, unicode.IsSpace) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the invalid parameter, if any, of a Client's authentication configuration
+func ValidateAuthentication(method string, signingAlg string, jwks *JSONWebKeySet, jwksURI string) (string, bool) {
+	switch method {
+	case "", ClientSecretBasic, ClientSecretPost, None, TLSClientAuth, SelfSignedTLSClientAuth:
+		if signingAlg != "" {
+			return "token_endpoint_auth_signing_alg", false
+		}
+		if jwks != nil {
+			return "jwks", false
+		}
+		if jwksURI != "" {
+			return "jwks_uri", false
+		}
+	case PrivateKeyJWT:
+		if signingAlg != "" && !tokenEndpointAuthSigningAlgs[signingAlg] {
+			return "token_endpoint_auth_signing_alg", false
+		}
+		// Exactly one source of keys is required
+		if (jwks == nil) == (jwksURI == "") {
+			return "jwks", false
+		}
+		if jwks != nil && !jwks.Valid() {
+			return "jwks", false
+		}
+		if jwksURI != "" && !ValidJWKSURI(jwksURI) {
+			return "jwks_uri", false
+		}
+	default:
+		return "token_endpoint_auth_method", false
+	}
+	return "", true
+}
+
+// The grant types of a Client which doesn't specify any
+//
+// Public Clients can't authenticate, so can only act on behalf of an end-user. The device
+// authorization grant is never a default, as it's only for Clients without a browser.
+func DefaultGrantTypes(method string, redirectURIs []string) []string {
+	if method == None {
+		return []string{AuthorizationCode, RefreshToken}
+	}
+	if len(redirectURIs) > 0 {
+		return []string{ClientCredentials, AuthorizationCode, RefreshToken}
+	}
+	return []string{ClientCredentials}
+}
+
+// Returns the invalid parameter, if any, of a Client's grant types
+func ValidateGrantTypes(grantTypes []string, method string, redirectURIs []string) (string, bool) {
+	for _, grantType := range grantTypes {
+		if !supportedGrantTypes[grantType] {
+			return "grant_types", false
+		}
+	}
+
+	if len(grantTypes) == 0 {
+		grantTypes = DefaultGrantTypes(method, redirectURIs)
+	}
+
+	for _, grantType := range grantTypes {
+		switch grantType {
+		case ClientCredentials, TokenExchange:
+			// Public Clients can't authenticate as themselves
+			if method == None {
+				return "grant_types", false
+			}
+		case AuthorizationCode:
+			if len(redirectURIs) == 0 {
+				return "redirect_uris", false
+			}
+		}
+	}
+
+	return "", true
+}
+
+// Keys must be fetched over TLS
+func ValidJWKSURI(jwksURI string) bool {
+	u, err := url.Parse(jwksURI)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// Returns the invalid parameter, if any, of the certificate a mutual TLS Client authenticates with
+//
+// The subject DN is formatted as per RFC 4514, e.g. "CN=client.example.com,O=Example", and the
+// SPKI thumbprint is the base64url encoded SHA-256 hash of the certificate's public key
+func ValidateTLSClientAuth(method string, subjectDN string, spkiThumbprint string) (string, bool) {
+	switch method {
+	case TLSClientAuth:
+		if subjectDN == "" {
+			return "tls_client_auth_subject_dn", false
+		}
+		if spkiThumbprint != "" {
+			return "tls_client_auth_spki_thumbprint", false
+		}
+	case SelfSignedTLSClientAuth:
+		if subjectDN != "" {
+			return "tls_client_auth_subject_dn", false
+		}
+		if thumbprint, err := base64.RawURLEncoding.DecodeString(spkiThumbprint); err != nil || len(thumbprint) != sha256.Size {
+			return "tls_client_auth_spki_thumbprint", false
+		}
+	default:
+		if subjectDN != "" {
+			return "tls_client_auth_subject_dn", false
+		}
+		if spkiThumbprint != "" {
+			return "tls_client_auth_spki_thumbprint", false
+		}
+	}
+	return "", true
+}
+
+// Claims which are set by the server, so can't be a custom claim, including those of the
+// introspection response (see https://datatracker.ietf.org/doc/html/rfc7662#section-2.2)
+var reservedClaims = map[string]bool{
+	// https://datatracker.ietf.org/doc/html/rfc7519#section-4.1
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+	// https://datatracker.ietf.org/doc/html/rfc9068#section-2.2
+	"client_id": true,
+	"scope":     true,
+	"scp":       true,
+	"auth_time": true,
+	"acr":       true,
+	"amr":       true,
+	// https://datatracker.ietf.org/doc/html/rfc8693#section-4
+	"act":     true,
+	"may_act": true,
+	// https://datatracker.ietf.org/doc/html/rfc7800#section-3.1
+	"cnf": true,
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	"azp":     true,
+	"nonce":   true,
+	"at_hash": true,
+	"c_hash":  true,
+	"sid":     true,
+	// Introspection
+	"active":     true,
+	"token_type": true,
+	"username":   true,
+	// Ours
+	"account_id":      true,
+	"android_id":      true,
+	"subscription_id": true,
+	"entitlements":    true,
+}
+
+func IsReservedClaim(name string) bool {
+	return reservedClaims[name]
+}
+
+// Variables which a custom claim's value may include as e.g. `{{account_id}}`, and which are
+// replaced with those of the access token when it's issued
+var claimTemplateVariables = map[string]bool{
+	"sub":        true,
+	"client_id":  true,
+	"account_id": true,
+	"android_id": true,
+}
+
+var claimTemplatePattern = regexp.MustCompile(`{{\s*([^{}\s]*)\s*}}`)
+
+const (
+	maxCustomClaims          = 20
+	maxCustomClaimNameLength = 64
+	maxCustomClaimLength     = 256
+)
+
+// Custom claims are string valued, and can't override any reserved claim
+//
+// Values are templates, where any `{{variable}}` must be one of `claimTemplateVariables`
+func ValidateCustomClaims(claims map[string]string) (string, bool) {
+	if len(claims) > maxCustomClaims {
+		return "custom_claims", false
+	}
+
+	for name, value := range claims {
+		if name == "" || len(name) > maxCustomClaimNameLength || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+			return "custom_claims", false
+		}
+		if IsReservedClaim(name) || len(value) > maxCustomClaimLength {
+			return "custom_claims", false
+		}
+		for _, match := range claimTemplatePattern.FindAllStringSubmatch(value, -1) {
+			if !claimTemplateVariables[match[1]] {
+				return "custom_claims", false
+			}
+		}
+	}
+
+	return "", true
+}
+
+// Replaces the `{{variable}}`s of a custom claim's value
+func ExpandClaimTemplate(value string, variables map[string]string) string {
+	return claimTemplatePattern.ReplaceAllStringFunc(value, func(match string) string {
+		return variables[claimTemplatePattern.FindStringSubmatch(match)[1]]
+	})
+}
+
+// Redirect URIs must be absolute and without a fragment, see https://datatracker.ietf.org/doc/html/rfc6749#section-3.1.2
+//
+// Custom schemes (e.g. `com.kidsloop.app:/callback`) are allowed for mobile apps, but plain `http` only for localhost
+func ValidRedirectURIs(redirectURIs []string) bool {
+	for _, redirectURI := range redirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || strings.Contains(redirectURI, "#") {
+			return false
+		}
+		if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" && u.Hostname() != "::1" {
+			return false
+		}
+	}
+	return true
 }
@@ -1,33 +1,292 @@
 package client
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/KL-Engineering/oauth2-server/internal/utils"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
 )
 
 func TestJSONMarshal(t *testing.T) {
 	a := assert.New(t)
 
 	client := Client{
-		ID:           uuid.NewString(),
-		Name:         "Test",
-		SecretPrefix: "abc",
-		SecretHash:   "abcdef",
-		AndroidID:    uuid.NewString(),
-		AccountID:    uuid.NewString(),
+		ID:               uuid.NewString(),
+		Name:             "Test",
+		SecretPrefix:     "abc",
+		SecretHash:       "abcdef",
+		AndroidID:        uuid.NewString(),
+		AccountID:        uuid.NewString(),
+		AllowedScopes:    []string{"foo", "bar.*"},
+		AllowedAudiences: []string{"https://api.kidsloop.live"},
+		RedirectURIs:     []string{"com.kidsloop.app:/callback"},
 	}
 
 	bytes, err := json.Marshal(client)
 	a.NoError(err)
 
 	expected := utils.Must(json.Marshal(map[string]interface{}{
-		"id":            client.ID,
-		"name":          client.Name,
-		"secret_prefix": client.SecretPrefix,
+		"id":                client.ID,
+		"name":              client.Name,
+		"secret_prefix":     client.SecretPrefix,
+		"allowed_scopes":    client.AllowedScopes,
+		"allowed_audiences": client.AllowedAudiences,
+		"redirect_uris":     client.RedirectURIs,
 	}))
 	a.JSONEq(string(bytes), string(expected), "Does not include 'secret'")
 }
+
+func TestValidScopes(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidScopes(nil))
+	a.True(ValidScopes([]string{"foo", "foo.bar", "foo.*", "urn:foo:bar"}))
+
+	a.False(ValidScopes([]string{""}), "Empty scope")
+	a.False(ValidScopes([]string{"foo bar"}), "Scopes are space delimited")
+	a.False(ValidScopes([]string{`foo"`}))
+	a.False(ValidScopes([]string{`foo\\`}))
+	a.False(ValidScopes([]string{"föö"}))
+}
+
+func TestValidAudiences(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidAudiences(nil))
+	a.True(ValidAudiences([]string{"https://api.kidsloop.live", "assessments"}))
+
+	a.False(ValidAudiences([]string{""}), "Empty audience")
+	a.False(ValidAudiences([]string{"foo bar"}), "Audiences are space delimited")
+	a.False(ValidAudiences([]string{"foo\tbar"}))
+}
+
+func TestValidTokenFormat(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidTokenFormat(""), "Default")
+	a.True(ValidTokenFormat(JWTTokenFormat))
+	a.True(ValidTokenFormat(OpaqueTokenFormat))
+
+	a.False(ValidTokenFormat("JWT"))
+	a.False(ValidTokenFormat("hmac"))
+}
+
+func TestValidSecretGracePeriod(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidSecretGracePeriod(0), "Revoked immediately")
+	a.True(ValidSecretGracePeriod(3600))
+	a.True(ValidSecretGracePeriod(int64(MaxSecretGracePeriod.Seconds())))
+
+	a.False(ValidSecretGracePeriod(-1))
+	a.False(ValidSecretGracePeriod(int64(MaxSecretGracePeriod.Seconds()) + 1))
+}
+
+func TestValidPreviousSecretHash(t *testing.T) {
+	a := assert.New(t)
+
+	client := Client{PreviousSecretHash: "abcdef", PreviousSecretExpiresAt: time.Now().Add(time.Minute).Unix()}
+	a.Equal("abcdef", client.ValidPreviousSecretHash())
+
+	client.PreviousSecretExpiresAt = time.Now().Add(-time.Minute).Unix()
+	a.Empty(client.ValidPreviousSecretHash(), "Expired")
+
+	a.Empty((&Client{}).ValidPreviousSecretHash(), "Never rotated")
+}
+
+func TestValidRedirectURIs(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(ValidRedirectURIs(nil))
+	a.True(ValidRedirectURIs([]string{"https://example.com/callback", "com.kidsloop.app:/callback"}))
+	a.True(ValidRedirectURIs([]string{"http://localhost:8080/callback", "http://127.0.0.1/callback"}))
+
+	a.False(ValidRedirectURIs([]string{"/callback"}), "Must be absolute")
+	a.False(ValidRedirectURIs([]string{"https://example.com/callback#foo"}), "Must not have a fragment")
+	a.False(ValidRedirectURIs([]string{"http://example.com/callback"}), "http is only allowed for localhost")
+}
+
+func TestValidateAuthentication(t *testing.T) {
+	a := assert.New(t)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+
+	jwks := &JSONWebKeySet{jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &privateKey.PublicKey, KeyID: "1", Use: "sig"},
+	}}}
+	noUseJWKS := &JSONWebKeySet{jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &privateKey.PublicKey, KeyID: "1"},
+	}}}
+	encJWKS := &JSONWebKeySet{jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &privateKey.PublicKey, KeyID: "1", Use: "enc"},
+	}}}
+	privateJWKS := &JSONWebKeySet{jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: privateKey, KeyID: "1", Use: "sig"},
+	}}}
+
+	for _, tc := range []struct {
+		method     string
+		signingAlg string
+		jwks       *JSONWebKeySet
+		jwksURI    string
+		param      string
+	}{
+		{method: ""},
+		{method: ClientSecretBasic},
+		{method: ClientSecretPost},
+		{method: ClientSecretBasic, jwks: jwks, param: "jwks"},
+		{method: ClientSecretBasic, jwksURI: "https://example.com/jwks.json", param: "jwks_uri"},
+		{method: ClientSecretBasic, signingAlg: "RS256", param: "token_endpoint_auth_signing_alg"},
+		{method: PrivateKeyJWT, jwks: jwks},
+		{method: PrivateKeyJWT, jwks: jwks, signingAlg: "PS256"},
+		{method: PrivateKeyJWT, jwksURI: "https://example.com/jwks.json"},
+		{method: PrivateKeyJWT, param: "jwks"},
+		{method: PrivateKeyJWT, jwks: jwks, jwksURI: "https://example.com/jwks.json", param: "jwks"},
+		{method: PrivateKeyJWT, jwks: noUseJWKS},
+		{method: PrivateKeyJWT, jwks: encJWKS, param: "jwks"},
+		{method: PrivateKeyJWT, jwks: privateJWKS, param: "jwks"},
+		{method: PrivateKeyJWT, jwksURI: "http://example.com/jwks.json", param: "jwks_uri"},
+		{method: PrivateKeyJWT, jwks: jwks, signingAlg: "HS256", param: "token_endpoint_auth_signing_alg"},
+		{method: None},
+		{method: None, jwks: jwks, param: "jwks"},
+		{method: TLSClientAuth},
+		{method: SelfSignedTLSClientAuth, signingAlg: "RS256", param: "token_endpoint_auth_signing_alg"},
+		{method: "client_secret_jwt", param: "token_endpoint_auth_method"},
+	} {
+		param, ok := ValidateAuthentication(tc.method, tc.signingAlg, tc.jwks, tc.jwksURI)
+		a.Equal(tc.param == "", ok, "%+v", tc)
+		a.Equal(tc.param, param, "%+v", tc)
+	}
+}
+
+func TestJSONWebKeySetAttributeValue(t *testing.T) {
+	a := assert.New(t)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+
+	jwks := &JSONWebKeySet{jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &privateKey.PublicKey, KeyID: "1", Algorithm: "RS256", Use: "sig"},
+	}}}
+
+	av, err := attributevalue.Marshal(jwks)
+	a.NoError(err)
+
+	var got JSONWebKeySet
+	a.NoError(attributevalue.Unmarshal(av, &got))
+
+	a.Len(got.Keys, 1)
+	a.Equal("1", got.Keys[0].KeyID)
+	a.True(got.Keys[0].IsPublic())
+}
+
+func TestValidateGrantTypes(t *testing.T) {
+	a := assert.New(t)
+
+	redirectURIs := []string{"https://example.com/callback"}
+
+	for _, tc := range []struct {
+		grantTypes   []string
+		method       string
+		redirectURIs []string
+		param        string
+	}{
+		{},
+		{grantTypes: []string{ClientCredentials}},
+		{grantTypes: []string{DeviceCode, RefreshToken}, method: None},
+		{grantTypes: []string{AuthorizationCode, RefreshToken}, redirectURIs: redirectURIs},
+		{method: None, redirectURIs: redirectURIs},
+		{method: None, param: "redirect_uris"},
+		{grantTypes: []string{AuthorizationCode}, param: "redirect_uris"},
+		{grantTypes: []string{ClientCredentials}, method: None, param: "grant_types"},
+		{grantTypes: []string{TokenExchange}},
+		{grantTypes: []string{TokenExchange}, method: None, redirectURIs: redirectURIs, param: "grant_types"},
+		{grantTypes: []string{"password"}, param: "grant_types"},
+	} {
+		param, ok := ValidateGrantTypes(tc.grantTypes, tc.method, tc.redirectURIs)
+		a.Equal(tc.param == "", ok, "%+v", tc)
+		a.Equal(tc.param, param, "%+v", tc)
+	}
+}
+
+func TestValidateTLSClientAuth(t *testing.T) {
+	a := assert.New(t)
+
+	thumbprint := "y8Dnd8W0dMyTxj1LU3CgUVjVCfjFsA1Qx3sHr2g7y4k"
+
+	for _, tc := range []struct {
+		method         string
+		subjectDN      string
+		spkiThumbprint string
+		param          string
+	}{
+		{},
+		{method: TLSClientAuth, subjectDN: "CN=partner.example.com,O=Partner"},
+		{method: TLSClientAuth, param: "tls_client_auth_subject_dn"},
+		{method: TLSClientAuth, subjectDN: "CN=partner.example.com", spkiThumbprint: thumbprint, param: "tls_client_auth_spki_thumbprint"},
+		{method: SelfSignedTLSClientAuth, spkiThumbprint: thumbprint},
+		{method: SelfSignedTLSClientAuth, param: "tls_client_auth_spki_thumbprint"},
+		{method: SelfSignedTLSClientAuth, spkiThumbprint: "not-a-thumbprint", param: "tls_client_auth_spki_thumbprint"},
+		{method: SelfSignedTLSClientAuth, subjectDN: "CN=device", spkiThumbprint: thumbprint, param: "tls_client_auth_subject_dn"},
+		{method: ClientSecretBasic, subjectDN: "CN=partner.example.com", param: "tls_client_auth_subject_dn"},
+		{method: PrivateKeyJWT, spkiThumbprint: thumbprint, param: "tls_client_auth_spki_thumbprint"},
+	} {
+		param, ok := ValidateTLSClientAuth(tc.method, tc.subjectDN, tc.spkiThumbprint)
+		a.Equal(tc.param == "", ok, "%+v", tc)
+		a.Equal(tc.param, param, "%+v", tc)
+	}
+}
+
+func TestValidateCustomClaims(t *testing.T) {
+	a := assert.New(t)
+
+	tooMany := map[string]string{}
+	for i := 0; i <= maxCustomClaims; i++ {
+		tooMany[fmt.Sprintf("claim_%d", i)] = "value"
+	}
+
+	for _, claims := range []map[string]string{
+		nil,
+		{},
+		{"region": "eu-west-2", "partner_code": "ACME"},
+		{"tenant": "acme-{{account_id}}", "device": "{{ android_id }}"},
+	} {
+		_, ok := ValidateCustomClaims(claims)
+		a.True(ok, "%+v", claims)
+	}
+
+	for _, claims := range []map[string]string{
+		{"sub": "someone-else"},
+		{"account_id": "another-account"},
+		{"cnf": "unbound"},
+		{"": "value"},
+		{"region name": "value"},
+		{"region": strings.Repeat("a", maxCustomClaimLength+1)},
+		{"tenant": "{{password}}"},
+		tooMany,
+	} {
+		param, ok := ValidateCustomClaims(claims)
+		a.False(ok, "%+v", claims)
+		a.Equal("custom_claims", param)
+	}
+}
+
+func TestExpandClaimTemplate(t *testing.T) {
+	a := assert.New(t)
+
+	variables := map[string]string{"account_id": "123", "sub": "456"}
+
+	a.Equal("eu-west-2", ExpandClaimTemplate("eu-west-2", variables))
+	a.Equal("acme-123", ExpandClaimTemplate("acme-{{account_id}}", variables))
+	a.Equal("123/456", ExpandClaimTemplate("{{ account_id }}/{{sub}}", variables))
+}
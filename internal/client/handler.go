@@ -2,25 +2,39 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/KL-Engineering/oauth2-server/internal/account"
 	"github.com/KL-Engineering/oauth2-server/internal/core"
 	"github.com/KL-Engineering/oauth2-server/internal/crypto"
 	"github.com/KL-Engineering/oauth2-server/internal/errorsx"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 )
 
 type Handler struct {
-	repo Repository
+	repo     Repository
+	lockouts *lockout.Store
+	opts     HandlerOptions
 }
 
-func NewHandler(client *dynamodb.Client) *Handler {
+type HandlerOptions struct {
+	// Verified Client secrets, which are invalidated when a Client's secret is rotated or it is deleted.
+	// Should match `oauth2.ProviderOptions.SecretCache`.
+	SecretCache *secretcache.Cache
+}
+
+func NewHandler(client *dynamodb.Client, opts HandlerOptions) *Handler {
 	return &Handler{
-		repo: *NewRepository(client),
+		repo:     *NewRepository(client),
+		lockouts: lockout.NewStore(client, lockout.DefaultPolicy),
+		opts:     opts,
 	}
 }
 
@@ -31,6 +45,8 @@ func (h *Handler) SetupRouter(router *httprouter.Router) {
 	router.DELETE("/clients/:id", h.Delete())
 	router.PATCH("/clients/:id", h.Update())
 	router.PATCH("/clients/:id/secret", h.RegenerateSecret())
+	router.DELETE("/clients/:id/secret/previous", h.RevokePreviousSecret())
+	router.DELETE("/clients/:id/lockout", h.ClearLockout())
 }
 
 type ListResponse struct {
@@ -58,13 +74,40 @@ func (h *Handler) List() httprouter.Handle {
 }
 
 type CreateClientRequest struct {
-	Name string `json:"name"`
+	Name                        string            `json:"name"`
+	AllowedScopes               []string          `json:"allowed_scopes"`
+	AllowedAudiences            []string          `json:"allowed_audiences"`
+	TokenEndpointAuthMethod     string            `json:"token_endpoint_auth_method"`
+	TokenEndpointAuthSigningAlg string            `json:"token_endpoint_auth_signing_alg"`
+	JWKS                        *JSONWebKeySet    `json:"jwks"`
+	JWKSURI                     string            `json:"jwks_uri"`
+	RedirectURIs                []string          `json:"redirect_uris"`
+	GrantTypes                  []string          `json:"grant_types"`
+	TLSClientAuthSubjectDN      string            `json:"tls_client_auth_subject_dn"`
+	TLSClientAuthSPKIThumbprint string            `json:"tls_client_auth_spki_thumbprint"`
+	TokenLifespan               int64             `json:"token_lifespan"`
+	CustomClaims                map[string]string `json:"custom_claims"`
+	TokenFormat                 string            `json:"token_format"`
 }
 
 type CreateClientResponse struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Secret string `json:"secret"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Not returned for public or mutual TLS Clients, which have no secret
+	Secret                      string            `json:"secret,omitempty"`
+	AllowedScopes               []string          `json:"allowed_scopes"`
+	AllowedAudiences            []string          `json:"allowed_audiences"`
+	TokenEndpointAuthMethod     string            `json:"token_endpoint_auth_method,omitempty"`
+	TokenEndpointAuthSigningAlg string            `json:"token_endpoint_auth_signing_alg,omitempty"`
+	JWKS                        *JSONWebKeySet    `json:"jwks,omitempty"`
+	JWKSURI                     string            `json:"jwks_uri,omitempty"`
+	RedirectURIs                []string          `json:"redirect_uris"`
+	GrantTypes                  []string          `json:"grant_types,omitempty"`
+	TLSClientAuthSubjectDN      string            `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSPKIThumbprint string            `json:"tls_client_auth_spki_thumbprint,omitempty"`
+	TokenLifespan               int64             `json:"token_lifespan,omitempty"`
+	CustomClaims                map[string]string `json:"custom_claims,omitempty"`
+	TokenFormat                 string            `json:"token_format,omitempty"`
 }
 
 func (h *Handler) Create() httprouter.Handle {
@@ -81,6 +124,91 @@ func (h *Handler) Create() httprouter.Handle {
 			return
 		}
 
+		if !ValidScopes(req.AllowedScopes) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("allowed_scopes"),
+			)
+			return
+		}
+
+		if !ValidAudiences(req.AllowedAudiences) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("allowed_audiences"),
+			)
+			return
+		}
+
+		if param, ok := ValidateAuthentication(
+			req.TokenEndpointAuthMethod,
+			req.TokenEndpointAuthSigningAlg,
+			req.JWKS,
+			req.JWKSURI,
+		); !ok {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError(param),
+			)
+			return
+		}
+
+		if param, ok := ValidateTLSClientAuth(
+			req.TokenEndpointAuthMethod,
+			req.TLSClientAuthSubjectDN,
+			req.TLSClientAuthSPKIThumbprint,
+		); !ok {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError(param),
+			)
+			return
+		}
+
+		if !ValidRedirectURIs(req.RedirectURIs) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("redirect_uris"),
+			)
+			return
+		}
+
+		if param, ok := ValidateGrantTypes(
+			req.GrantTypes,
+			req.TokenEndpointAuthMethod,
+			req.RedirectURIs,
+		); !ok {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError(param),
+			)
+			return
+		}
+
+		if !account.ValidTokenLifespan(req.TokenLifespan) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_lifespan"),
+			)
+			return
+		}
+
+		if param, ok := ValidateCustomClaims(req.CustomClaims); !ok {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError(param),
+			)
+			return
+		}
+
+		if !ValidTokenFormat(req.TokenFormat) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_format"),
+			)
+			return
+		}
+
 		// TODO will in future need to accept external `android_id` from accounts rather than generating one here
 		// but this functionality is not available currently
 		androidID, err := uuid.NewRandom()
@@ -90,32 +218,67 @@ func (h *Handler) Create() httprouter.Handle {
 			return
 		}
 
-		secret, err := crypto.GenerateSecret()
-		if err != nil {
-			log.Printf("ERROR: crypto.GenerateSecret: %v", err)
-			core.InternalErrorResponse(w)
-			return
+		var secret string
+		if HasSecret(req.TokenEndpointAuthMethod) {
+			secret, err = crypto.GenerateSecret()
+			if err != nil {
+				log.Printf("ERROR: crypto.GenerateSecret: %v", err)
+				core.InternalErrorResponse(w)
+				return
+			}
 		}
 
 		client, err := h.repo.Create(ctx, CreateOptions{
-			Secret:    secret,
-			Name:      req.Name,
-			AndroidID: androidID.String(),
-			AccountID: accountID,
+			Secret:           secret,
+			Name:             req.Name,
+			AndroidID:        androidID.String(),
+			AccountID:        accountID,
+			AllowedScopes:    req.AllowedScopes,
+			AllowedAudiences: req.AllowedAudiences,
+
+			TokenEndpointAuthMethod:     req.TokenEndpointAuthMethod,
+			TokenEndpointAuthSigningAlg: req.TokenEndpointAuthSigningAlg,
+			JWKS:                        req.JWKS,
+			JWKSURI:                     req.JWKSURI,
+			RedirectURIs:                req.RedirectURIs,
+			GrantTypes:                  req.GrantTypes,
+			TLSClientAuthSubjectDN:      req.TLSClientAuthSubjectDN,
+			TLSClientAuthSPKIThumbprint: req.TLSClientAuthSPKIThumbprint,
+			TokenLifespan:               req.TokenLifespan,
+			CustomClaims:                req.CustomClaims,
+			TokenFormat:                 req.TokenFormat,
 		})
 		if err != nil {
 			// TODO specific codes in case of bad request
 			log.Printf("ERROR: Create Client: %v", err)
-			core.InternalErrorResponse(w)
+			if errors.Is(err, crypto.ErrHashingUnavailable) {
+				core.ServiceUnavailableResponse(w)
+			} else {
+				core.InternalErrorResponse(w)
+			}
 			return
 		}
 
 		log.Printf("INFO: Created Client(id=%s)", client.ID)
 
 		clientResponse := CreateClientResponse{
-			ID:     client.ID,
-			Name:   client.Name,
-			Secret: secret,
+			ID:               client.ID,
+			Name:             client.Name,
+			Secret:           secret,
+			AllowedScopes:    client.AllowedScopes,
+			AllowedAudiences: client.AllowedAudiences,
+
+			TokenEndpointAuthMethod:     client.TokenEndpointAuthMethod,
+			TokenEndpointAuthSigningAlg: client.TokenEndpointAuthSigningAlg,
+			JWKS:                        client.JWKS,
+			JWKSURI:                     client.JWKSURI,
+			RedirectURIs:                client.RedirectURIs,
+			GrantTypes:                  client.GrantTypes,
+			TLSClientAuthSubjectDN:      client.TLSClientAuthSubjectDN,
+			TLSClientAuthSPKIThumbprint: client.TLSClientAuthSPKIThumbprint,
+			TokenLifespan:               client.TokenLifespan,
+			CustomClaims:                client.CustomClaims,
+			TokenFormat:                 client.TokenFormat,
 		}
 
 		w.WriteHeader(http.StatusCreated)
@@ -150,7 +313,7 @@ func (h *Handler) Delete() httprouter.Handle {
 		accountID := account.GetAccountIdFromCtx(ctx)
 		id := ps.ByName("id")
 
-		if err := h.repo.Delete(ctx, DeleteOptions{accountID: accountID, id: id}); err != nil {
+		if err := h.repo.Delete(ctx, DeleteOptions{AccountID: accountID, ID: id}); err != nil {
 			if err == core.ErrNotFound {
 				core.NotFoundResponse(w, id)
 			} else {
@@ -160,13 +323,58 @@ func (h *Handler) Delete() httprouter.Handle {
 			return
 		}
 
+		h.invalidateSecrets(id)
+
 		w.WriteHeader(http.StatusNoContent)
 		w.Header().Set("Content-Type", "application/json")
 	})
 }
 
+// Forgets the failed authentications of a Client (from every source IP), so it can authenticate again immediately
+//
+// Lockouts of source IPs aren't cleared, and expire by themselves
+func (h *Handler) ClearLockout() httprouter.Handle {
+	return account.Middleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := r.Context()
+		accountID := account.GetAccountIdFromCtx(ctx)
+		id := ps.ByName("id")
+
+		// Only the Client's own account may clear its lockout
+		if _, err := h.repo.Get(ctx, GetOptions{AccountID: accountID, ID: id}); err != nil {
+			if err == core.ErrNotFound {
+				core.NotFoundResponse(w, id)
+			} else {
+				log.Printf("ERROR: Get Client: %v", err)
+				core.InternalErrorResponse(w)
+			}
+			return
+		}
+
+		if err := h.lockouts.ResetPartition(ctx, lockout.ClientPartition(id)); err != nil {
+			log.Printf("ERROR: Clear Client lockout: %v", err)
+			core.InternalErrorResponse(w)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 type UpdateClientRequest struct {
-	Name string `json:"name"`
+	Name             string         `json:"name"`
+	AllowedScopes    []string       `json:"allowed_scopes"`
+	AllowedAudiences []string       `json:"allowed_audiences"`
+	JWKS             *JSONWebKeySet `json:"jwks"`
+	JWKSURI          string         `json:"jwks_uri"`
+	RedirectURIs     []string       `json:"redirect_uris"`
+	// Omitted to leave unchanged, or 0 for the account's default
+	TokenLifespan *int64 `json:"token_lifespan"`
+	// Omitted to leave unchanged, or empty to remove all claims
+	CustomClaims map[string]string `json:"custom_claims"`
+	// Omitted to leave unchanged
+	TokenFormat string `json:"token_format"`
+	// Omitted to leave unchanged
+	Disabled *bool `json:"disabled"`
 }
 
 func (h *Handler) Update() httprouter.Handle {
@@ -184,12 +392,96 @@ func (h *Handler) Update() httprouter.Handle {
 			return
 		}
 
+		if !ValidScopes(req.AllowedScopes) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("allowed_scopes"),
+			)
+			return
+		}
+
+		if !ValidAudiences(req.AllowedAudiences) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("allowed_audiences"),
+			)
+			return
+		}
+
+		if !ValidRedirectURIs(req.RedirectURIs) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("redirect_uris"),
+			)
+			return
+		}
+
+		if req.TokenLifespan != nil && !account.ValidTokenLifespan(*req.TokenLifespan) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_lifespan"),
+			)
+			return
+		}
+
+		if param, ok := ValidateCustomClaims(req.CustomClaims); !ok {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError(param),
+			)
+			return
+		}
+
+		if !ValidTokenFormat(req.TokenFormat) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_format"),
+			)
+			return
+		}
+
+		if req.JWKS != nil || req.JWKSURI != "" {
+			// Public keys can only be replaced on a `private_key_jwt` Client
+			existing, err := h.repo.Get(ctx, GetOptions{AccountID: accountID, ID: id})
+			if err != nil {
+				if err == core.ErrNotFound {
+					core.NotFoundResponse(w, id)
+				} else {
+					log.Printf("ERROR: Get Client: %v", err)
+					core.InternalErrorResponse(w)
+				}
+				return
+			}
+
+			if param, ok := ValidateAuthentication(
+				existing.TokenEndpointAuthMethod,
+				existing.TokenEndpointAuthSigningAlg,
+				req.JWKS,
+				req.JWKSURI,
+			); !ok {
+				core.BadRequestResponse(
+					w,
+					errorsx.InvalidArgumentError(param),
+				)
+				return
+			}
+		}
+
 		client, err := h.repo.Update(
 			ctx,
 			UpdateOptions{
-				AccountID: accountID,
-				ID:        id,
-				Name:      req.Name,
+				AccountID:        accountID,
+				ID:               id,
+				Name:             req.Name,
+				AllowedScopes:    req.AllowedScopes,
+				AllowedAudiences: req.AllowedAudiences,
+				JWKS:             req.JWKS,
+				JWKSURI:          req.JWKSURI,
+				RedirectURIs:     req.RedirectURIs,
+				TokenLifespan:    req.TokenLifespan,
+				CustomClaims:     req.CustomClaims,
+				TokenFormat:      req.TokenFormat,
+				Disabled:         req.Disabled,
 			},
 		)
 
@@ -203,12 +495,24 @@ func (h *Handler) Update() httprouter.Handle {
 			return
 		}
 
+		// A disabled Client's cached secret would otherwise still be verified
+		if req.Disabled != nil && *req.Disabled {
+			h.invalidateSecrets(id)
+		}
+
 		core.JSONResponse(w, client)
 	})
 }
 
+type RegenerateSecretRequest struct {
+	// Seconds, where nil is `DefaultSecretGracePeriod`
+	GracePeriod *int64 `json:"grace_period"`
+}
+
 type RegenerateSecretResponse struct {
 	Secret string `json:"secret"`
+	// Unix seconds, omitted if the previous secret was revoked
+	PreviousSecretExpiresAt int64 `json:"previous_secret_expires_at,omitempty"`
 }
 
 func (h *Handler) RegenerateSecret() httprouter.Handle {
@@ -217,6 +521,50 @@ func (h *Handler) RegenerateSecret() httprouter.Handle {
 		accountID := account.GetAccountIdFromCtx(ctx)
 		id := ps.ByName("id")
 
+		var req RegenerateSecretRequest
+		// The body is optional
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				core.BadRequestResponse(
+					w,
+					errorsx.InvalidArgumentError("grace_period"),
+				)
+				return
+			}
+		}
+
+		gracePeriod := DefaultSecretGracePeriod
+		if req.GracePeriod != nil {
+			if !ValidSecretGracePeriod(*req.GracePeriod) {
+				core.BadRequestResponse(
+					w,
+					errorsx.InvalidArgumentError("grace_period"),
+				)
+				return
+			}
+			gracePeriod = time.Duration(*req.GracePeriod) * time.Second
+		}
+
+		existing, err := h.repo.Get(ctx, GetOptions{AccountID: accountID, ID: id})
+		if err != nil {
+			if err == core.ErrNotFound {
+				core.NotFoundResponse(w, id)
+			} else {
+				log.Printf("ERROR: Get Client: %v", err)
+				core.InternalErrorResponse(w)
+			}
+			return
+		}
+
+		// Public and mutual TLS Clients have no secret
+		if !HasSecret(existing.TokenEndpointAuthMethod) {
+			core.BadRequestResponse(
+				w,
+				errorsx.InvalidArgumentError("token_endpoint_auth_method"),
+			)
+			return
+		}
+
 		secret, err := crypto.GenerateSecret()
 		if err != nil {
 			log.Printf("ERROR: crypto.GenerateSecret: %v", err)
@@ -224,20 +572,61 @@ func (h *Handler) RegenerateSecret() httprouter.Handle {
 			return
 		}
 
-		_, err = h.repo.Update(ctx, UpdateOptions{AccountID: accountID, ID: id, Secret: secret})
+		// The secret being replaced remains valid for the grace period, so consumers can be updated
+		client, err := h.repo.Update(ctx, UpdateOptions{AccountID: accountID, ID: id, Secret: secret, SecretGracePeriod: gracePeriod})
 
 		if err != nil {
 			if err == core.ErrNotFound {
 				core.NotFoundResponse(w, id)
 			} else {
 				log.Printf("ERROR: Update Client: %v", err)
-				core.InternalErrorResponse(w)
+				if errors.Is(err, crypto.ErrHashingUnavailable) {
+					core.ServiceUnavailableResponse(w)
+				} else {
+					core.InternalErrorResponse(w)
+				}
 			}
 			return
 		}
 
+		h.invalidateSecrets(id)
+
 		core.JSONResponse(w, RegenerateSecretResponse{
-			Secret: secret,
+			Secret:                  secret,
+			PreviousSecretExpiresAt: client.PreviousSecretExpiresAt,
 		})
 	})
 }
+
+// Revokes the previous secret before its grace period ends, e.g. once every consumer has been
+// updated, or if it was leaked
+func (h *Handler) RevokePreviousSecret() httprouter.Handle {
+	return account.Middleware(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := r.Context()
+		accountID := account.GetAccountIdFromCtx(ctx)
+		id := ps.ByName("id")
+
+		_, err := h.repo.Update(ctx, UpdateOptions{AccountID: accountID, ID: id, RevokePreviousSecret: true})
+
+		if err != nil {
+			if err == core.ErrNotFound {
+				core.NotFoundResponse(w, id)
+			} else {
+				log.Printf("ERROR: Update Client: %v", err)
+				core.InternalErrorResponse(w)
+			}
+			return
+		}
+
+		h.invalidateSecrets(id)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Cached verifications can't outlive a secret on this instance, and expire soon after on others
+func (h *Handler) invalidateSecrets(id string) {
+	if h.opts.SecretCache != nil {
+		h.opts.SecretCache.Invalidate(id)
+	}
+}
@@ -9,10 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/KL-Engineering/oauth2-server/internal/account"
 	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/KL-Engineering/oauth2-server/internal/storage"
 	"github.com/KL-Engineering/oauth2-server/internal/utils"
 	"github.com/alexedwards/argon2id"
@@ -34,7 +38,7 @@ func TestListEmpty(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	r := httptest.NewRequest(http.MethodGet, "/clients", nil)
@@ -87,7 +91,7 @@ func TestList(t *testing.T) {
 	})
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	r := httptest.NewRequest(http.MethodGet, "/clients", nil)
@@ -114,7 +118,7 @@ func TestCreateNoBody(t *testing.T) {
 	a := assert.New(t)
 
 	db := utils.Must(storage.NewDynamoDBClient())
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	router := httprouter.New()
 	h.SetupRouter(router)
 
@@ -130,7 +134,7 @@ func TestCreateValid(t *testing.T) {
 	a := assert.New(t)
 
 	db := utils.Must(storage.NewDynamoDBClient())
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	router := httprouter.New()
 	h.SetupRouter(router)
 
@@ -177,11 +181,118 @@ func TestCreateValid(t *testing.T) {
 	a.True(passwordMatch)
 }
 
+func TestCreateWithAllowedScopes(t *testing.T) {
+	a := assert.New(t)
+
+	db := utils.Must(storage.NewDynamoDBClient())
+	h := NewHandler(db, HandlerOptions{})
+	router := httprouter.New()
+	h.SetupRouter(router)
+
+	body := &CreateClientRequest{Name: "Test client", AllowedScopes: []string{"foo", "bar.*"}}
+	buf := new(bytes.Buffer)
+	a.NoError(json.NewEncoder(buf).Encode(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/clients", buf)
+	w := httptest.NewRecorder()
+
+	accountID := uuid.New().String()
+	r.Header.Add(account.IDHeader, accountID)
+
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusCreated, res.StatusCode)
+
+	var response CreateClientResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&response))
+	a.Equal(body.AllowedScopes, response.AllowedScopes)
+
+	client, err := h.repo.Get(context.Background(), GetOptions{AccountID: accountID, ID: response.ID})
+	a.NoError(err)
+	a.Equal(body.AllowedScopes, client.AllowedScopes)
+}
+
+func TestCreateInvalidAllowedScopes(t *testing.T) {
+	a := assert.New(t)
+
+	db := utils.Must(storage.NewDynamoDBClient())
+	h := NewHandler(db, HandlerOptions{})
+	router := httprouter.New()
+	h.SetupRouter(router)
+
+	body := &CreateClientRequest{Name: "Test client", AllowedScopes: []string{"foo bar"}}
+	buf := new(bytes.Buffer)
+	a.NoError(json.NewEncoder(buf).Encode(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/clients", buf)
+	r.Header.Add(account.IDHeader, uuid.NewString())
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func TestCreatePublicClient(t *testing.T) {
+	a := assert.New(t)
+
+	db := utils.Must(storage.NewDynamoDBClient())
+	h := NewHandler(db, HandlerOptions{})
+	router := httprouter.New()
+	h.SetupRouter(router)
+
+	body := &CreateClientRequest{
+		Name:                    "Test client",
+		TokenEndpointAuthMethod: None,
+		RedirectURIs:            []string{"com.kidsloop.app:/callback"},
+	}
+	buf := new(bytes.Buffer)
+	a.NoError(json.NewEncoder(buf).Encode(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/clients", buf)
+	r.Header.Add(account.IDHeader, uuid.NewString())
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusCreated, res.StatusCode)
+
+	var response CreateClientResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&response))
+	a.Empty(response.Secret, "Public clients have no secret")
+	a.Equal(body.RedirectURIs, response.RedirectURIs)
+}
+
+func TestCreatePublicClientWithoutRedirectURIs(t *testing.T) {
+	a := assert.New(t)
+
+	db := utils.Must(storage.NewDynamoDBClient())
+	h := NewHandler(db, HandlerOptions{})
+	router := httprouter.New()
+	h.SetupRouter(router)
+
+	body := &CreateClientRequest{Name: "Test client", TokenEndpointAuthMethod: None}
+	buf := new(bytes.Buffer)
+	a.NoError(json.NewEncoder(buf).Encode(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/clients", buf)
+	r.Header.Add(account.IDHeader, uuid.NewString())
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
 func TestGetNotFound(t *testing.T) {
 	a := assert.New(t)
 
 	db := utils.Must(storage.NewDynamoDBClient())
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	router := httprouter.New()
 	h.SetupRouter(router)
 
@@ -200,7 +311,7 @@ func TestGetUnauthorized(t *testing.T) {
 	db := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	client, err := h.repo.Create(context.Background(), CreateOptions{
 		Secret:    "pa$$word",
 		Name:      "Test",
@@ -229,7 +340,7 @@ func TestGetValid(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	client, err := h.repo.Create(
@@ -268,7 +379,7 @@ func TestDeleteNotFound(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/clients/%s", uuid.New()), nil)
@@ -288,7 +399,7 @@ func TestDeleteUnauthorized(t *testing.T) {
 	db := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	client, err := h.repo.Create(context.Background(), CreateOptions{
 		Secret:    "pa$$word",
 		Name:      "Test",
@@ -315,7 +426,7 @@ func TestDelete(t *testing.T) {
 
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	client, err := h.repo.Create(
@@ -357,7 +468,7 @@ func TestUpdateNotFound(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	body := &UpdateClientRequest{Name: "Test2"}
@@ -381,7 +492,7 @@ func TestUpdateUnauthorized(t *testing.T) {
 	db := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(db)
+	h := NewHandler(db, HandlerOptions{})
 	client, err := h.repo.Create(context.Background(), CreateOptions{
 		Secret:    "pa$$word",
 		Name:      "Test",
@@ -412,7 +523,7 @@ func TestUpdate(t *testing.T) {
 
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	client, err := h.repo.Create(
@@ -447,6 +558,85 @@ func TestUpdate(t *testing.T) {
 	a.Equal(http.StatusOK, res.StatusCode)
 }
 
+func TestUpdateDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+
+	for _, disabled := range []bool{true, false} {
+		buf := new(bytes.Buffer)
+		a.NoError(json.NewEncoder(buf).Encode(&UpdateClientRequest{Disabled: &disabled}))
+
+		r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s", client.ID), buf)
+		r.Header.Add(account.IDHeader, accountID)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+		a.Equal(http.StatusOK, w.Code)
+
+		updated, err := h.repo.GetByID(context.Background(), client.ID)
+		a.NoError(err)
+		a.Equal(disabled, updated.Disabled)
+		a.Equal(client.Name, updated.Name, "Only the disabled flag has changed")
+	}
+}
+
+func TestUpdateAllowedScopes(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:        "pa$$word",
+			Name:          "Test1",
+			AndroidID:     uuid.NewString(),
+			AccountID:     accountID,
+			AllowedScopes: []string{"foo"},
+		},
+	)
+	a.NoError(err)
+
+	body := &UpdateClientRequest{AllowedScopes: []string{"bar"}}
+	buf := new(bytes.Buffer)
+	a.NoError(json.NewEncoder(buf).Encode(body))
+
+	r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s", client.ID), buf)
+	r.Header.Add(account.IDHeader, accountID)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	res := w.Result()
+
+	var response Client
+	a.NoError(json.NewDecoder(res.Body).Decode(&response))
+
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal(client.Name, response.Name, "Name is unchanged")
+	a.Equal([]string{"bar"}, response.AllowedScopes, "AllowedScopes have been updated")
+}
+
 func TestRegenerateSecret(t *testing.T) {
 	a := assert.New(t)
 
@@ -454,7 +644,7 @@ func TestRegenerateSecret(t *testing.T) {
 
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	client, err := h.repo.Create(
@@ -495,6 +685,105 @@ func TestRegenerateSecret(t *testing.T) {
 
 	a.True(utils.Must(argon2id.ComparePasswordAndHash(response.Secret, updatedClient.SecretHash)))
 	a.NotEqual(updatedClient.SecretHash, client.SecretHash)
+
+	a.Equal(client.SecretHash, updatedClient.ValidPreviousSecretHash(), "The previous secret is still accepted")
+	a.Equal(client.SecretPrefix, updatedClient.PreviousSecretPrefix)
+	a.Equal(updatedClient.PreviousSecretExpiresAt, response.PreviousSecretExpiresAt)
+	a.InDelta(time.Now().Add(DefaultSecretGracePeriod).Unix(), response.PreviousSecretExpiresAt, 5)
+}
+
+func TestRegenerateSecretWithoutGracePeriod(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+
+	for _, gracePeriod := range []string{"3600", "0"} {
+		r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s/secret", client.ID), strings.NewReader(fmt.Sprintf(`{"grace_period": %s}`, gracePeriod)))
+		r.Header.Add(account.IDHeader, accountID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		a.Equal(http.StatusOK, w.Result().StatusCode)
+	}
+
+	updatedClient, err := h.repo.Get(context.Background(), GetOptions{ID: client.ID, AccountID: accountID})
+	a.NoError(err)
+	a.Empty(updatedClient.PreviousSecretHash, "Rotating without a grace period revokes any previous secret")
+	a.Zero(updatedClient.PreviousSecretExpiresAt)
+}
+
+func TestRegenerateSecretInvalidGracePeriod(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+
+	r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s/secret", client.ID), strings.NewReader(`{"grace_period": -1}`))
+	r.Header.Add(account.IDHeader, accountID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	a.Equal(http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestRegenerateSecretInvalidatesSecretCache(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+	cache := utils.Must(secretcache.New(secretcache.DefaultPolicy))
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{SecretCache: cache})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+	cache.Add(client.ID, client.SecretHash, []byte("pa$$word"))
+
+	r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s/secret", client.ID), nil)
+	r.Header.Add(account.IDHeader, accountID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	a.Equal(http.StatusOK, w.Result().StatusCode)
+	a.False(cache.Verified(client.ID, client.SecretHash, []byte("pa$$word")), "Verifications are forgotten")
 }
 
 func TestRegenerateSecretNotFound(t *testing.T) {
@@ -503,7 +792,7 @@ func TestRegenerateSecretNotFound(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	r := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/clients/%s/secret", uuid.NewString()), nil)
@@ -520,7 +809,7 @@ func TestRegenerateSecretUnauthorized(t *testing.T) {
 	dynamoClient := utils.Must(storage.NewDynamoDBClient())
 
 	router := httprouter.New()
-	h := NewHandler(dynamoClient)
+	h := NewHandler(dynamoClient, HandlerOptions{})
 	h.SetupRouter(router)
 
 	client, err := h.repo.Create(
@@ -541,3 +830,138 @@ func TestRegenerateSecretUnauthorized(t *testing.T) {
 
 	a.Equal(http.StatusNotFound, res.StatusCode, "Client belongs to another AccountID")
 }
+
+func TestRevokePreviousSecret(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.New().String()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+
+	_, err = h.repo.Update(context.Background(), UpdateOptions{AccountID: accountID, ID: client.ID, Secret: "n3w-pa$$word", SecretGracePeriod: time.Hour})
+	a.NoError(err)
+
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/clients/%s/secret/previous", client.ID), nil)
+	r.Header.Add(account.IDHeader, accountID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	a.Equal(http.StatusNoContent, w.Result().StatusCode)
+
+	updatedClient, err := h.repo.Get(context.Background(), GetOptions{ID: client.ID, AccountID: accountID})
+	a.NoError(err)
+	a.Empty(updatedClient.ValidPreviousSecretHash(), "The previous secret is revoked")
+	a.Empty(updatedClient.PreviousSecretPrefix)
+	a.True(utils.Must(argon2id.ComparePasswordAndHash("n3w-pa$$word", updatedClient.SecretHash)), "The current secret is unchanged")
+}
+
+func TestRevokePreviousSecretUnauthorized(t *testing.T) {
+	a := assert.New(t)
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test1",
+			AndroidID: uuid.NewString(),
+			AccountID: uuid.NewString(),
+		},
+	)
+	a.NoError(err)
+
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/clients/%s/secret/previous", client.ID), nil)
+	r.Header.Add(account.IDHeader, uuid.NewString())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	a.Equal(http.StatusNotFound, w.Result().StatusCode, "Client belongs to another AccountID")
+}
+
+func TestClearLockout(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.NewString()
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test",
+			AndroidID: uuid.NewString(),
+			AccountID: accountID,
+		},
+	)
+	a.NoError(err)
+
+	lockouts := lockout.NewStore(dynamoClient, lockout.Policy{Threshold: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Hour})
+	// Locked out from two source IPs
+	keys := []lockout.Key{lockout.ClientKey(client.ID, "192.0.2.1"), lockout.ClientKey(client.ID, "192.0.2.2")}
+	for _, key := range keys {
+		counter, err := lockouts.RecordFailure(context.Background(), key)
+		a.NoError(err)
+		a.NotZero(counter.RetryAfter(), "Client is locked out")
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/clients/%s/lockout", client.ID), nil)
+	r.Header.Add(account.IDHeader, accountID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusNoContent, res.StatusCode)
+
+	for _, key := range keys {
+		counter, err := lockouts.Get(context.Background(), key)
+		a.NoError(err)
+		a.Zero(counter.Failures)
+		a.Zero(counter.RetryAfter(), "Lockout is cleared from every source IP")
+	}
+}
+
+func TestClearLockoutUnauthorized(t *testing.T) {
+	a := assert.New(t)
+
+	dynamoClient := utils.Must(storage.NewDynamoDBClient())
+	router := httprouter.New()
+	h := NewHandler(dynamoClient, HandlerOptions{})
+	h.SetupRouter(router)
+
+	client, err := h.repo.Create(
+		context.Background(), CreateOptions{
+			Secret:    "pa$$word",
+			Name:      "Test",
+			AndroidID: uuid.NewString(),
+			AccountID: uuid.NewString(),
+		},
+	)
+	a.NoError(err)
+
+	r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/clients/%s/lockout", client.ID), nil)
+	r.Header.Add(account.IDHeader, uuid.NewString())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusNotFound, res.StatusCode, "Client belongs to another AccountID")
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// A Client's public keys, stored in DynamoDB as its JSON encoding
+type JSONWebKeySet struct {
+	jose.JSONWebKeySet
+}
+
+func (k *JSONWebKeySet) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	bytes, err := json.Marshal(k)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal JSONWebKeySet: %w", err)
+	}
+	return &types.AttributeValueMemberS{Value: string(bytes)}, nil
+}
+
+func (k *JSONWebKeySet) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	s, ok := av.(*types.AttributeValueMemberS)
+	if !ok {
+		return fmt.Errorf("JSONWebKeySet: unexpected attribute type %T", av)
+	}
+	if err := json.Unmarshal([]byte(s.Value), k); err != nil {
+		return fmt.Errorf("json.Unmarshal JSONWebKeySet: %w", err)
+	}
+	return nil
+}
+
+// Only public signing keys may be registered. `use` is optional, so a key without one is assumed
+// to be for signing.
+func (k *JSONWebKeySet) Valid() bool {
+	if len(k.Keys) == 0 {
+		return false
+	}
+	for _, key := range k.Keys {
+		if !key.Valid() || !key.IsPublic() || key.Use == "enc" {
+			return false
+		}
+	}
+	return true
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/KL-Engineering/oauth2-server/internal/core"
-	"github.com/alexedwards/argon2id"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
@@ -35,7 +37,10 @@ type ListOptions struct {
 }
 
 func (repo *Repository) List(ctx context.Context, opts ListOptions) ([]Client, error) {
-	key := expression.Key("pk").Equal(expression.Value(fmt.Sprintf("Account#%s", opts.AccountID)))
+	// The account's partition also contains its settings
+	key := expression.Key("pk").Equal(expression.Value(fmt.Sprintf("Account#%s", opts.AccountID))).And(
+		expression.Key("sk").BeginsWith("Client#"),
+	)
 	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
 	if err != nil {
 		return nil, fmt.Errorf("expression.NewBuilder: %w", err)
@@ -64,16 +69,50 @@ func (repo *Repository) List(ctx context.Context, opts ListOptions) ([]Client, e
 }
 
 type CreateOptions struct {
-	Secret    string
-	Name      string
-	AndroidID string
-	AccountID string
+	// Empty for Clients without a secret, see `HasSecret`
+	Secret           string
+	Name             string
+	AndroidID        string
+	AccountID        string
+	AllowedScopes    []string
+	AllowedAudiences []string
+	// Client authentication, see `ValidateAuthentication`
+	TokenEndpointAuthMethod     string
+	TokenEndpointAuthSigningAlg string
+	JWKS                        *JSONWebKeySet
+	JWKSURI                     string
+	RedirectURIs                []string
+	GrantTypes                  []string
+	// Mutual TLS, see `ValidateTLSClientAuth`
+	TLSClientAuthSubjectDN      string
+	TLSClientAuthSPKIThumbprint string
+	// Seconds, see `account.ValidTokenLifespan`
+	TokenLifespan int64
+	// See `ValidateCustomClaims`
+	CustomClaims map[string]string
+	// See `ValidTokenFormat`
+	TokenFormat string
+	// Only for dynamically registered Clients, where only the hash of the token is stored
+	RegistrationAccessToken string
+	SoftwareID              string
+	SoftwareVersion         string
+	SoftwareStatement       string
 }
 
 func (repo *Repository) Create(ctx context.Context, opts CreateOptions) (*Client, error) {
-	hash, err := argon2id.CreateHash(opts.Secret, argon2id.DefaultParams)
-	if err != nil {
-		return nil, fmt.Errorf("argon2id.CreateHash: %w", err)
+	var hash, secretPrefix string
+	if opts.Secret != "" {
+		var err error
+		hash, err = crypto.HashSecret(ctx, opts.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("crypto.HashSecret: %w", err)
+		}
+		secretPrefix = opts.Secret[:secretPrefixLength]
+	}
+
+	var registrationAccessTokenHash string
+	if opts.RegistrationAccessToken != "" {
+		registrationAccessTokenHash = crypto.HashToken(opts.RegistrationAccessToken)
 	}
 
 	id, err := uuid.NewRandom()
@@ -82,25 +121,90 @@ func (repo *Repository) Create(ctx context.Context, opts CreateOptions) (*Client
 	}
 
 	client := Client{
-		ID:           id.String(),
-		SecretPrefix: opts.Secret[:secretPrefixLength],
-		SecretHash:   hash,
-		Name:         opts.Name,
-		AndroidID:    opts.AndroidID,
-		AccountID:    opts.AccountID,
+		ID:               id.String(),
+		SecretPrefix:     secretPrefix,
+		SecretHash:       hash,
+		Name:             opts.Name,
+		AndroidID:        opts.AndroidID,
+		AccountID:        opts.AccountID,
+		AllowedScopes:    opts.AllowedScopes,
+		AllowedAudiences: opts.AllowedAudiences,
+
+		TokenEndpointAuthMethod:     opts.TokenEndpointAuthMethod,
+		TokenEndpointAuthSigningAlg: opts.TokenEndpointAuthSigningAlg,
+		JWKS:                        opts.JWKS,
+		JWKSURI:                     opts.JWKSURI,
+		RedirectURIs:                opts.RedirectURIs,
+		GrantTypes:                  opts.GrantTypes,
+		TLSClientAuthSubjectDN:      opts.TLSClientAuthSubjectDN,
+		TLSClientAuthSPKIThumbprint: opts.TLSClientAuthSPKIThumbprint,
+		TokenLifespan:               opts.TokenLifespan,
+		CustomClaims:                opts.CustomClaims,
+		TokenFormat:                 opts.TokenFormat,
+		RegistrationAccessTokenHash: registrationAccessTokenHash,
+		SoftwareID:                  opts.SoftwareID,
+		SoftwareVersion:             opts.SoftwareVersion,
+		SoftwareStatement:           opts.SoftwareStatement,
+	}
+
+	allowedScopes, err := attributevalue.Marshal(client.AllowedScopes)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal allowed_scopes: %w", err)
+	}
+
+	allowedAudiences, err := attributevalue.Marshal(client.AllowedAudiences)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal allowed_audiences: %w", err)
+	}
+
+	jwks, err := attributevalue.Marshal(client.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal jwks: %w", err)
+	}
+
+	redirectURIs, err := attributevalue.Marshal(client.RedirectURIs)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal redirect_uris: %w", err)
+	}
+
+	grantTypes, err := attributevalue.Marshal(client.GrantTypes)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal grant_types: %w", err)
+	}
+
+	customClaims, err := attributevalue.Marshal(client.CustomClaims)
+	if err != nil {
+		return nil, fmt.Errorf("attributevalue.Marshal custom_claims: %w", err)
 	}
 
 	input := dynamodb.PutItemInput{
 		TableName: aws.String(tableName),
 		Item: map[string]types.AttributeValue{
-			"pk":            &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", client.AccountID)},
-			"sk":            &types.AttributeValueMemberS{Value: fmt.Sprintf("Client#%s", client.ID)},
-			"id":            &types.AttributeValueMemberS{Value: client.ID},
-			"secret":        &types.AttributeValueMemberS{Value: client.SecretHash},
-			"secret_prefix": &types.AttributeValueMemberS{Value: client.SecretPrefix},
-			"name":          &types.AttributeValueMemberS{Value: client.Name},
-			"android_id":    &types.AttributeValueMemberS{Value: client.AndroidID},
-			"account_id":    &types.AttributeValueMemberS{Value: client.AccountID},
+			"pk":                              &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", client.AccountID)},
+			"sk":                              &types.AttributeValueMemberS{Value: fmt.Sprintf("Client#%s", client.ID)},
+			"id":                              &types.AttributeValueMemberS{Value: client.ID},
+			"secret":                          &types.AttributeValueMemberS{Value: client.SecretHash},
+			"secret_prefix":                   &types.AttributeValueMemberS{Value: client.SecretPrefix},
+			"name":                            &types.AttributeValueMemberS{Value: client.Name},
+			"android_id":                      &types.AttributeValueMemberS{Value: client.AndroidID},
+			"account_id":                      &types.AttributeValueMemberS{Value: client.AccountID},
+			"allowed_scopes":                  allowedScopes,
+			"allowed_audiences":               allowedAudiences,
+			"token_endpoint_auth_method":      &types.AttributeValueMemberS{Value: client.TokenEndpointAuthMethod},
+			"token_endpoint_auth_signing_alg": &types.AttributeValueMemberS{Value: client.TokenEndpointAuthSigningAlg},
+			"jwks":                            jwks,
+			"jwks_uri":                        &types.AttributeValueMemberS{Value: client.JWKSURI},
+			"redirect_uris":                   redirectURIs,
+			"grant_types":                     grantTypes,
+			"tls_client_auth_subject_dn":      &types.AttributeValueMemberS{Value: client.TLSClientAuthSubjectDN},
+			"tls_client_auth_spki_thumbprint": &types.AttributeValueMemberS{Value: client.TLSClientAuthSPKIThumbprint},
+			"token_lifespan":                  &types.AttributeValueMemberN{Value: strconv.FormatInt(client.TokenLifespan, 10)},
+			"custom_claims":                   customClaims,
+			"token_format":                    &types.AttributeValueMemberS{Value: client.TokenFormat},
+			"registration_access_token":       &types.AttributeValueMemberS{Value: client.RegistrationAccessTokenHash},
+			"software_id":                     &types.AttributeValueMemberS{Value: client.SoftwareID},
+			"software_version":                &types.AttributeValueMemberS{Value: client.SoftwareVersion},
+			"software_statement":              &types.AttributeValueMemberS{Value: client.SoftwareStatement},
 		},
 		ConditionExpression: aws.String("attribute_not_exists(pk)"),
 	}
@@ -177,16 +281,16 @@ func (repo *Repository) GetByID(ctx context.Context, id string) (*Client, error)
 }
 
 type DeleteOptions struct {
-	accountID string
-	id        string
+	AccountID string
+	ID        string
 }
 
 func (repo *Repository) Delete(ctx context.Context, opts DeleteOptions) error {
 	_, err := repo.dynamodb.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
-			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", opts.accountID)},
-			"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Client#%s", opts.id)},
+			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", opts.AccountID)},
+			"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Client#%s", opts.ID)},
 		},
 		ConditionExpression: aws.String("attribute_exists(pk)"),
 	})
@@ -205,6 +309,33 @@ type UpdateOptions struct {
 	ID        string
 	Name      string
 	Secret    string
+	// With `Secret`, how long the secret it replaces is still accepted, where 0 revokes it immediately
+	SecretGracePeriod time.Duration
+	// Revokes the previous secret before it expires
+	RevokePreviousSecret bool
+	// nil leaves the existing scopes unchanged, whereas an empty slice removes all scopes
+	AllowedScopes []string
+	// nil leaves the existing audiences unchanged, whereas an empty slice removes all audiences
+	AllowedAudiences []string
+	// Replaces the public keys of a `private_key_jwt` Client (only one of these may be set)
+	JWKS    *JSONWebKeySet
+	JWKSURI string
+	// nil leaves the existing redirect URIs unchanged, whereas an empty slice removes all redirect URIs
+	RedirectURIs []string
+	// nil leaves the existing lifespan unchanged, whereas 0 reverts to the account's default
+	TokenLifespan *int64
+	// nil leaves the existing claims unchanged, whereas an empty map removes all claims
+	CustomClaims map[string]string
+	// Empty leaves the existing format unchanged
+	TokenFormat string
+	// nil leaves the existing grant types unchanged, whereas an empty slice reverts to the defaults
+	GrantTypes []string
+	// nil leaves the Client enabled (or disabled) as it is
+	Disabled *bool
+	// Replaces the software of a dynamically registered Client, if any of these are set
+	SoftwareID        string
+	SoftwareVersion   string
+	SoftwareStatement string
 }
 
 func (repo *Repository) Update(ctx context.Context, opts UpdateOptions) (*Client, error) {
@@ -213,14 +344,87 @@ func (repo *Repository) Update(ctx context.Context, opts UpdateOptions) (*Client
 		update = update.Set(expression.Name("name"), expression.Value(opts.Name))
 	}
 
+	if opts.AllowedScopes != nil {
+		update = update.Set(expression.Name("allowed_scopes"), expression.Value(opts.AllowedScopes))
+	}
+
+	if opts.AllowedAudiences != nil {
+		update = update.Set(expression.Name("allowed_audiences"), expression.Value(opts.AllowedAudiences))
+	}
+
+	if opts.RedirectURIs != nil {
+		update = update.Set(expression.Name("redirect_uris"), expression.Value(opts.RedirectURIs))
+	}
+
+	if opts.CustomClaims != nil {
+		update = update.Set(expression.Name("custom_claims"), expression.Value(opts.CustomClaims))
+	}
+
+	if opts.TokenLifespan != nil {
+		update = update.Set(expression.Name("token_lifespan"), expression.Value(*opts.TokenLifespan))
+	}
+
+	if opts.TokenFormat != "" {
+		update = update.Set(expression.Name("token_format"), expression.Value(opts.TokenFormat))
+	}
+
+	if opts.GrantTypes != nil {
+		update = update.Set(expression.Name("grant_types"), expression.Value(opts.GrantTypes))
+	}
+
+	if opts.Disabled != nil {
+		update = update.Set(expression.Name("disabled"), expression.Value(*opts.Disabled))
+	}
+
+	// The software statement describes the software, so is replaced along with it
+	if opts.SoftwareID != "" || opts.SoftwareVersion != "" || opts.SoftwareStatement != "" {
+		update = update.Set(expression.Name("software_id"), expression.Value(opts.SoftwareID)).Set(
+			expression.Name("software_version"), expression.Value(opts.SoftwareVersion),
+		).Set(
+			expression.Name("software_statement"), expression.Value(opts.SoftwareStatement),
+		)
+	}
+
+	// A Client has a single source of public keys, so setting one replaces the other
+	if opts.JWKS != nil {
+		update = update.Set(expression.Name("jwks"), expression.Value(opts.JWKS)).Set(
+			expression.Name("jwks_uri"), expression.Value(""),
+		)
+	}
+
+	if opts.JWKSURI != "" {
+		update = update.Set(expression.Name("jwks_uri"), expression.Value(opts.JWKSURI)).Remove(
+			expression.Name("jwks"),
+		)
+	}
+
 	if opts.Secret != "" {
-		hash, err := argon2id.CreateHash(opts.Secret, argon2id.DefaultParams)
+		hash, err := crypto.HashSecret(ctx, opts.Secret)
 		if err != nil {
-			return nil, fmt.Errorf("argon2id.CreateHash: %w", err)
+			return nil, fmt.Errorf("crypto.HashSecret: %w", err)
 		}
 		update = update.Set(expression.Name("secret"), expression.Value(hash)).Set(
 			expression.Name("secret_prefix"), expression.Value(opts.Secret[:secretPrefixLength]),
 		)
+
+		// Only the secret being replaced is kept, as operands are evaluated before the update
+		if opts.SecretGracePeriod > 0 {
+			update = update.Set(expression.Name("previous_secret"), expression.Name("secret")).Set(
+				expression.Name("previous_secret_prefix"), expression.Name("secret_prefix"),
+			).Set(
+				expression.Name("previous_secret_expires_at"), expression.Value(time.Now().Add(opts.SecretGracePeriod).Unix()),
+			)
+		} else {
+			opts.RevokePreviousSecret = true
+		}
+	}
+
+	if opts.RevokePreviousSecret {
+		update = update.Remove(expression.Name("previous_secret")).Remove(
+			expression.Name("previous_secret_prefix"),
+		).Remove(
+			expression.Name("previous_secret_expires_at"),
+		)
 	}
 
 	expr, err := expression.NewBuilder().WithCondition(
@@ -264,3 +468,46 @@ func (repo *Repository) Update(ctx context.Context, opts UpdateOptions) (*Client
 
 	return &client, nil
 }
+
+type RehashSecretOptions struct {
+	AccountID string
+	ID        string
+	// The hash being replaced, so a concurrent rotation isn't overwritten
+	Hash    string
+	NewHash string
+}
+
+// Replaces the hash of a Client's secret with one of the same secret, see `crypto.NeedsRehash`
+//
+// Returns `core.ErrNotFound` if the Client no longer exists or its secret has changed
+func (repo *Repository) RehashSecret(ctx context.Context, opts RehashSecretOptions) error {
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.Name("secret").Equal(expression.Value(opts.Hash)),
+	).WithUpdate(
+		expression.Set(expression.Name("secret"), expression.Value(opts.NewHash)),
+	).Build()
+
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = repo.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", opts.AccountID)},
+			"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Client#%s", opts.ID)},
+		},
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+			return core.ErrNotFound
+		}
+		return fmt.Errorf("dynamodb.UpdateItem Client: %w", err)
+	}
+
+	return nil
+}
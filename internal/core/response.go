@@ -43,6 +43,15 @@ func MethodNotAllowedResponse(w http.ResponseWriter) {
 	})
 }
 
+// For transient overload, e.g. too many secrets being hashed, where the request can be retried
+func ServiceUnavailableResponse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	JSONResponse(w, errorsx.Errors{
+		Errors: []errorsx.Error{errorsx.UnavailableError()},
+	})
+}
+
 func InternalErrorResponse(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	// NB: Here we duplicate `JSONResponse` to avoid an infinite loop
@@ -74,6 +74,37 @@ func TestInternalErrorResponse(t *testing.T) {
 	)
 }
 
+func TestServiceUnavailableResponse(t *testing.T) {
+	a := assert.New(t)
+
+	w := httptest.NewRecorder()
+
+	ServiceUnavailableResponse(w)
+
+	res := w.Result()
+
+	a.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	a.Equal("1", res.Header.Get("Retry-After"))
+
+	var response errorsx.Errors
+	a.NoError(json.NewDecoder(res.Body).Decode(&response))
+
+	a.Equal(
+		errorsx.Errors(
+			errorsx.Errors{
+				Errors: []errorsx.Error{
+					{
+						Category: category.UNAVAILABLE,
+						Code:     code.UNAVAILABLE,
+						Message:  "Service temporarily unavailable.",
+					},
+				},
+			},
+		),
+		response,
+	)
+}
+
 // A JSON response that can't be marshalled returns an `InternalErrorResponse`
 func TestJSONResponseInvalid(t *testing.T) {
 	a := assert.New(t)
@@ -0,0 +1,37 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// The `x5t#S256` confirmation method of a certificate-bound access token,
+// see https://datatracker.ietf.org/doc/html/rfc8705#section-3.1
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Identifies a self-signed certificate by its public key, so it can be re-issued with the same key
+func SPKIThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Loads the PEM encoded CA certificates at `path`
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file at path: %s: %w", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("No certificates found in file at path: %s", path)
+	}
+
+	return pool, nil
+}
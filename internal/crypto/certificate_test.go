@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSPKIThumbprint(t *testing.T) {
+	a := assert.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+
+	c1 := generateCertificate(a, key, 1)
+	c2 := generateCertificate(a, key, 2)
+
+	// A re-issued certificate has the same public key, but is otherwise different
+	a.Equal(SPKIThumbprint(c1), SPKIThumbprint(c2))
+	a.NotEqual(CertificateThumbprint(c1), CertificateThumbprint(c2))
+	a.Len(SPKIThumbprint(c1), 43)
+	a.Equal("CN=device,O=KidsLoop", c1.Subject.String())
+}
+
+func generateCertificate(a *assert.Assertions, key *ecdsa.PrivateKey, serial int64) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "device", Organization: []string{"KidsLoop"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	a.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	a.NoError(err)
+	return cert
+}
@@ -8,6 +8,9 @@ import (
 	"gopkg.in/square/go-jose.v2"
 )
 
+// Where the JWKS is served, which is also advertised by the authorization server metadata
+const JWKSPath = "/.well-known/jwks.json"
+
 type Handler struct {
 	jwks *jose.JSONWebKeySet
 }
@@ -17,7 +20,7 @@ func NewHandler(jwks *jose.JSONWebKeySet) *Handler {
 }
 
 func (h *Handler) SetupRouter(router *httprouter.Router) {
-	router.GET("/.well-known/jwks.json", h.WellKnown())
+	router.GET(JWKSPath, h.WellKnown())
 }
 
 func (h *Handler) WellKnown() httprouter.Handle {
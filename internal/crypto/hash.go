@@ -0,0 +1,133 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alexedwards/argon2id"
+)
+
+// The argon2id parameters of new Client secret hashes, see `SetSecretHashParams`
+//
+// Existing hashes encode the parameters they were created with, so still verify after these change,
+// and are re-created on use, see `NeedsRehash`
+var secretHashParams = argon2id.DefaultParams
+
+// The minimums of https://datatracker.ietf.org/doc/html/rfc9106#section-4, below which parameters
+// are rejected
+const (
+	minSecretHashMemory     = 19 * 1024
+	minSecretHashSaltLength = 16
+	minSecretHashKeyLength  = 16
+)
+
+var ErrInvalidSecretHashParams = errors.New("invalid secret hash params")
+
+// A hash of a random secret with `secretHashParams`, see `CompareDummySecret`
+var dummySecretHash = &dummyHash{}
+
+type dummyHash struct {
+	once sync.Once
+	hash string
+	err  error
+}
+
+// Created when first needed, rather than on startup
+func (d *dummyHash) get() (string, error) {
+	d.once.Do(func() {
+		secret, err := GenerateSecret()
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.hash, d.err = argon2id.CreateHash(secret, secretHashParams)
+	})
+	return d.hash, d.err
+}
+
+// Parses parameters in the format of a hash, e.g. "m=65536,t=3,p=2" (memory in KiB, iterations,
+// parallelism), where the salt and key lengths are those of `argon2id.DefaultParams`
+func ParseSecretHashParams(s string) (*argon2id.Params, error) {
+	params := *argon2id.DefaultParams
+	if _, err := fmt.Sscanf(s, "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSecretHashParams, err)
+	}
+	// Sscanf ignores anything after the last value
+	if fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism) != s {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSecretHashParams, s)
+	}
+	if err := validSecretHashParams(&params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func validSecretHashParams(params *argon2id.Params) error {
+	if params.Memory < minSecretHashMemory || params.Iterations < 1 || params.Parallelism < 1 ||
+		params.SaltLength < minSecretHashSaltLength || params.KeyLength < minSecretHashKeyLength {
+		return fmt.Errorf("%w: m=%d,t=%d,p=%d", ErrInvalidSecretHashParams, params.Memory, params.Iterations, params.Parallelism)
+	}
+	return nil
+}
+
+// Must be called before serving, as the parameters aren't synchronised
+func SetSecretHashParams(params *argon2id.Params) error {
+	if err := validSecretHashParams(params); err != nil {
+		return err
+	}
+	secretHashParams = params
+	dummySecretHash = &dummyHash{}
+	return nil
+}
+
+// Returns `ErrHashingUnavailable` if too many secrets are already being hashed, see `HashLimits`
+func HashSecret(ctx context.Context, secret string) (string, error) {
+	release, err := hashLimiter.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return argon2id.CreateHash(secret, secretHashParams)
+}
+
+// Returns `ErrHashingUnavailable` if too many secrets are already being hashed, see `HashLimits`
+func CompareSecret(ctx context.Context, secret string, hash string) (bool, error) {
+	release, err := hashLimiter.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	return argon2id.ComparePasswordAndHash(secret, hash)
+}
+
+// Compares a secret presented for a Client which doesn't exist against a hash which never matches, so that
+// it takes as long as comparing the hash of a Client which does, and response times don't reveal which exist
+//
+// Returns `ErrHashingUnavailable` if too many secrets are already being hashed, see `HashLimits`
+func CompareDummySecret(ctx context.Context, secret string) error {
+	release, err := hashLimiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	hash, err := dummySecretHash.get()
+	if err != nil {
+		return fmt.Errorf("dummy hash: %w", err)
+	}
+	_, err = argon2id.ComparePasswordAndHash(secret, hash)
+	return err
+}
+
+// Whether a hash was created with other parameters than those of new hashes, so should be re-created
+// the next time its secret is known (i.e. when the Client authenticates)
+func NeedsRehash(hash string) bool {
+	params, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		// Not one of ours, so can't be verified in order to re-create it
+		return false
+	}
+	return *params != *secretHashParams
+}
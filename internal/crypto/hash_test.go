@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/utils"
+	"github.com/alexedwards/argon2id"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecretHashParams(t *testing.T) {
+	a := assert.New(t)
+
+	params, err := ParseSecretHashParams("m=65536,t=3,p=4")
+	a.NoError(err)
+	a.Equal(uint32(65536), params.Memory)
+	a.Equal(uint32(3), params.Iterations)
+	a.Equal(uint8(4), params.Parallelism)
+	a.Equal(argon2id.DefaultParams.SaltLength, params.SaltLength)
+	a.Equal(argon2id.DefaultParams.KeyLength, params.KeyLength)
+
+	for _, s := range []string{"", "m=65536,t=3", "m=65536,t=3,p=4,x=1", "m=1024,t=3,p=4", "m=65536,t=0,p=4", "m=65536,t=3,p=0", "m=65536,t=3,p=256"} {
+		_, err := ParseSecretHashParams(s)
+		a.ErrorIs(err, ErrInvalidSecretHashParams, s)
+	}
+}
+
+// Restores the parameters (and dummy hash) after `SetSecretHashParams`
+func restoreSecretHashParams() func() {
+	params, dummy := secretHashParams, dummySecretHash
+	return func() { secretHashParams, dummySecretHash = params, dummy }
+}
+
+func TestNeedsRehash(t *testing.T) {
+	a := assert.New(t)
+	defer restoreSecretHashParams()()
+
+	hash, err := HashSecret(context.Background(), "secret")
+	a.NoError(err)
+	a.False(NeedsRehash(hash))
+	a.True(utils.Must(CompareSecret(context.Background(), "secret", hash)))
+
+	a.NoError(SetSecretHashParams(&argon2id.Params{Memory: 32 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	a.True(NeedsRehash(hash), "Created with the previous parameters")
+	a.True(utils.Must(CompareSecret(context.Background(), "secret", hash)), "Still verifies")
+
+	hash, err = HashSecret(context.Background(), "secret")
+	a.NoError(err)
+	a.False(NeedsRehash(hash))
+
+	a.False(NeedsRehash(""), "No secret")
+	a.Error(SetSecretHashParams(&argon2id.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+}
+
+func TestCompareDummySecret(t *testing.T) {
+	a := assert.New(t)
+	defer restoreSecretHashParams()()
+
+	params := &argon2id.Params{Memory: minSecretHashMemory, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	a.NoError(SetSecretHashParams(params))
+	dummy, err := dummySecretHash.get()
+	a.NoError(err)
+	a.False(NeedsRehash(dummy), "Created with the current parameters")
+
+	hash, err := HashSecret(context.Background(), "secret")
+	a.NoError(err)
+
+	// Interleaved, so that any change in load affects both alike
+	var known, unknown []time.Duration
+	for i := 0; i < 15; i++ {
+		start := time.Now()
+		a.False(utils.Must(CompareSecret(context.Background(), "incorrect-secret", hash)))
+		known = append(known, time.Since(start))
+
+		start = time.Now()
+		a.NoError(CompareDummySecret(context.Background(), "incorrect-secret"))
+		unknown = append(unknown, time.Since(start))
+	}
+	a.InEpsilon(float64(median(known)), float64(median(unknown)), 0.25, "known: %v, unknown: %v", known, unknown)
+}
+
+func median(durations []time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
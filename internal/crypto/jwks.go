@@ -1,8 +1,11 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -14,7 +17,11 @@ import (
 const (
 	privateKeyPath = "internal/crypto/private.pem"
 	publicKeyPath  = "internal/crypto/public.pem"
-	KID              = "2c7ef7a0-913f-458d-8c84-be44b3091cb3"
+
+	// The fixed `kid` of tokens issued before it was derived from the key (see `KeyID`), which the key is
+	// also published under until they've expired. Remove once the maximum access token lifespan has passed
+	// since that change was deployed.
+	LegacyKeyID = "2c7ef7a0-913f-458d-8c84-be44b3091cb3"
 )
 
 func LoadPrivateKey() (*rsa.PrivateKey, error) {
@@ -62,6 +69,17 @@ func parseRSAPrivateKey(bytes []byte) (*rsa.PrivateKey, error) {
 	return key, nil
 }
 
+// The `kid` of a key is its JWK SHA-256 thumbprint (see https://datatracker.ietf.org/doc/html/rfc7638),
+// so it changes whenever the key is rotated
+func KeyID(key *rsa.PublicKey) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
 func JWKS() (*jose.JSONWebKeySet, error) {
 	// TODO: replace with AWS KMS
 	bytes, err := loadRSAKeyFile(publicKeyPath)
@@ -74,16 +92,46 @@ func JWKS() (*jose.JSONWebKeySet, error) {
 		return &jose.JSONWebKeySet{}, err
 	}
 
+	kid, err := KeyID(key)
+	if err != nil {
+		return &jose.JSONWebKeySet{}, err
+	}
+
 	return &jose.JSONWebKeySet{
 		Keys: []jose.JSONWebKey{
 			{
 				Algorithm: "RS256",
 				Use:       "sig",
 				Key:       key,
-				// TODO: remove hardcoded kid - either store kid & some unique identifier for public key
-				// or use a one-way deterministic approach to derive kid from key
-				KeyID: KID,
+				KeyID:     kid,
+			},
+			{
+				Algorithm: "RS256",
+				Use:       "sig",
+				Key:       key,
+				KeyID:     LegacyKeyID,
 			},
 		},
 	}, nil
 }
+
+// Loads the JSON encoded JWKS at `path`, e.g. the keys of trusted third parties
+func LoadJWKS(path string) (*jose.JSONWebKeySet, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file at path: %s: %w", path, err)
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(bytes, &jwks); err != nil {
+		return nil, fmt.Errorf("Failed to parse JWKS at path: %s: %w", path, err)
+	}
+
+	for _, key := range jwks.Keys {
+		if !key.IsPublic() {
+			return nil, fmt.Errorf("JWKS at path: %s contains a private key", path)
+		}
+	}
+
+	return &jwks, nil
+}
@@ -35,9 +35,19 @@ func TestJWKS(t *testing.T) {
 	err = json.NewDecoder(res.Body).Decode(&response)
 	a.NoError(err)
 
-	a.Len(response["keys"], 1)
+	a.Len(response["keys"], 2)
 
 	key := response["keys"].([]interface{})[0].(map[string]interface{})
-	a.Equal(KID, key["kid"])
+	// The same `kid` as tokens signed with the private key
+	privateKey, err := LoadPrivateKey()
+	a.NoError(err)
+	kid, err := KeyID(&privateKey.PublicKey)
+	a.NoError(err)
+	a.Equal(kid, key["kid"])
 	a.Equal("RS256", key["alg"])
+
+	// And under the `kid` of tokens issued before it was derived from the key
+	legacy := response["keys"].([]interface{})[1].(map[string]interface{})
+	a.Equal(LegacyKeyID, legacy["kid"])
+	a.Equal(key["n"], legacy["n"])
 }
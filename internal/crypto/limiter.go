@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Returned when a secret can't be hashed before the queue timeout, or the queue is full, which should
+// be reported as temporarily unavailable rather than as invalid credentials
+var ErrHashingUnavailable = errors.New("secret hashing unavailable")
+
+// Bounds the secrets hashed at once, as each argon2id hash allocates the `Memory` of `secretHashParams`
+// (64 MiB by default), so a burst of requests would otherwise exhaust memory
+type HashLimits struct {
+	// Hashes computed at once
+	Concurrency int
+	// Hashes waiting for one of those to finish, beyond which they fail immediately
+	MaxQueue int
+	// How long a hash waits before failing
+	QueueTimeout time.Duration
+}
+
+var DefaultHashLimits = HashLimits{
+	Concurrency:  runtime.NumCPU(),
+	MaxQueue:     runtime.NumCPU() * 16,
+	QueueTimeout: time.Second * 2,
+}
+
+var ErrInvalidHashLimits = errors.New("invalid hash limits")
+
+var hashLimiter = newLimiter(DefaultHashLimits)
+
+// Must be called before serving, as the limits aren't synchronised
+func SetHashLimits(limits HashLimits) error {
+	if limits.Concurrency < 1 || limits.MaxQueue < 0 || limits.QueueTimeout <= 0 {
+		return fmt.Errorf("%w: %+v", ErrInvalidHashLimits, limits)
+	}
+	hashLimiter = newLimiter(limits)
+	return nil
+}
+
+type limiter struct {
+	limits HashLimits
+	slots  chan struct{}
+	queued int64
+}
+
+func newLimiter(limits HashLimits) *limiter {
+	return &limiter{
+		limits: limits,
+		slots:  make(chan struct{}, limits.Concurrency),
+	}
+}
+
+// Waits for a slot, which must be released once the hash is computed
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > int64(l.limits.MaxQueue) {
+		atomic.AddInt64(&l.queued, -1)
+		return nil, fmt.Errorf("%w: the queue is full", ErrHashingUnavailable)
+	}
+	defer atomic.AddInt64(&l.queued, -1)
+
+	timer := time.NewTimer(l.limits.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: timed out after %s", ErrHashingUnavailable, l.limits.QueueTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
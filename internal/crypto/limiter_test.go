@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func atomicQueued(l *limiter) int64 {
+	return atomic.LoadInt64(&l.queued)
+}
+
+func TestLimiter(t *testing.T) {
+	a := assert.New(t)
+
+	l := newLimiter(HashLimits{Concurrency: 1, MaxQueue: 1, QueueTimeout: time.Second})
+
+	release, err := l.acquire(context.Background())
+	a.NoError(err)
+
+	// Waits for the slot to be released
+	acquired := make(chan error)
+	go func() {
+		release, err := l.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	// Waits for the goroutine to be queued
+	for i := 0; i < 100 && atomicQueued(l) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, err = l.acquire(context.Background())
+	a.ErrorIs(err, ErrHashingUnavailable, "The queue is full")
+
+	release()
+	a.NoError(<-acquired)
+
+	release, err = l.acquire(context.Background())
+	a.NoError(err, "Released")
+	release()
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	l := newLimiter(HashLimits{Concurrency: 1, MaxQueue: 1, QueueTimeout: time.Millisecond * 10})
+
+	release, err := l.acquire(context.Background())
+	a.NoError(err)
+	defer release()
+
+	_, err = l.acquire(context.Background())
+	a.ErrorIs(err, ErrHashingUnavailable)
+	a.Zero(atomicQueued(l), "No longer queued")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.limits.QueueTimeout = time.Minute
+	_, err = l.acquire(ctx)
+	a.ErrorIs(err, context.Canceled)
+	a.Zero(atomicQueued(l))
+}
+
+func TestSetHashLimits(t *testing.T) {
+	a := assert.New(t)
+	defer func(l *limiter) { hashLimiter = l }(hashLimiter)
+
+	a.NoError(SetHashLimits(HashLimits{Concurrency: 2, MaxQueue: 0, QueueTimeout: time.Second}))
+	a.Equal(2, cap(hashLimiter.slots))
+
+	for _, limits := range []HashLimits{
+		{Concurrency: 0, MaxQueue: 1, QueueTimeout: time.Second},
+		{Concurrency: 1, MaxQueue: -1, QueueTimeout: time.Second},
+		{Concurrency: 1, MaxQueue: 1, QueueTimeout: 0},
+	} {
+		a.ErrorIs(SetHashLimits(limits), ErrInvalidHashLimits, "%+v", limits)
+	}
+}
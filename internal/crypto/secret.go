@@ -2,20 +2,37 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/big"
 )
 
 var (
 	rander      = rand.Reader
 	secretRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890_-.~")
+	// Consonants only, so codes are easy to type and can't spell words
+	// https://datatracker.ietf.org/doc/html/rfc8628#section-6.1
+	UserCodeRunes = []rune("BCDFGHJKLMNPQRSTVWXZ")
 )
 
-const secretLength = 40
+const (
+	secretLength = 40
+	// 20^8 possible codes, which are only valid for a short period
+	UserCodeLength = 8
+)
 
 // Modified version of https://github.com/ory/hydra/blob/79255970787c4793a57fe79d756aa0364b4a9490/x/secret.go#L31
 func GenerateSecret() (string, error) {
-	l := secretLength
-	c := big.NewInt(int64(len(secretRunes)))
+	return generate(secretRunes, secretLength)
+}
+
+// A code for the end-user to enter when authorizing a device, see `UserCodeRunes`
+func GenerateUserCode() (string, error) {
+	return generate(UserCodeRunes, UserCodeLength)
+}
+
+func generate(runes []rune, l int) (string, error) {
+	c := big.NewInt(int64(len(runes)))
 	seq := make([]rune, l)
 
 	for i := 0; i < l; i++ {
@@ -23,9 +40,16 @@ func GenerateSecret() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		rn := secretRunes[r.Uint64()]
+		rn := runes[r.Uint64()]
 		seq[i] = rn
 	}
 
 	return string(seq), nil
 }
+
+// Only the hash of a bearer token (e.g. an initial access token) is stored, so the table can't be
+// used to authenticate. Tokens are random, so a fast hash suffices, unlike for Client secrets.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
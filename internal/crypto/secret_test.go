@@ -27,3 +27,23 @@ func TestGenerateSecretUnique(t *testing.T) {
 
 	a.NotEqual(s1, s2)
 }
+
+func TestGenerateUserCode(t *testing.T) {
+	a := assert.New(t)
+
+	code, err := GenerateUserCode()
+	a.Nil(err)
+
+	a.Len(code, UserCodeLength)
+	for _, r := range code {
+		a.Contains(UserCodeRunes, r)
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(HashToken("token"), HashToken("token"))
+	a.NotEqual(HashToken("token"), HashToken("other"))
+	a.NotContains(HashToken("token"), "token")
+}
@@ -6,4 +6,5 @@ const (
 	INVALID_REQUEST Category = "INVALID_REQUEST"
 	NOT_FOUND                = "NOT_FOUND"
 	INTERNAL                 = "INTERNAL"
+	UNAVAILABLE              = "UNAVAILABLE"
 )
@@ -10,4 +10,5 @@ const (
 	INVALID_METHOD   = "INVALID_METHOD"
 	REQUIRED_HEADER  = "REQUIRED_HEADER"
 	INTERNAL         = "INTERNAL"
+	UNAVAILABLE      = "UNAVAILABLE"
 )
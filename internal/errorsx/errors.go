@@ -71,3 +71,11 @@ func InternalError() Error {
 		Message:  "Internal server error.",
 	}
 }
+
+func UnavailableError() Error {
+	return Error{
+		Category: category.UNAVAILABLE,
+		Code:     code.UNAVAILABLE,
+		Message:  "Service temporarily unavailable.",
+	}
+}
@@ -0,0 +1,297 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	tableName = "authentication"
+	namespace = "Lockout"
+)
+
+// What failures are counted against
+type Key struct {
+	// Every counter with the same partition can be reset at once, see `Store.ResetPartition`
+	partition string
+	id        string
+}
+
+func (k Key) String() string {
+	if k.id == "" {
+		return k.partition
+	}
+	return fmt.Sprintf("%s#%s", k.partition, k.id)
+}
+
+func (k Key) attributes() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("%s#%s", namespace, k.partition)},
+		"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("%s#%s", namespace, k)},
+	}
+}
+
+// The failures of a Client (whether or not it exists) from a source IP, so others can't lock it out
+func ClientKey(clientID string, ip string) Key {
+	return Key{partition: ClientPartition(clientID), id: fmt.Sprintf("IP#%s", ip)}
+}
+
+// The partition of every `ClientKey` of a Client
+func ClientPartition(clientID string) string {
+	return fmt.Sprintf("Client#%s", clientID)
+}
+
+// The failures from a source IP, across every Client
+func IPKey(ip string) Key {
+	return Key{partition: fmt.Sprintf("IP#%s", ip)}
+}
+
+// The invalid device flow user codes entered from a source IP
+func UserCodeKey(ip string) Key {
+	return Key{partition: fmt.Sprintf("UserCode#IP#%s", ip)}
+}
+
+// How failed authentications are throttled
+type Policy struct {
+	// Failures allowed before the first lockout
+	Threshold int
+	// The first lockout, which doubles with every further failure
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Failures are forgotten after this long without another
+	Window time.Duration
+}
+
+var DefaultPolicy = Policy{
+	Threshold: 5,
+	BaseDelay: time.Second,
+	MaxDelay:  time.Minute * 15,
+	Window:    time.Hour,
+}
+
+// How long `failures` (in a row) are locked out for, which is 0 below the `Threshold`
+func (p Policy) Delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.Threshold; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// The failed authentications of a key
+type Counter struct {
+	Failures int `dynamodbav:"failures"`
+	// Unix time, or 0 if not locked out
+	LockedUntil int64 `dynamodbav:"locked_until"`
+	TTL         int64 `dynamodbav:"ttl"`
+}
+
+// How long until the key is no longer locked out, or 0 if it isn't
+func (c *Counter) RetryAfter() time.Duration {
+	if c.LockedUntil == 0 {
+		return 0
+	}
+	if until := time.Until(time.Unix(c.LockedUntil, 0)); until > 0 {
+		return until
+	}
+	return 0
+}
+
+// Counts failed authentications in DynamoDB, each expiring (via TTL) after the `Policy.Window`
+type Store struct {
+	dynamodb *dynamodb.Client
+	policy   Policy
+}
+
+func NewStore(dynamodbClient *dynamodb.Client, policy Policy) *Store {
+	return &Store{
+		dynamodb: dynamodbClient,
+		policy:   policy,
+	}
+}
+
+// Returns the zero value if the key has no (unexpired) failures
+func (s *Store) Get(ctx context.Context, key Key) (*Counter, error) {
+	output, err := s.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            key.attributes(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem %s: %w", namespace, err)
+	}
+
+	var counter Counter
+	if output.Item == nil || storage.Expired(output.Item) {
+		return &counter, nil
+	}
+
+	if err := attributevalue.UnmarshalMap(output.Item, &counter); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap %s: %w", namespace, err)
+	}
+
+	return &counter, nil
+}
+
+// Counts a failure, locking out the key (per the `Policy`) if it has failed too often
+func (s *Store) RecordFailure(ctx context.Context, key Key) (*Counter, error) {
+	now := time.Now()
+	ttl := now.Add(s.policy.Window).Unix()
+
+	// Atomic, so concurrent failures are all counted. Expired (but undeleted) counters start again.
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.AttributeNotExists(expression.Name("pk")).Or(
+			expression.Name(storage.TTLAttribute).GreaterThanEqual(expression.Value(now.Unix())),
+		),
+	).WithUpdate(
+		expression.Add(expression.Name("failures"), expression.Value(1)).Set(
+			expression.Name(storage.TTLAttribute), expression.Value(ttl),
+		),
+	).Build()
+	if err != nil {
+		return nil, fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	output, err := s.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key.attributes(),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var counter Counter
+	if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+		counter = Counter{Failures: 1, TTL: ttl}
+		if err := s.put(ctx, key, counter); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("dynamodb.UpdateItem %s: %w", namespace, err)
+	} else if err := attributevalue.UnmarshalMap(output.Attributes, &counter); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap %s: %w", namespace, err)
+	}
+
+	delay := s.policy.Delay(counter.Failures)
+	if delay == 0 {
+		return &counter, nil
+	}
+
+	counter.LockedUntil = now.Add(delay).Unix()
+	// The lockout can't be forgotten before it ends
+	if counter.LockedUntil > counter.TTL {
+		counter.TTL = counter.LockedUntil
+	}
+
+	update := expression.Set(
+		expression.Name("locked_until"), expression.Value(counter.LockedUntil),
+	).Set(
+		expression.Name(storage.TTLAttribute), expression.Value(counter.TTL),
+	)
+	expr, err = expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return nil, fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = s.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key.attributes(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.UpdateItem %s: %w", namespace, err)
+	}
+
+	return &counter, nil
+}
+
+func (s *Store) put(ctx context.Context, key Key, counter Counter) error {
+	item, err := attributevalue.MarshalMap(counter)
+	if err != nil {
+		return fmt.Errorf("attributevalue.MarshalMap %s: %w", namespace, err)
+	}
+	for k, v := range key.attributes() {
+		item[k] = v
+	}
+
+	_, err = s.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.PutItem %s: %w", namespace, err)
+	}
+
+	return nil
+}
+
+// Forgets every failure of the key, including any lockout
+func (s *Store) Reset(ctx context.Context, key Key) error {
+	_, err := s.dynamodb.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       key.attributes(),
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.DeleteItem %s: %w", namespace, err)
+	}
+
+	return nil
+}
+
+// Resets every counter in the partition, e.g. every `ClientKey` of a Client
+func (s *Store) ResetPartition(ctx context.Context, partition string) error {
+	expr, err := expression.NewBuilder().WithKeyCondition(
+		expression.Key("pk").Equal(expression.Value(fmt.Sprintf("%s#%s", namespace, partition))),
+	).WithProjection(
+		expression.NamesList(expression.Name("pk"), expression.Name("sk")),
+	).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	paginator := dynamodb.NewQueryPaginator(s.dynamodb, &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("dynamodb.Query %s: %w", namespace, err)
+		}
+
+		for _, item := range output.Items {
+			_, err := s.dynamodb.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(tableName),
+				Key:       item,
+			})
+			if err != nil {
+				return fmt.Errorf("dynamodb.DeleteItem %s: %w", namespace, err)
+			}
+		}
+	}
+
+	return nil
+}
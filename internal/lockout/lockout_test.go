@@ -0,0 +1,43 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	a := assert.New(t)
+
+	policy := Policy{Threshold: 3, BaseDelay: time.Second, MaxDelay: time.Second * 10}
+
+	a.Equal(time.Duration(0), policy.Delay(0))
+	a.Equal(time.Duration(0), policy.Delay(2), "Below the threshold")
+	a.Equal(time.Second, policy.Delay(3))
+	a.Equal(time.Second*2, policy.Delay(4))
+	a.Equal(time.Second*8, policy.Delay(6))
+	a.Equal(time.Second*10, policy.Delay(7), "Capped")
+	a.Equal(time.Second*10, policy.Delay(1000), "Capped")
+}
+
+func TestCounterRetryAfter(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(time.Duration(0), (&Counter{Failures: 1}).RetryAfter())
+	a.Equal(time.Duration(0), (&Counter{LockedUntil: time.Now().Add(-time.Minute).Unix()}).RetryAfter(), "Lockout has ended")
+	a.InDelta(time.Minute.Seconds(), (&Counter{LockedUntil: time.Now().Add(time.Minute).Unix()}).RetryAfter().Seconds(), 1)
+}
+
+func TestKey(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("IP#192.0.2.1", IPKey("192.0.2.1").String())
+	a.Equal("Client#client#IP#192.0.2.1", ClientKey("client", "192.0.2.1").String())
+	a.Equal("UserCode#IP#192.0.2.1", UserCodeKey("192.0.2.1").String())
+
+	// Every source IP's counter of a Client shares a partition, so they can be reset at once
+	a.Equal(ClientKey("client", "192.0.2.1").attributes()["pk"], ClientKey("client", "192.0.2.2").attributes()["pk"])
+	a.NotEqual(ClientKey("client", "192.0.2.1").attributes()["sk"], ClientKey("client", "192.0.2.2").attributes()["sk"])
+	a.NotEqual(ClientKey("client", "192.0.2.1").attributes()["pk"], ClientKey("other", "192.0.2.1").attributes()["pk"])
+}
@@ -1,6 +1,8 @@
 package monitoring
 
 import (
+	"encoding/json"
+	"expvar"
 	"net/http"
 
 	"github.com/KL-Engineering/oauth2-server/internal/core"
@@ -15,8 +17,12 @@ func NewHandler() *Handler {
 
 func (h *Handler) SetupRouter(router *httprouter.Router) {
 	router.GET("/health", h.HealthHandler())
+	router.GET("/metrics", h.MetricsHandler())
 }
 
+// The `expvar` variables served at `/metrics`, which is unauthenticated so excludes the rest (e.g. `cmdline`)
+var metricVars = []string{"secret_cache"}
+
 type HealthResponse struct {
 	Status string `json:"status"`
 }
@@ -28,3 +34,16 @@ func (h *Handler) HealthHandler() httprouter.Handle {
 		})
 	}
 }
+
+func (h *Handler) MetricsHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		metrics := map[string]json.RawMessage{}
+		for _, name := range metricVars {
+			// Only published if its package is in use
+			if v := expvar.Get(name); v != nil {
+				metrics[name] = json.RawMessage(v.String())
+			}
+		}
+		core.JSONResponse(w, metrics)
+	}
+}
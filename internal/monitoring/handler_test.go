@@ -6,6 +6,8 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	// Publishes the `secret_cache` variables
+	_ "github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
 )
@@ -33,3 +35,23 @@ func TestHealth(t *testing.T) {
 		response,
 	)
 }
+
+func TestMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	router := httprouter.New()
+	NewHandler().SetupRouter(router)
+	router.ServeHTTP(w, r)
+	res := w.Result()
+
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var response map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&response))
+	a.Contains(response, "secret_cache")
+	a.NotContains(response, "memstats")
+	a.NotContains(response, "cmdline")
+}
@@ -0,0 +1,142 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/rsa"
+	"strings"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// The `typ` of our access tokens, see https://datatracker.ietf.org/doc/html/rfc9068#section-2.1
+const AccessTokenJWTType = "at+jwt"
+
+// Signs JWTs with the server's private key, with the `kid` of that key and (unlike `jwt.RS256JWTStrategy`,
+// which always uses `JWT`) a configurable `typ`
+type JWTSigningStrategy struct {
+	*jwt.RS256JWTStrategy
+	KeyID string
+	Type  string
+}
+
+var _ jwt.JWTStrategy = (*JWTSigningStrategy)(nil)
+
+func NewJWTSigningStrategy(privateKey *rsa.PrivateKey, typ string) (*JWTSigningStrategy, error) {
+	kid, err := crypto.KeyID(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTSigningStrategy{
+		RS256JWTStrategy: &jwt.RS256JWTStrategy{PrivateKey: privateKey},
+		KeyID:            kid,
+		Type:             typ,
+	}, nil
+}
+
+func (s *JWTSigningStrategy) Generate(ctx context.Context, claims jwt.MapClaims, header jwt.Mapper) (string, string, error) {
+	if claims == nil || header == nil {
+		return "", "", errors.New("Either claims or header is nil.")
+	}
+
+	options := &jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]interface{}{}}
+	// `jwt.Headers.ToMap` already omits any `alg` and `typ`
+	for k, v := range header.ToMap() {
+		options.ExtraHeaders[jose.HeaderKey(k)] = v
+	}
+	options.WithType(jose.ContentType(s.Type))
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: s.PrivateKey, KeyID: s.KeyID},
+	}, options)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	token, err := josejwt.Signed(signer).Claims(map[string]interface{}(claims)).CompactSerialize()
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	signature, err := s.GetSignature(ctx, token)
+	return token, signature, err
+}
+
+// Issues access tokens in the JWT profile of https://datatracker.ietf.org/doc/html/rfc9068, where
+// `DefaultJWTStrategy` should use a `JWTSigningStrategy` with a `typ` of `AccessTokenJWTType`
+//
+// Scopes are in both the standard `scope` string and (for existing resource servers) the `scp` list.
+//
+// Clients with a `token_format` of `opaque` are instead issued HMAC tokens, which are stored (see
+// `Store.CreateAccessTokenSession`) so they can be introspected
+type AccessTokenStrategy struct {
+	*oauth2.DefaultJWTStrategy
+}
+
+func NewAccessTokenStrategy(signer *JWTSigningStrategy, hmac *oauth2.HMACSHAStrategy) *AccessTokenStrategy {
+	return &AccessTokenStrategy{
+		DefaultJWTStrategy: (&oauth2.DefaultJWTStrategy{
+			JWTStrategy:     signer,
+			HMACSHAStrategy: hmac,
+		}).WithIssuer(ISSUER).WithScopeField(jwt.JWTScopeFieldBoth),
+	}
+}
+
+func (s *AccessTokenStrategy) GenerateAccessToken(ctx context.Context, requester fosite.Requester) (string, string, error) {
+	if isOpaqueTokenClient(requester.GetClient()) {
+		return s.HMACSHAStrategy.GenerateAccessToken(ctx, requester)
+	}
+
+	// The `aud` claim is required, so a token without a requested audience is for the platform itself
+	if len(requester.GetGrantedAudience()) == 0 {
+		requester.GrantAudience(ISSUER)
+	}
+	return s.DefaultJWTStrategy.GenerateAccessToken(ctx, requester)
+}
+
+func (s *AccessTokenStrategy) AccessTokenSignature(token string) string {
+	if !isJWT(token) {
+		return s.HMACSHAStrategy.AccessTokenSignature(token)
+	}
+	return s.DefaultJWTStrategy.AccessTokenSignature(token)
+}
+
+func (s *AccessTokenStrategy) ValidateAccessToken(ctx context.Context, requester fosite.Requester, token string) error {
+	if !isJWT(token) {
+		return s.HMACSHAStrategy.ValidateAccessToken(ctx, requester, token)
+	}
+	return s.DefaultJWTStrategy.ValidateAccessToken(ctx, requester, token)
+}
+
+func isOpaqueTokenClient(c fosite.Client) bool {
+	custom, ok := c.(CustomFositeClient)
+	return ok && custom.IsOpaqueTokenFormat()
+}
+
+// JWTs have three parts, whereas opaque (HMAC) tokens only have a key and signature
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Whether a token's header is that of an access token, rather than e.g. an ID token signed with the same key
+//
+// The `application/` prefix may be included, and the comparison is case insensitive, see
+// https://datatracker.ietf.org/doc/html/rfc9068#section-4
+func isAccessTokenType(header map[string]interface{}) bool {
+	typ, _ := header["typ"].(string)
+	typ = strings.TrimPrefix(strings.ToLower(typ), "application/")
+
+	// Tokens issued before this profile was implemented were `JWT`, and had the legacy `kid`, which new
+	// tokens never have. They're accepted until they expire, see `crypto.LegacyKeyID`.
+	if kid, _ := header["kid"].(string); kid == crypto.LegacyKeyID {
+		return typ == AccessTokenJWTType || typ == "jwt"
+	}
+	return typ == AccessTokenJWTType
+}
@@ -0,0 +1,117 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTSigningStrategy(t *testing.T) {
+	a := assert.New(t)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+	kid, err := crypto.KeyID(&privateKey.PublicKey)
+	a.NoError(err)
+
+	signer, err := NewJWTSigningStrategy(privateKey, AccessTokenJWTType)
+	a.NoError(err)
+
+	session := NewSession("subject")
+	token, _, err := signer.Generate(context.Background(), jwt.MapClaims{"sub": "subject"}, session.GetJWTHeader())
+	a.NoError(err)
+
+	headers, err := crypto.DecodeJWTHeader(token)
+	a.NoError(err)
+	a.Equal("RS256", headers["alg"])
+	a.Equal(AccessTokenJWTType, headers["typ"])
+	a.Equal(kid, headers["kid"])
+
+	// Still verifiable by fosite
+	decoded, err := signer.Decode(context.Background(), token)
+	a.NoError(err)
+	a.Equal("subject", decoded.Claims["sub"])
+	a.True(isAccessTokenType(decoded.Header))
+}
+
+func TestLegacyAccessToken(t *testing.T) {
+	a := assert.New(t)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+
+	// As tokens were signed before this profile was implemented
+	legacy := &JWTSigningStrategy{RS256JWTStrategy: &jwt.RS256JWTStrategy{PrivateKey: privateKey}, KeyID: crypto.LegacyKeyID, Type: "JWT"}
+	token, _, err := legacy.Generate(context.Background(), jwt.MapClaims{"sub": "subject"}, NewSession("subject").GetJWTHeader())
+	a.NoError(err)
+
+	signer, err := NewJWTSigningStrategy(privateKey, AccessTokenJWTType)
+	a.NoError(err)
+	decoded, err := signer.Decode(context.Background(), token)
+	a.NoError(err)
+	a.True(isAccessTokenType(decoded.Header))
+}
+
+func TestIsAccessTokenType(t *testing.T) {
+	for typ, expected := range map[interface{}]bool{
+		"at+jwt":             true,
+		"AT+JWT":             true,
+		"application/at+jwt": true,
+		"JWT":                false,
+		"":                   false,
+		nil:                  false,
+	} {
+		assert.Equal(t, expected, isAccessTokenType(map[string]interface{}{"typ": typ}), typ)
+	}
+
+	// Tokens issued before this profile was implemented
+	assert.True(t, isAccessTokenType(map[string]interface{}{"typ": "JWT", "kid": crypto.LegacyKeyID}))
+	assert.False(t, isAccessTokenType(map[string]interface{}{"typ": "JWT", "kid": "another-key"}))
+}
+
+func TestAccessTokenStrategyOpaque(t *testing.T) {
+	a := assert.New(t)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+	signer, err := NewJWTSigningStrategy(privateKey, AccessTokenJWTType)
+	a.NoError(err)
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	a.NoError(err)
+
+	strategy := NewAccessTokenStrategy(signer, compose.NewOAuth2HMACStrategy(config, secret, nil))
+
+	request := fosite.NewRequest()
+	request.Client = NewFositeClient(&client.Client{ID: uuid.NewString(), TokenFormat: client.OpaqueTokenFormat})
+	session := NewSession("")
+	session.SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Minute))
+	request.Session = session
+
+	token, signature, err := strategy.GenerateAccessToken(context.Background(), request)
+	a.NoError(err)
+	a.False(isJWT(token))
+	a.Equal(signature, strategy.AccessTokenSignature(token))
+	a.NoError(strategy.ValidateAccessToken(context.Background(), request, token))
+	a.Empty(request.GetGrantedAudience(), "Opaque tokens have no claims")
+
+	_, err = crypto.DecodeJWTPayload(token)
+	a.Error(err, "Nothing is revealed to the token's holder")
+
+	// The default format
+	request.Client = NewFositeClient(&client.Client{ID: uuid.NewString()})
+	token, signature, err = strategy.GenerateAccessToken(context.Background(), request)
+	a.NoError(err)
+	a.True(isJWT(token))
+	a.Equal(signature, strategy.AccessTokenSignature(token))
+}
@@ -0,0 +1,223 @@
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// Locks out Clients (per source IP, see `lockout.ClientKey`) and source IPs which fail to authenticate too often
+type clientLockout struct {
+	store *lockout.Store
+	// Whether the source IP is the last address of `X-Forwarded-For`, which must then be set by a proxy
+	trustForwardedFor bool
+}
+
+// Returns nil (which never locks out) if `store` is nil
+func newClientLockout(store *lockout.Store, trustForwardedFor bool) *clientLockout {
+	if store == nil {
+		return nil
+	}
+	return &clientLockout{store: store, trustForwardedFor: trustForwardedFor}
+}
+
+// Wrapped by the error of a locked out request, see `setRetryAfter`
+type lockedOutError struct {
+	retryAfter time.Duration
+}
+
+func (e *lockedOutError) Error() string {
+	return fmt.Sprintf("locked out for %s", e.retryAfter)
+}
+
+// Checks for a lockout before authenticating the Client, and counts the failure if it doesn't authenticate
+func (l *clientLockout) wrap(authenticate fosite.ClientAuthenticationStrategy) fosite.ClientAuthenticationStrategy {
+	if l == nil {
+		return authenticate
+	}
+
+	return func(ctx context.Context, r *http.Request, form url.Values) (fosite.Client, error) {
+		keys := l.keys(r)
+		if err := l.check(ctx, keys); err != nil {
+			return nil, err
+		}
+
+		client, err := authenticate(ctx, r, form)
+		if errors.Is(err, fosite.ErrInvalidClient) {
+			l.recordFailure(ctx, keys)
+		} else if err == nil {
+			l.reset(ctx, keys)
+		}
+		return client, err
+	}
+}
+
+// The keys whose failed authentications are counted for a request, i.e. its Client and its source IP
+type lockoutKeys struct {
+	// Only set if the request has both a Client ID and a source IP
+	client *lockout.Key
+	ip     *lockout.Key
+}
+
+func (k lockoutKeys) all() []lockout.Key {
+	keys := []lockout.Key{}
+	if k.client != nil {
+		keys = append(keys, *k.client)
+	}
+	if k.ip != nil {
+		keys = append(keys, *k.ip)
+	}
+	return keys
+}
+
+func (l *clientLockout) keys(req *http.Request) lockoutKeys {
+	keys := lockoutKeys{}
+	ip := sourceIP(req, l.trustForwardedFor)
+	if ip == "" {
+		return keys
+	}
+
+	ipKey := lockout.IPKey(ip)
+	keys.ip = &ipKey
+	if clientID, _ := clientCredentialsFromRequest(req); clientID != "" {
+		clientKey := lockout.ClientKey(clientID, ip)
+		keys.client = &clientKey
+	}
+	return keys
+}
+
+// Returns `fosite.ErrInvalidClient` (with a `429` status) if the Client or source IP is locked out
+func (l *clientLockout) check(ctx context.Context, keys lockoutKeys) error {
+	retryAfter := l.retryAfter(ctx, keys)
+	if retryAfter == 0 {
+		return nil
+	}
+
+	rfcErr := fosite.ErrInvalidClient.WithHint("Too many failed authentication attempts, try again later.")
+	rfcErr.CodeField = http.StatusTooManyRequests
+	return errors.WithStack(rfcErr.WithWrap(&lockedOutError{retryAfter: retryAfter}))
+}
+
+// The longest lockout of any of the keys, or 0 if none are locked out. Fails open if DynamoDB does.
+func (l *clientLockout) retryAfter(ctx context.Context, keys lockoutKeys) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	var retryAfter time.Duration
+	for _, key := range keys.all() {
+		counter, err := l.store.Get(ctx, key)
+		if err != nil {
+			log.Printf("Error occurred in lockout.Get: %+v", err)
+			continue
+		}
+		if d := counter.RetryAfter(); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	return retryAfter
+}
+
+// The keys whose invalid user codes are counted for a device verification request, i.e. its source IP
+func (l *clientLockout) userCodeKeys(req *http.Request) lockoutKeys {
+	keys := lockoutKeys{}
+	if l == nil {
+		return keys
+	}
+	if ip := sourceIP(req, l.trustForwardedFor); ip != "" {
+		ipKey := lockout.UserCodeKey(ip)
+		keys.ip = &ipKey
+	}
+	return keys
+}
+
+// Returns `fosite.ErrInvalidRequest` (with a `429` status) if the source IP has entered too many invalid user codes
+func (l *clientLockout) checkUserCode(ctx context.Context, keys lockoutKeys) error {
+	retryAfter := l.retryAfter(ctx, keys)
+	if retryAfter == 0 {
+		return nil
+	}
+
+	rfcErr := fosite.ErrInvalidRequest.WithHint("Too many invalid user codes, try again later.")
+	rfcErr.CodeField = http.StatusTooManyRequests
+	return errors.WithStack(rfcErr.WithWrap(&lockedOutError{retryAfter: retryAfter}))
+}
+
+// Counts a failed authentication against both the Client and the source IP
+func (l *clientLockout) recordFailure(ctx context.Context, keys lockoutKeys) {
+	if l == nil {
+		return
+	}
+
+	for _, key := range keys.all() {
+		if _, err := l.store.RecordFailure(ctx, key); err != nil {
+			log.Printf("Error occurred in lockout.RecordFailure: %+v", err)
+		}
+	}
+}
+
+// Forgets the failures of the Client (but not the source IP) once it has authenticated
+func (l *clientLockout) reset(ctx context.Context, keys lockoutKeys) {
+	if l == nil || keys.client == nil {
+		return
+	}
+
+	counter, err := l.store.Get(ctx, *keys.client)
+	if err != nil {
+		log.Printf("Error occurred in lockout.Get: %+v", err)
+		return
+	}
+	// Avoid a write for every token request
+	if counter.Failures == 0 {
+		return
+	}
+
+	if err := l.store.Reset(ctx, *keys.client); err != nil {
+		log.Printf("Error occurred in lockout.Reset: %+v", err)
+	}
+}
+
+// Tells the Client when to retry a lockout, or hashing being saturated (see `withHashingErrors`)
+func setRetryAfter(rw http.ResponseWriter, err error) {
+	var lockedOut *lockedOutError
+	if errors.As(err, &lockedOut) {
+		rw.Header().Set("Retry-After", retryAfterHeader(lockedOut.retryAfter))
+	} else if fosite.ErrorToRFC6749Error(err).CodeField == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", retryAfterHeader(hashingRetryAfter))
+	}
+}
+
+// Whole seconds, rounded up so a Client doesn't retry while still locked out
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// The IP of the request's peer, or (if it is a trusted proxy) the address it appended to `X-Forwarded-For`
+func sourceIP(req *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			// Earlier entries are set by the client, so can't be trusted
+			addrs := strings.Split(strings.Join(forwarded, ","), ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,32 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceIP(t *testing.T) {
+	a := assert.New(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/token", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Add("X-Forwarded-For", "198.51.100.1, 198.51.100.2")
+	req.Header.Add("X-Forwarded-For", "198.51.100.3")
+
+	a.Equal("192.0.2.1", sourceIP(req, false), "X-Forwarded-For is ignored unless trusted")
+	a.Equal("198.51.100.3", sourceIP(req, true), "Last address, as appended by the proxy")
+
+	req.Header.Del("X-Forwarded-For")
+	a.Equal("192.0.2.1", sourceIP(req, true), "Peer address without X-Forwarded-For")
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("1", retryAfterHeader(time.Millisecond*10), "Rounded up")
+	a.Equal("60", retryAfterHeader(time.Minute))
+}
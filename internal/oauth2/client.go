@@ -1,8 +1,13 @@
 package oauth2
 
 import (
+	"net/http"
+	"net/url"
+	"time"
+
 	"github.com/KL-Engineering/oauth2-server/internal/client"
 	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2"
 )
 
 type FositeClient struct {
@@ -11,11 +16,20 @@ type FositeClient struct {
 
 type CustomFositeClient interface {
 	fosite.Client
+	// Shown to end-users when they're asked for consent
+	GetName() string
 	GetAccountID() string
 	GetAndroidID() string
+	// Zero for the account's default
+	GetTokenLifespan() time.Duration
+	// Templates of extra claims, see `client.ValidateCustomClaims`
+	GetCustomClaims() map[string]string
+	// Whether access tokens are opaque rather than JWTs, see `client.OpaqueTokenFormat`
+	IsOpaqueTokenFormat() bool
 }
 
 var _ fosite.Client = (*FositeClient)(nil)
+var _ fosite.ClientWithSecretRotation = (*FositeClient)(nil)
 
 func NewFositeClient(model *client.Client) *FositeClient {
 	return &FositeClient{model: model}
@@ -29,33 +43,43 @@ func (c *FositeClient) GetHashedSecret() []byte {
 	return []byte(c.model.SecretHash)
 }
 
+// fosite accepts these secrets as well, so the previous secret is accepted until its grace period ends
+func (c *FositeClient) GetRotatedHashes() [][]byte {
+	if hash := c.model.ValidPreviousSecretHash(); hash != "" {
+		return [][]byte{[]byte(hash)}
+	}
+	return nil
+}
+
 func (c *FositeClient) GetRedirectURIs() []string {
-	// Currently no public client support
-	return []string{}
+	return c.model.RedirectURIs
 }
 
 func (c *FositeClient) GetGrantTypes() fosite.Arguments {
-	// Currently only support client_credentials
-	return []string{"client_credentials"}
+	return c.model.GetGrantTypes()
 }
 
 func (c *FositeClient) GetScopes() fosite.Arguments {
-	return []string{""}
+	return c.model.AllowedScopes
 }
 
 func (c *FositeClient) GetResponseTypes() fosite.Arguments {
-	// Currently only support access_tokens
+	if c.GetGrantTypes().Has(client.AuthorizationCode) {
+		return []string{"token", "code"}
+	}
 	return []string{"token"}
 }
 
 func (c *FositeClient) IsPublic() bool {
-	// Currently no public client support
-	return false
+	return c.model.IsPublic()
 }
 
 func (c *FositeClient) GetAudience() fosite.Arguments {
-	// Currently only support a single (global) platform "audience"
-	return []string{}
+	return c.model.AllowedAudiences
+}
+
+func (c *FositeClient) GetName() string {
+	return c.model.Name
 }
 
 func (c *FositeClient) GetAccountID() string {
@@ -65,3 +89,79 @@ func (c *FositeClient) GetAccountID() string {
 func (c *FositeClient) GetAndroidID() string {
 	return c.model.AndroidID
 }
+
+func (c *FositeClient) GetTokenLifespan() time.Duration {
+	return time.Duration(c.model.TokenLifespan) * time.Second
+}
+
+func (c *FositeClient) GetCustomClaims() map[string]string {
+	return c.model.CustomClaims
+}
+
+func (c *FositeClient) IsOpaqueTokenFormat() bool {
+	return c.model.TokenFormat == client.OpaqueTokenFormat
+}
+
+// A Client which authenticates with a signed `client_assertion` (`private_key_jwt`)
+//
+// Only these Clients implement `fosite.OpenIDConnectClient`, as fosite otherwise restricts
+// secret based Clients to a single one of `client_secret_basic` or `client_secret_post`
+type FositeJWKClient struct {
+	*FositeClient
+}
+
+var _ fosite.OpenIDConnectClient = (*FositeJWKClient)(nil)
+
+func NewFositeJWKClient(model *client.Client) *FositeJWKClient {
+	return &FositeJWKClient{FositeClient: NewFositeClient(model)}
+}
+
+func (c *FositeJWKClient) GetTokenEndpointAuthMethod() string {
+	return client.PrivateKeyJWT
+}
+
+func (c *FositeJWKClient) GetTokenEndpointAuthSigningAlgorithm() string {
+	if c.model.TokenEndpointAuthSigningAlg == "" {
+		return client.DefaultTokenEndpointAuthSigningAlg
+	}
+	return c.model.TokenEndpointAuthSigningAlg
+}
+
+func (c *FositeJWKClient) GetJSONWebKeys() *jose.JSONWebKeySet {
+	if c.model.JWKS == nil {
+		return nil
+	}
+	return &c.model.JWKS.JSONWebKeySet
+}
+
+func (c *FositeJWKClient) GetJSONWebKeysURI() string {
+	return c.model.JWKSURI
+}
+
+func (c *FositeJWKClient) GetRequestURIs() []string {
+	// Request objects are not supported
+	return []string{}
+}
+
+func (c *FositeJWKClient) GetRequestObjectSigningAlgorithm() string {
+	// Request objects are not supported
+	return ""
+}
+
+// The ID and secret a Client presented, via either `client_secret_basic` or the `client_id` and
+// `client_secret` parameters, as fosite reads them. The secret is empty if it isn't secret based.
+func clientCredentialsFromRequest(req *http.Request) (string, string) {
+	id, secret, ok := req.BasicAuth()
+	if !ok {
+		return req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+	}
+
+	// Credentials are form-urlencoded, see https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+	if unescaped, err := url.QueryUnescape(id); err == nil {
+		id = unescaped
+	}
+	if unescaped, err := url.QueryUnescape(secret); err == nil {
+		secret = unescaped
+	}
+	return id, secret
+}
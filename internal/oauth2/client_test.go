@@ -0,0 +1,35 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCredentialsFromRequest(t *testing.T) {
+	a := assert.New(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/token", nil)
+	req.SetBasicAuth(url.QueryEscape("client:id"), url.QueryEscape("pa$$:word"))
+	id, secret := clientCredentialsFromRequest(req)
+	a.Equal("client:id", id, "Basic auth is form-urlencoded")
+	a.Equal("pa$$:word", secret, "Basic auth is form-urlencoded")
+
+	form := url.Values{"client_id": {"client"}, "client_secret": {"pa$$word"}}
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	id, secret = clientCredentialsFromRequest(req)
+	a.Equal("client", id)
+	a.Equal("pa$$word", secret)
+
+	form = url.Values{"client_id": {"client"}}
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	id, secret = clientCredentialsFromRequest(req)
+	a.Equal("client", id)
+	a.Empty(secret, "Not a secret based Client")
+}
@@ -0,0 +1,269 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// How long a consent page may be submitted for after it was shown
+const consentLifespan = time.Minute * 10
+
+// The end-user's decision on an authorization request
+type Consent struct {
+	// The authenticated end-user, used as the `sub` of the issued tokens
+	Subject string
+	// The end-user's account, used as the `account_id` of the issued tokens
+	AccountID       string
+	GrantedScopes   []string
+	GrantedAudience []string
+}
+
+// Hands off an authorization request to the end-user's login and consent
+type ConsentStrategy interface {
+	// Returns nil (and no error) if a response has already been written, e.g. a redirect to a login page.
+	// Errors are returned to the Client, so should be a `fosite.RFC6749Error` such as `fosite.ErrAccessDenied`
+	HandleAuthorizeRequest(rw http.ResponseWriter, req *http.Request, ar fosite.AuthorizeRequester) (*Consent, error)
+}
+
+// Hands off a device authorization request (see `DeviceAuthorization`) to the end-user, who has
+// entered the device's user code
+//
+// A GET must only show the request (or where to enter the user code), as anyone can link to it
+type DeviceVerificationStrategy interface {
+	// Called before the user code is looked up, so that only end-users can tell whether it is valid.
+	// Returns nil (and no error) if a response has already been written, e.g. a redirect to a login page.
+	AuthenticateDeviceRequest(rw http.ResponseWriter, req *http.Request) (*EndUser, error)
+	// `authorization` and `client` are nil if the end-user has yet to enter a user code.
+	//
+	// Returns nil (and no error) if a response has already been written, e.g. the consent page.
+	// Returning `fosite.ErrAccessDenied` denies the request, so the device stops polling
+	HandleDeviceRequest(rw http.ResponseWriter, req *http.Request, user *EndUser, authorization *DeviceAuthorization, client CustomFositeClient) (*Consent, error)
+}
+
+// Authenticates the end-user by the platform's session (see `LoginSession`), then asks them to
+// approve the request on a consent page, which is posted back to the same endpoint
+//
+// Only the scopes the end-user selects are granted, out of those requested (which have already been
+// checked against what the Client is allowed)
+type SessionConsentStrategy struct {
+	Login *LoginSession
+	// Signs the consent page, so that only the end-user it was shown to can submit it, see `ConsentCSRFKey`
+	CSRFKey []byte
+}
+
+// A key for `SessionConsentStrategy.CSRFKey`, derived from (rather than reusing) another secret,
+// e.g. the HMAC secret of opaque tokens
+func ConsentCSRFKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("consent-csrf"))
+	return mac.Sum(nil)
+}
+
+var (
+	_ ConsentStrategy            = (*SessionConsentStrategy)(nil)
+	_ DeviceVerificationStrategy = (*SessionConsentStrategy)(nil)
+)
+
+func (s *SessionConsentStrategy) HandleAuthorizeRequest(rw http.ResponseWriter, req *http.Request, ar fosite.AuthorizeRequester) (*Consent, error) {
+	promptNone := fosite.Arguments(fosite.RemoveEmpty(strings.Split(ar.GetRequestForm().Get("prompt"), " "))).Has("none")
+
+	user, err := s.Login.Authenticate(rw, req, !promptNone)
+	if user == nil || err != nil {
+		return nil, err
+	}
+
+	client := ar.GetClient().(CustomFositeClient)
+	purpose := "authorize#" + client.GetID()
+
+	if req.PostForm.Get("consent") == "" {
+		// Consent isn't remembered, so must be given every time
+		if promptNone {
+			return nil, errors.WithStack(fosite.ErrConsentRequired)
+		}
+		s.renderConsentPage(rw, req, &consentPage{
+			ClientName: client.GetName(),
+			Scopes:     ar.GetRequestedScopes(),
+			Audience:   ar.GetRequestedAudience(),
+			Form:       ar.GetRequestForm(),
+			CSRFToken:  s.csrfToken(user, purpose, time.Now().Add(consentLifespan)),
+		})
+		return nil, nil
+	}
+
+	if !s.validCSRFToken(req.PostForm.Get("csrf_token"), user, purpose) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The consent page is invalid or has expired."))
+	}
+	if req.PostForm.Get("consent") != "approve" {
+		return nil, errors.WithStack(fosite.ErrAccessDenied.WithHint("The end-user denied the authorization request."))
+	}
+
+	return &Consent{
+		Subject:         user.Subject,
+		AccountID:       user.AccountID,
+		GrantedScopes:   approvedScopes(ar.GetRequestedScopes(), req.PostForm),
+		GrantedAudience: ar.GetRequestedAudience(),
+	}, nil
+}
+
+func (s *SessionConsentStrategy) AuthenticateDeviceRequest(rw http.ResponseWriter, req *http.Request) (*EndUser, error) {
+	return s.Login.Authenticate(rw, req, true)
+}
+
+// The end-user confirms the user code (which the verification URI may have prefilled) on the consent page
+func (s *SessionConsentStrategy) HandleDeviceRequest(rw http.ResponseWriter, req *http.Request, user *EndUser, authorization *DeviceAuthorization, client CustomFositeClient) (*Consent, error) {
+	if authorization == nil {
+		renderPage(rw, userCodeTemplate, nil)
+		return nil, nil
+	}
+
+	purpose := "device#" + authorization.DeviceCodeSignature
+
+	if req.Method != http.MethodPost || req.PostForm.Get("consent") == "" {
+		s.renderConsentPage(rw, req, &consentPage{
+			ClientName: client.GetName(),
+			UserCode:   FormatUserCode(authorization.UserCode),
+			Scopes:     authorization.RequestedScope,
+			Audience:   authorization.RequestedAudience,
+			Form:       url.Values{"user_code": {FormatUserCode(authorization.UserCode)}},
+			CSRFToken:  s.csrfToken(user, purpose, time.Now().Add(consentLifespan)),
+		})
+		return nil, nil
+	}
+
+	if !s.validCSRFToken(req.PostForm.Get("csrf_token"), user, purpose) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The consent page is invalid or has expired."))
+	}
+	if req.PostForm.Get("consent") != "approve" {
+		return nil, errors.WithStack(fosite.ErrAccessDenied.WithHint("The end-user denied the device authorization request."))
+	}
+
+	return &Consent{
+		Subject:         user.Subject,
+		AccountID:       user.AccountID,
+		GrantedScopes:   approvedScopes(authorization.RequestedScope, req.PostForm),
+		GrantedAudience: authorization.RequestedAudience,
+	}, nil
+}
+
+// The requested scopes which the end-user left selected on the consent page
+func approvedScopes(requested fosite.Arguments, form url.Values) []string {
+	approved := fosite.Arguments(form["granted_scope"])
+	scopes := []string{}
+	for _, scope := range requested {
+		if approved.Has(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// A CSRF token, which is only valid for the end-user and what they're consenting to (`purpose`) until `exp`
+func (s *SessionConsentStrategy) csrfToken(user *EndUser, purpose string, exp time.Time) string {
+	mac := hmac.New(sha256.New, s.CSRFKey)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s", exp.Unix(), user.Subject, user.AccountID, purpose)
+	return fmt.Sprintf("%d.%s", exp.Unix(), base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *SessionConsentStrategy) validCSRFToken(token string, user *EndUser, purpose string) bool {
+	if len(s.CSRFKey) == 0 {
+		return false
+	}
+	prefix, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	exp, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(s.csrfToken(user, purpose, time.Unix(exp, 0))))
+}
+
+type consentPage struct {
+	Action     string
+	ClientName string
+	// Of a device, which the end-user should check matches the code it shows
+	UserCode string
+	Scopes   []string
+	Audience []string
+	// The request, which is submitted again along with the end-user's decision
+	Form      url.Values
+	CSRFToken string
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Allow {{.ClientName}}?</title>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<p><strong>{{.ClientName}}</strong> would like to access your account.</p>
+{{if .UserCode}}<p>Only continue if your device shows the code <strong>{{.UserCode}}</strong>.</p>
+{{end}}{{range .Scopes}}<label><input type="checkbox" name="granted_scope" value="{{.}}" checked> {{.}}</label><br>
+{{end}}{{if .Audience}}<p>It will be able to use: {{range .Audience}}{{.}} {{end}}</p>
+{{end}}{{range $name, $values := .Form}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit" name="consent" value="approve">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// Where the end-user enters the code shown on their device, which is submitted to the consent page
+var userCodeTemplate = template.Must(template.New("user_code").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Connect a device</title>
+</head>
+<body>
+<form method="get">
+<label>Enter the code shown on your device <input type="text" name="user_code" autocomplete="off" required></label>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// The page is posted back to the URL it was shown at
+func (s *SessionConsentStrategy) renderConsentPage(rw http.ResponseWriter, req *http.Request, page *consentPage) {
+	form := url.Values{}
+	for name, values := range page.Form {
+		switch name {
+		case "consent", "csrf_token", "granted_scope":
+		default:
+			form[name] = values
+		}
+	}
+	page.Form = form
+	page.Action = req.URL.Path
+
+	renderPage(rw, consentTemplate, page)
+}
+
+// Pages can't be framed, which could trick the end-user into approving a request
+func renderPage(rw http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	rw.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	if err := tmpl.Execute(rw, data); err != nil {
+		log.Printf("Error occurred in renderPage: %+v", err)
+	}
+}
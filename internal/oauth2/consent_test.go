@@ -0,0 +1,187 @@
+package oauth2
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuthorizeRequest(scopes ...string) *fosite.AuthorizeRequest {
+	ar := fosite.NewAuthorizeRequest()
+	ar.Client = NewFositeClient(&client.Client{ID: uuid.NewString(), Name: "<Lessons>"})
+	ar.RequestedScope = scopes
+	ar.Form = url.Values{"client_id": {ar.Client.GetID()}, "scope": {strings.Join(scopes, " ")}}
+	return ar
+}
+
+// A POST of the consent page (whose form was `page`) by the end-user of `cookie`
+func newConsentRequest(page url.Values, cookie *http.Cookie, decision url.Values) *http.Request {
+	form := url.Values{}
+	for name, values := range page {
+		form[name] = values
+	}
+	for name, values := range decision {
+		form[name] = values
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	_ = req.ParseForm()
+	return req
+}
+
+func TestSessionConsentStrategy(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+	s := &SessionConsentStrategy{Login: login, CSRFKey: []byte("csrf")}
+
+	accountID := uuid.NewString()
+	cookie := sessionCookie(a, key, "user", accountID)
+	ar := newTestAuthorizeRequest("offline_access", "lessons.read")
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/auth?"+ar.Form.Encode(), nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+
+	consent, err := s.HandleAuthorizeRequest(rw, req, ar)
+	a.NoError(err)
+	a.Nil(consent, "The consent page is shown")
+	a.Equal(http.StatusOK, rw.Code)
+	a.Equal("DENY", rw.Header().Get("X-Frame-Options"))
+	a.Contains(rw.Body.String(), "&lt;Lessons&gt;")
+
+	page := url.Values{}
+	for _, input := range hiddenInputPattern.FindAllStringSubmatch(rw.Body.String(), -1) {
+		page.Add(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+	}
+	a.Equal(ar.Form.Get("scope"), page.Get("scope"))
+	a.NotEmpty(page.Get("csrf_token"))
+
+	// Only requested scopes are granted
+	req = newConsentRequest(page, cookie, url.Values{"consent": {"approve"}, "granted_scope": {"lessons.read", "admin"}})
+	consent, err = s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+	a.NoError(err)
+	a.Equal(&Consent{
+		Subject:         "user",
+		AccountID:       accountID,
+		GrantedScopes:   []string{"lessons.read"},
+		GrantedAudience: []string{},
+	}, consent)
+
+	req = newConsentRequest(page, cookie, url.Values{"consent": {"deny"}})
+	_, err = s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+	a.ErrorIs(err, fosite.ErrAccessDenied)
+}
+
+func TestSessionConsentStrategyCSRF(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+	s := &SessionConsentStrategy{Login: login, CSRFKey: []byte("csrf")}
+
+	user := &EndUser{Subject: "user", AccountID: uuid.NewString()}
+	cookie := sessionCookie(a, key, user.Subject, user.AccountID)
+	ar := newTestAuthorizeRequest()
+	purpose := "authorize#" + ar.Client.GetID()
+
+	for _, tc := range []struct {
+		token  string
+		reason string
+	}{
+		{token: "", reason: "Missing"},
+		{token: s.csrfToken(user, purpose, time.Now().Add(-time.Minute)), reason: "Expired"},
+		{token: s.csrfToken(&EndUser{Subject: "other", AccountID: user.AccountID}, purpose, time.Now().Add(time.Minute)), reason: "Another end-user"},
+		{token: s.csrfToken(user, "authorize#other", time.Now().Add(time.Minute)), reason: "Another Client"},
+		{token: (&SessionConsentStrategy{CSRFKey: []byte("other")}).csrfToken(user, purpose, time.Now().Add(time.Minute)), reason: "Another key"},
+	} {
+		req := newConsentRequest(ar.Form, cookie, url.Values{"consent": {"approve"}, "csrf_token": {tc.token}})
+		consent, err := s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+		a.Nil(consent, tc.reason)
+		a.ErrorIs(err, fosite.ErrRequestForbidden, tc.reason)
+	}
+
+	req := newConsentRequest(ar.Form, cookie, url.Values{"consent": {"approve"}, "csrf_token": {s.csrfToken(user, purpose, time.Now().Add(time.Minute))}})
+	consent, err := s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+	a.NoError(err)
+	a.NotNil(consent)
+}
+
+func TestSessionConsentStrategyPromptNone(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+	s := &SessionConsentStrategy{Login: login, CSRFKey: []byte("csrf")}
+
+	ar := newTestAuthorizeRequest()
+	ar.Form.Set("prompt", "none")
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/auth?"+ar.Form.Encode(), nil)
+	_, err := s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+	a.ErrorIs(err, fosite.ErrLoginRequired)
+
+	req.AddCookie(sessionCookie(a, key, "user", uuid.NewString()))
+	_, err = s.HandleAuthorizeRequest(httptest.NewRecorder(), req, ar)
+	a.ErrorIs(err, fosite.ErrConsentRequired)
+}
+
+func TestSessionConsentStrategyDevice(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+	s := &SessionConsentStrategy{Login: login, CSRFKey: []byte("csrf")}
+
+	cookie := sessionCookie(a, key, "user", uuid.NewString())
+	authorization := &DeviceAuthorization{
+		DeviceCodeSignature: DeviceCodeSignature("device-code"),
+		UserCode:            "BCDFGHJK",
+		RequestedScope:      []string{"lessons.read"},
+	}
+	c := NewFositeClient(&client.Client{ID: uuid.NewString(), Name: "Classroom Tablet"})
+
+	// Approving requires a POST from the consent page, so a GET only shows it
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/device/verify?user_code=BCDF-GHJK&consent=approve", nil)
+	_, err := s.AuthenticateDeviceRequest(httptest.NewRecorder(), req)
+	a.ErrorIs(err, fosite.ErrLoginRequired)
+
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+
+	user, err := s.AuthenticateDeviceRequest(rw, req)
+	a.NoError(err)
+	a.Equal("user", user.Subject)
+
+	consent, err := s.HandleDeviceRequest(rw, req, user, authorization, c)
+	a.NoError(err)
+	a.Nil(consent)
+	a.Contains(rw.Body.String(), "BCDF-GHJK")
+
+	page := url.Values{}
+	for _, input := range hiddenInputPattern.FindAllStringSubmatch(rw.Body.String(), -1) {
+		page.Add(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+	}
+
+	req = newConsentRequest(url.Values{"user_code": {"BCDF-GHJK"}}, cookie, url.Values{"consent": {"approve"}})
+	_, err = s.HandleDeviceRequest(httptest.NewRecorder(), req, user, authorization, c)
+	a.ErrorIs(err, fosite.ErrRequestForbidden, "No CSRF token")
+
+	req = newConsentRequest(page, cookie, url.Values{"consent": {"approve"}, "granted_scope": {"lessons.read"}})
+	consent, err = s.HandleDeviceRequest(httptest.NewRecorder(), req, user, authorization, c)
+	a.NoError(err)
+	a.Equal([]string{"lessons.read"}, consent.GrantedScopes)
+
+	// Before a user code has been entered
+	req = httptest.NewRequest(http.MethodGet, "/oauth2/device/verify", nil)
+	req.AddCookie(cookie)
+	rw = httptest.NewRecorder()
+	consent, err = s.HandleDeviceRequest(rw, req, user, nil, nil)
+	a.NoError(err)
+	a.Nil(consent)
+	a.Contains(rw.Body.String(), `name="user_code"`)
+}
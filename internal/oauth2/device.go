@@ -0,0 +1,312 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/ory/fosite"
+)
+
+const (
+	// Device authorizations, keyed by the signature of their device code
+	deviceCodeNamespace = "DeviceCode"
+	// Pointers from a user code to its device authorization
+	userCodeNamespace = "UserCode"
+
+	DeviceCodeLifespan = time.Minute * 10
+	// The default minimum interval between polls of the token endpoint
+	DeviceCodeInterval = 5
+	// https://datatracker.ietf.org/doc/html/rfc8628#section-3.5
+	slowDownIncrement = 5
+
+	// Retries in the (unlikely) event of a user code collision
+	userCodeAttempts = 3
+)
+
+type DeviceAuthorizationStatus string
+
+const (
+	DeviceAuthorizationPending  DeviceAuthorizationStatus = "pending"
+	DeviceAuthorizationApproved DeviceAuthorizationStatus = "approved"
+	DeviceAuthorizationDenied   DeviceAuthorizationStatus = "denied"
+	// Tokens have been issued, so the device code can't be used again
+	DeviceAuthorizationUsed DeviceAuthorizationStatus = "used"
+)
+
+// A device authorization request, see https://datatracker.ietf.org/doc/html/rfc8628
+type DeviceAuthorization struct {
+	DeviceCodeSignature string                    `dynamodbav:"device_code_signature"`
+	UserCode            string                    `dynamodbav:"user_code"`
+	ClientID            string                    `dynamodbav:"client_id"`
+	RequestedScope      []string                  `dynamodbav:"requested_scope"`
+	RequestedAudience   []string                  `dynamodbav:"requested_audience"`
+	RequestedAt         time.Time                 `dynamodbav:"requested_at"`
+	ExpiresAt           time.Time                 `dynamodbav:"expires_at"`
+	Status              DeviceAuthorizationStatus `dynamodbav:"status"`
+	// Minimum seconds between polls of the token endpoint, which is increased by `slow_down`
+	Interval     int       `dynamodbav:"interval"`
+	LastPolledAt time.Time `dynamodbav:"last_polled_at"`
+	// Set once approved by the end-user
+	Subject         string    `dynamodbav:"subject"`
+	AccountID       string    `dynamodbav:"account_id"`
+	GrantedScope    []string  `dynamodbav:"granted_scope"`
+	GrantedAudience []string  `dynamodbav:"granted_audience"`
+	ApprovedAt      time.Time `dynamodbav:"approved_at"`
+	TTL             int64     `dynamodbav:"ttl"`
+}
+
+func (a *DeviceAuthorization) IsExpired() bool {
+	return time.Now().After(a.ExpiresAt)
+}
+
+// Only the signature of the device code is stored, so the table can't be used to obtain tokens
+func DeviceCodeSignature(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// Removes formatting (e.g. `BCDF-GHJK`) and is case insensitive, as the end-user types the code
+func NormalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		for _, c := range crypto.UserCodeRunes {
+			if r == c {
+				return r
+			}
+		}
+		return -1
+	}, strings.ToUpper(userCode))
+}
+
+// Formats a user code for display, e.g. `BCDF-GHJK`
+func FormatUserCode(userCode string) string {
+	if len(userCode) != crypto.UserCodeLength {
+		return userCode
+	}
+	return userCode[:crypto.UserCodeLength/2] + "-" + userCode[crypto.UserCodeLength/2:]
+}
+
+type DeviceStore struct {
+	dynamodb *dynamodb.Client
+}
+
+func NewDeviceStore(dynamodbClient *dynamodb.Client) *DeviceStore {
+	return &DeviceStore{
+		dynamodb: dynamodbClient,
+	}
+}
+
+// Returns the new authorization and its device code, which is only known by the device
+func (s *DeviceStore) Create(ctx context.Context, clientID string, scopes []string, audience []string) (*DeviceAuthorization, string, error) {
+	deviceCode, err := crypto.GenerateSecret()
+	if err != nil {
+		return nil, "", fmt.Errorf("crypto.GenerateSecret: %w", err)
+	}
+
+	now := time.Now()
+	authorization := &DeviceAuthorization{
+		DeviceCodeSignature: DeviceCodeSignature(deviceCode),
+		ClientID:            clientID,
+		RequestedScope:      scopes,
+		RequestedAudience:   audience,
+		RequestedAt:         now,
+		ExpiresAt:           now.Add(DeviceCodeLifespan),
+		Status:              DeviceAuthorizationPending,
+		Interval:            DeviceCodeInterval,
+		TTL:                 now.Add(DeviceCodeLifespan).Unix(),
+	}
+
+	for attempt := 1; ; attempt++ {
+		authorization.UserCode, err = crypto.GenerateUserCode()
+		if err != nil {
+			return nil, "", fmt.Errorf("crypto.GenerateUserCode: %w", err)
+		}
+
+		err = s.put(ctx, authorization)
+		if err == nil {
+			return authorization, deviceCode, nil
+		}
+		if apiErr := new(types.TransactionCanceledException); !errors.As(err, &apiErr) || attempt == userCodeAttempts {
+			return nil, "", err
+		}
+	}
+}
+
+// Writes the authorization along with a pointer from its user code, which must be unique
+func (s *DeviceStore) put(ctx context.Context, authorization *DeviceAuthorization) error {
+	item, err := attributevalue.MarshalMap(authorization)
+	if err != nil {
+		return fmt.Errorf("attributevalue.MarshalMap %s: %w", deviceCodeNamespace, err)
+	}
+	for k, v := range storage.Key(deviceCodeNamespace, authorization.DeviceCodeSignature) {
+		item[k] = v
+	}
+
+	pointer := storage.Key(userCodeNamespace, authorization.UserCode)
+	pointer["device_code_signature"] = &types.AttributeValueMemberS{Value: authorization.DeviceCodeSignature}
+	pointer[storage.TTLAttribute] = item[storage.TTLAttribute]
+
+	// DynamoDB TTL deletion is lazy, so an expired user code may still exist
+	expr, err := expression.NewBuilder().WithCondition(storage.AbsentOrExpired()).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = s.dynamodb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(tableName),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(pk)"),
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName:                 aws.String(tableName),
+					Item:                      pointer,
+					ConditionExpression:       expr.Condition(),
+					ExpressionAttributeNames:  expr.Names(),
+					ExpressionAttributeValues: expr.Values(),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.TransactWriteItems %s: %w", deviceCodeNamespace, err)
+	}
+
+	return nil
+}
+
+// Returns `fosite.ErrNotFound` if there is no such authorization, but not if it has expired (see `IsExpired`)
+func (s *DeviceStore) Get(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	return s.getBySignature(ctx, DeviceCodeSignature(deviceCode))
+}
+
+func (s *DeviceStore) getBySignature(ctx context.Context, signature string) (*DeviceAuthorization, error) {
+	output, err := s.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            storage.Key(deviceCodeNamespace, signature),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem %s: %w", deviceCodeNamespace, err)
+	}
+
+	if output.Item == nil {
+		return nil, fosite.ErrNotFound
+	}
+
+	var authorization DeviceAuthorization
+	if err := attributevalue.UnmarshalMap(output.Item, &authorization); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap %s: %w", deviceCodeNamespace, err)
+	}
+
+	return &authorization, nil
+}
+
+// Returns `fosite.ErrNotFound` if there is no such authorization, or it has expired
+func (s *DeviceStore) GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	output, err := s.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            storage.Key(userCodeNamespace, NormalizeUserCode(userCode)),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem %s: %w", userCodeNamespace, err)
+	}
+
+	signature, ok := output.Item["device_code_signature"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	authorization, err := s.getBySignature(ctx, signature.Value)
+	if err != nil {
+		return nil, err
+	}
+	if authorization.IsExpired() {
+		return nil, fosite.ErrNotFound
+	}
+
+	return authorization, nil
+}
+
+// Records a poll of the token endpoint, along with the (possibly increased) interval
+func (s *DeviceStore) Poll(ctx context.Context, signature string, interval int) error {
+	update := expression.Set(
+		expression.Name("last_polled_at"), expression.Value(time.Now()),
+	).Set(
+		expression.Name("interval"), expression.Value(interval),
+	)
+	return s.update(ctx, signature, DeviceAuthorizationPending, update)
+}
+
+func (s *DeviceStore) Approve(ctx context.Context, signature string, consent *Consent) error {
+	update := expression.Set(
+		expression.Name("status"), expression.Value(DeviceAuthorizationApproved),
+	).Set(
+		expression.Name("subject"), expression.Value(consent.Subject),
+	).Set(
+		expression.Name("account_id"), expression.Value(consent.AccountID),
+	).Set(
+		expression.Name("granted_scope"), expression.Value(consent.GrantedScopes),
+	).Set(
+		expression.Name("granted_audience"), expression.Value(consent.GrantedAudience),
+	).Set(
+		expression.Name("approved_at"), expression.Value(time.Now()),
+	)
+	return s.update(ctx, signature, DeviceAuthorizationPending, update)
+}
+
+func (s *DeviceStore) Deny(ctx context.Context, signature string) error {
+	update := expression.Set(expression.Name("status"), expression.Value(DeviceAuthorizationDenied))
+	return s.update(ctx, signature, DeviceAuthorizationPending, update)
+}
+
+// Conditional write, so that of concurrent polls only one is issued tokens
+func (s *DeviceStore) Use(ctx context.Context, signature string) error {
+	update := expression.Set(expression.Name("status"), expression.Value(DeviceAuthorizationUsed))
+	return s.update(ctx, signature, DeviceAuthorizationApproved, update)
+}
+
+// Returns `ErrRequestInactive` if the authorization isn't in the `from` status
+func (s *DeviceStore) update(ctx context.Context, signature string, from DeviceAuthorizationStatus, update expression.UpdateBuilder) error {
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.Name("status").Equal(expression.Value(from)),
+	).WithUpdate(
+		update,
+	).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = s.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       storage.Key(deviceCodeNamespace, signature),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+			return ErrRequestInactive
+		}
+		return fmt.Errorf("dynamodb.UpdateItem %s: %w", deviceCodeNamespace, err)
+	}
+
+	return nil
+}
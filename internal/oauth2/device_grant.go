@@ -0,0 +1,206 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/pkg/errors"
+)
+
+// Token endpoint errors of the device authorization grant, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.5
+var (
+	ErrAuthorizationPending = &fosite.RFC6749Error{
+		ErrorField:       "authorization_pending",
+		DescriptionField: "The authorization request is still pending as the end-user hasn't yet completed the user-interaction steps.",
+		CodeField:        http.StatusBadRequest,
+	}
+	ErrSlowDown = &fosite.RFC6749Error{
+		ErrorField:       "slow_down",
+		DescriptionField: "The authorization request is still pending and polling should continue, but the interval MUST be increased by 5 seconds for this and all subsequent requests.",
+		CodeField:        http.StatusBadRequest,
+	}
+	ErrExpiredToken = &fosite.RFC6749Error{
+		ErrorField:       "expired_token",
+		DescriptionField: "The 'device_code' has expired, and the device authorization session has concluded.",
+		CodeField:        http.StatusBadRequest,
+	}
+)
+
+// Exchanges a `device_code` for tokens, once the end-user has approved the device
+//
+// fosite doesn't implement https://datatracker.ietf.org/doc/html/rfc8628, so this mirrors its
+// `AuthorizeExplicitGrantHandler`
+type DeviceCodeGrantHandler struct {
+	AccessTokenStrategy  oauth2.AccessTokenStrategy
+	RefreshTokenStrategy oauth2.RefreshTokenStrategy
+	Store                *Store
+	AccessTokenLifespan  time.Duration
+	RefreshTokenLifespan time.Duration
+	RefreshTokenScopes   []string
+}
+
+var _ fosite.TokenEndpointHandler = (*DeviceCodeGrantHandler)(nil)
+
+func DeviceCodeGrantFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &DeviceCodeGrantHandler{
+		AccessTokenStrategy:  strategy.(oauth2.AccessTokenStrategy),
+		RefreshTokenStrategy: strategy.(oauth2.RefreshTokenStrategy),
+		Store:                storage.(*Store),
+		AccessTokenLifespan:  config.GetAccessTokenLifespan(),
+		RefreshTokenLifespan: config.GetRefreshTokenLifespan(),
+		RefreshTokenScopes:   config.GetRefreshTokenScopes(),
+	}
+}
+
+func (h *DeviceCodeGrantHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
+	if !h.CanHandleTokenEndpointRequest(request) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	if !request.GetClient().GetGrantTypes().Has(client.DeviceCode) {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant '%s'.", client.DeviceCode))
+	}
+
+	deviceCode := request.GetRequestForm().Get("device_code")
+	if deviceCode == "" {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'device_code' parameter is required."))
+	}
+
+	authorization, err := h.Store.devices.Get(ctx, deviceCode)
+	if errors.Is(err, fosite.ErrNotFound) {
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The 'device_code' is invalid."))
+	} else if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if authorization.ClientID != request.GetClient().GetID() {
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The OAuth 2.0 Client ID from this request does not match the one from the device authorization request."))
+	}
+
+	if authorization.IsExpired() {
+		return errors.WithStack(ErrExpiredToken)
+	}
+
+	switch authorization.Status {
+	case DeviceAuthorizationPending:
+		return h.poll(ctx, authorization)
+	case DeviceAuthorizationDenied:
+		return errors.WithStack(fosite.ErrAccessDenied.WithHint("The end-user denied the device authorization request."))
+	case DeviceAuthorizationUsed:
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The 'device_code' has already been used."))
+	}
+
+	session, ok := request.GetSession().(*Session)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("Session is not an oauth2.Session."))
+	}
+
+	// The token is issued to the device's Client (so has its `android_id`), on behalf of the end-user
+	if err := session.WithClient(ctx, request.GetClient(), nil); err != nil {
+		return err
+	}
+	// The account's Entitlements are looked up by `Handler.Token`
+	if err := session.WithEndUser(ctx, authorization.Subject, authorization.AccountID, nil); err != nil {
+		return err
+	}
+	// The end-user authenticated when approving the request, rather than when the device polled
+	session.DefaultSession.Claims.AuthTime = authorization.ApprovedAt
+
+	request.SetRequestedScopes(authorization.RequestedScope)
+	request.SetRequestedAudience(authorization.RequestedAudience)
+	for _, scope := range authorization.GrantedScope {
+		request.GrantScope(scope)
+	}
+	for _, audience := range authorization.GrantedAudience {
+		request.GrantAudience(audience)
+	}
+
+	session.SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(h.AccessTokenLifespan).Round(time.Second))
+	if h.canIssueRefreshToken(request) {
+		session.SetExpiresAt(fosite.RefreshToken, time.Now().UTC().Add(h.RefreshTokenLifespan).Round(time.Second))
+	}
+
+	return nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8628#section-3.5
+func (h *DeviceCodeGrantHandler) poll(ctx context.Context, authorization *DeviceAuthorization) error {
+	interval := authorization.Interval
+	tooSoon := time.Since(authorization.LastPolledAt) < time.Duration(interval)*time.Second
+	if tooSoon {
+		interval += slowDownIncrement
+	}
+
+	if err := h.Store.devices.Poll(ctx, authorization.DeviceCodeSignature, interval); err != nil && !errors.Is(err, ErrRequestInactive) {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if tooSoon {
+		return errors.WithStack(ErrSlowDown)
+	}
+	return errors.WithStack(ErrAuthorizationPending)
+}
+
+func (h *DeviceCodeGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !h.CanHandleTokenEndpointRequest(requester) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	signature := DeviceCodeSignature(requester.GetRequestForm().Get("device_code"))
+	if err := h.Store.devices.Use(ctx, signature); err != nil {
+		if errors.Is(err, ErrRequestInactive) {
+			return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The 'device_code' has already been used."))
+		}
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	accessToken, accessSignature, err := h.AccessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if err := h.Store.CreateAccessTokenSession(ctx, accessSignature, requester.Sanitize([]string{})); err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if h.canIssueRefreshToken(requester) {
+		refreshToken, refreshSignature, err := h.RefreshTokenStrategy.GenerateRefreshToken(ctx, requester)
+		if err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+
+		if err := h.Store.CreateRefreshTokenSession(ctx, refreshSignature, requester.Sanitize([]string{})); err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+
+		responder.SetExtra("refresh_token", refreshToken)
+	}
+
+	responder.SetAccessToken(accessToken)
+	responder.SetTokenType("bearer")
+	responder.SetExpiresIn(time.Until(requester.GetSession().GetExpiresAt(fosite.AccessToken)).Round(time.Second))
+	responder.SetScopes(requester.GetGrantedScopes())
+
+	return nil
+}
+
+// Same conditions as the `authorization_code` grant
+func (h *DeviceCodeGrantHandler) canIssueRefreshToken(request fosite.Requester) bool {
+	if len(h.RefreshTokenScopes) > 0 && !request.GetGrantedScopes().HasOneOf(h.RefreshTokenScopes...) {
+		return false
+	}
+	return request.GetClient().GetGrantTypes().Has(client.RefreshToken)
+}
+
+func (h *DeviceCodeGrantHandler) CanSkipClientAuth(requester fosite.AccessRequester) bool {
+	return false
+}
+
+func (h *DeviceCodeGrantHandler) CanHandleTokenEndpointRequest(requester fosite.AccessRequester) bool {
+	return requester.GetGrantTypes().ExactOne(client.DeviceCode)
+}
@@ -0,0 +1,267 @@
+package oauth2
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// The request header containing a DPoP proof, see https://datatracker.ietf.org/doc/html/rfc9449#section-4.1
+	DPoPHeader = "DPoP"
+	// The `token_type` (and authorization scheme) of a DPoP-bound access token
+	DPoPTokenType = "DPoP"
+
+	dpopProofType = "dpop+jwt"
+	// How far a proof's `iat` may be from now, allowing for clock skew on devices
+	dpopProofLeeway = time.Minute * 5
+	// DPoP proofs which have already been used, keyed by their JWK thumbprint and `jti`
+	dpopProofNamespace = "DPoPProof"
+)
+
+// The `alg` values accepted for DPoP proofs (and advertised in the server's metadata), which are the
+// asymmetric algorithms accepted for `private_key_jwt`
+var DPoPSigningAlgs = client.TokenEndpointAuthSigningAlgs()
+
+var ErrInvalidDPoPProof = &fosite.RFC6749Error{
+	ErrorField:       "invalid_dpop_proof",
+	DescriptionField: "The DPoP proof is invalid.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// Remembers DPoP proofs which have already been used, so that each is only accepted once
+//
+// A `JTIStore` is one, though resource servers without access to its table can use their own
+type DPoPReplayCache interface {
+	// Returns `ErrJTIExists` if `jti` has already been added, and hasn't yet expired
+	Add(ctx context.Context, jti string, exp time.Time) error
+}
+
+// Validates DPoP proofs, which prove possession of the key an access token is (or will be) bound to
+//
+// Resource servers should use `VerifyDPoPRequest` instead
+type DPoPValidator struct {
+	// Proofs may only be used once
+	proofs DPoPReplayCache
+}
+
+func NewDPoPValidator(db *dynamodb.Client) *DPoPValidator {
+	return &DPoPValidator{proofs: NewJTIStore(db, dpopProofNamespace)}
+}
+
+type dpopClaims struct {
+	JTI string `json:"jti"`
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	IAT int64  `json:"iat"`
+	ATH string `json:"ath"`
+}
+
+// Validates a proof for a `method` request to `htu` (the public URL of the request, which may be
+// behind a proxy), and returns the JWK SHA-256 thumbprint (`jkt`) of its key
+//
+// If `accessToken` isn't empty, the proof must include its hash as the `ath` claim.
+// See https://datatracker.ietf.org/doc/html/rfc9449#section-4.3
+func (v *DPoPValidator) Validate(ctx context.Context, proof string, method string, htu string, accessToken string) (string, error) {
+	return validateDPoPProof(ctx, v.proofs, proof, method, htu, accessToken)
+}
+
+// For resource servers: checks that a request proves possession of the key its access token is bound
+// to, where `jkt` is the token's `cnf.jkt` claim (e.g. from introspection), or empty if it isn't bound
+//
+// `htu` is the public URL of the request, which may be behind a proxy. Tokens which aren't DPoP-bound
+// are accepted, as long as they aren't presented as if they were. See https://datatracker.ietf.org/doc/html/rfc9449#section-7
+func VerifyDPoPRequest(ctx context.Context, r *http.Request, htu string, accessToken string, jkt string, replay DPoPReplayCache) error {
+	scheme := strings.SplitN(r.Header.Get("Authorization"), " ", 2)[0]
+
+	if jkt == "" {
+		if strings.EqualFold(scheme, DPoPTokenType) {
+			return errors.WithStack(ErrInvalidDPoPProof.WithHint("The access token is not DPoP-bound."))
+		}
+		return nil
+	}
+
+	// Otherwise the proof could be stripped, and the token used as a bearer token
+	if !strings.EqualFold(scheme, DPoPTokenType) {
+		return errors.WithStack(ErrInvalidDPoPProof.WithHint("The access token is DPoP-bound, so must use the 'DPoP' authorization scheme."))
+	}
+
+	proof, err := dpopProofFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if proof == "" {
+		return errors.WithStack(ErrInvalidDPoPProof.WithHint("The access token is DPoP-bound, so a DPoP proof is required."))
+	}
+	// Otherwise the proof's `ath` isn't checked
+	if accessToken == "" {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("The access token is required to verify its DPoP proof."))
+	}
+
+	proofJKT, err := validateDPoPProof(ctx, replay, proof, r.Method, htu, accessToken)
+	if err != nil {
+		return err
+	}
+	if proofJKT != jkt {
+		return errors.WithStack(ErrInvalidDPoPProof.WithHint("The DPoP proof is not signed by the key the access token is bound to."))
+	}
+
+	return nil
+}
+
+func validateDPoPProof(ctx context.Context, replay DPoPReplayCache, proof string, method string, htu string, accessToken string) (string, error) {
+	jkt, claims, err := parseDPoPProof(proof, method, htu, accessToken, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	exp := time.Unix(claims.IAT, 0).Add(dpopProofLeeway)
+	if err := replay.Add(ctx, fmt.Sprintf("%s#%s", jkt, claims.JTI), exp); err != nil {
+		if errors.Is(err, ErrJTIExists) {
+			return "", errors.WithStack(ErrInvalidDPoPProof.WithHint("The DPoP proof has already been used."))
+		}
+		return "", errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	return jkt, nil
+}
+
+func parseDPoPProof(proof string, method string, htu string, accessToken string, now time.Time) (string, *dpopClaims, error) {
+	jws, err := jose.ParseSigned(proof)
+	if err != nil {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("Unable to parse the DPoP proof.").WithWrap(err).WithDebug(err.Error()))
+	}
+	if len(jws.Signatures) != 1 {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The DPoP proof must have exactly one signature."))
+	}
+
+	header := jws.Signatures[0].Header
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHintf("The 'typ' header of the DPoP proof must be '%s'.", dpopProofType))
+	}
+	if !fosite.Arguments(DPoPSigningAlgs).Has(header.Algorithm) {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHintf("The 'alg' header of the DPoP proof '%s' is not supported.", header.Algorithm))
+	}
+	if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The 'jwk' header of the DPoP proof must be a public key."))
+	}
+
+	payload, err := jws.Verify(header.JSONWebKey)
+	if err != nil {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The signature of the DPoP proof is invalid.").WithWrap(err).WithDebug(err.Error()))
+	}
+
+	var claims dpopClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("Unable to decode the claims of the DPoP proof.").WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if claims.JTI == "" {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The 'jti' claim of the DPoP proof is required."))
+	}
+	if claims.HTM != method {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHintf("The 'htm' claim of the DPoP proof must be '%s'.", method))
+	}
+	if !equalHTU(claims.HTU, htu) {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHintf("The 'htu' claim of the DPoP proof must be '%s'.", htu))
+	}
+	if iat := time.Unix(claims.IAT, 0); iat.Before(now.Add(-dpopProofLeeway)) || iat.After(now.Add(dpopProofLeeway)) {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The 'iat' claim of the DPoP proof is too far from the current time."))
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithHint("The 'ath' claim of the DPoP proof does not match the access token."))
+		}
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(gocrypto.SHA256)
+	if err != nil {
+		return "", nil, errors.WithStack(ErrInvalidDPoPProof.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), &claims, nil
+}
+
+// Bind the token to the key of the request's DPoP proof, if any, see https://datatracker.ietf.org/doc/html/rfc9449#section-5
+//
+// The refresh tokens of public Clients are bound to the key they were first issued with, so refreshing
+// requires a proof from the same key. Confidential Clients may refresh with a new key, or none.
+// Likewise, a DPoP-bound `subject_token` can only be exchanged with a proof from its key.
+func (h *Handler) bindDPoP(ctx context.Context, req *http.Request, accessRequest fosite.AccessRequester) error {
+	session, ok := accessRequest.GetSession().(*Session)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("Session is not an oauth2.Session."))
+	}
+
+	proof, err := dpopProofFromRequest(req)
+	if err != nil {
+		return err
+	}
+
+	bound, token := "", ""
+	switch {
+	case accessRequest.GetGrantTypes().ExactOne(client.RefreshToken) && accessRequest.GetClient().IsPublic():
+		bound, token = session.DPoPJKT, "refresh token"
+	case accessRequest.GetGrantTypes().ExactOne(client.TokenExchange):
+		// The session has the claims of the subject token, see `TokenExchangeGrantHandler`
+		bound, token = session.DPoPJKT, "'subject_token'"
+	}
+
+	if proof == "" {
+		if bound != "" {
+			return errors.WithStack(ErrInvalidDPoPProof.WithHintf("The %s is DPoP-bound, so a DPoP proof is required.", token))
+		}
+		session.DPoPJKT = ""
+		return nil
+	}
+
+	jkt, err := h.dpop.Validate(ctx, proof, req.Method, TokenURL, "")
+	if err != nil {
+		return err
+	}
+	if bound != "" && jkt != bound {
+		return errors.WithStack(ErrInvalidDPoPProof.WithHintf("The DPoP proof is not signed by the key the %s is bound to.", token))
+	}
+
+	session.DPoPJKT = jkt
+	return nil
+}
+
+// Returns an empty string if there is no proof, or an error if there's more than one
+func dpopProofFromRequest(r *http.Request) (string, error) {
+	proofs := r.Header.Values(DPoPHeader)
+	if len(proofs) > 1 {
+		return "", errors.WithStack(ErrInvalidDPoPProof.WithHint("Only one DPoP proof may be sent."))
+	}
+	if len(proofs) == 0 {
+		return "", nil
+	}
+	return proofs[0], nil
+}
+
+// `htu` excludes the query and fragment, and the scheme and host are case insensitive
+func equalHTU(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host) && ua.Path == ub.Path
+}
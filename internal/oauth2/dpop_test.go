@@ -0,0 +1,204 @@
+package oauth2
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testHTU = "https://auth.kidsloop.live/oauth2/token"
+
+type testDPoPClaims struct {
+	jwt.Claims
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	ATH string `json:"ath,omitempty"`
+}
+
+func TestParseDPoPProof(t *testing.T) {
+	a := assert.New(t)
+	key := generateDPoPKey(a)
+
+	proof := signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, testHTU, time.Now()))
+
+	jkt, claims, err := parseDPoPProof(proof, http.MethodPost, testHTU, "", time.Now())
+	a.NoError(err)
+	a.NotEmpty(claims.JTI)
+
+	public := key.Public()
+	thumbprint, err := public.Thumbprint(gocrypto.SHA256)
+	a.NoError(err)
+	a.Equal(base64.RawURLEncoding.EncodeToString(thumbprint), jkt)
+}
+
+func TestParseDPoPProofIgnoresQuery(t *testing.T) {
+	a := assert.New(t)
+	key := generateDPoPKey(a)
+
+	proof := signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, "HTTPS://auth.kidsloop.live/oauth2/token", time.Now()))
+
+	_, _, err := parseDPoPProof(proof, http.MethodPost, testHTU+"?foo=bar", "", time.Now())
+	a.NoError(err)
+}
+
+func TestParseDPoPProofInvalid(t *testing.T) {
+	a := assert.New(t)
+	key := generateDPoPKey(a)
+	now := time.Now()
+
+	token := "access-token"
+	sum := sha256.Sum256([]byte(token))
+	withATH := testDPoPClaimsFor(http.MethodPost, testHTU, now)
+	withATH.ATH = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		proof       string
+		accessToken string
+	}{
+		"wrong typ":   {signDPoPProof(a, key, "JWT", testDPoPClaimsFor(http.MethodPost, testHTU, now)), ""},
+		"wrong htm":   {signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodGet, testHTU, now)), ""},
+		"wrong htu":   {signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, "https://example.com/oauth2/token", now)), ""},
+		"stale iat":   {signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, testHTU, now.Add(-time.Hour))), ""},
+		"future iat":  {signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, testHTU, now.Add(time.Hour))), ""},
+		"missing ath": {signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, testHTU, now)), token},
+		"wrong ath":   {signDPoPProof(a, key, "dpop+jwt", withATH), "another-token"},
+		"not a JWT":   {"proof", ""},
+		"missing jti": {signDPoPProof(a, key, "dpop+jwt", testDPoPClaims{HTM: http.MethodPost, HTU: testHTU, Claims: jwt.Claims{IssuedAt: jwt.NewNumericDate(now)}}), ""},
+		"private jwk": {signDPoPProofWithPrivateJWK(a, key, testDPoPClaimsFor(http.MethodPost, testHTU, now)), ""},
+	}
+
+	for name, test := range tests {
+		_, _, err := parseDPoPProof(test.proof, http.MethodPost, testHTU, test.accessToken, now)
+		a.ErrorIs(err, ErrInvalidDPoPProof, name)
+	}
+}
+
+func TestParseDPoPProofAccessTokenHash(t *testing.T) {
+	a := assert.New(t)
+	key := generateDPoPKey(a)
+
+	token := "access-token"
+	sum := sha256.Sum256([]byte(token))
+	claims := testDPoPClaimsFor(http.MethodGet, testHTU, time.Now())
+	claims.ATH = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	_, _, err := parseDPoPProof(signDPoPProof(a, key, "dpop+jwt", claims), http.MethodGet, testHTU, token, time.Now())
+	a.NoError(err)
+}
+
+func TestVerifyDPoPRequest(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	key := generateDPoPKey(a)
+	other := generateDPoPKey(a)
+	replay := memoryReplayCache{}
+
+	htu := "https://api.kidsloop.live/lessons"
+	token := "access-token"
+	sum := sha256.Sum256([]byte(token))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	public := key.Public()
+	thumbprint, err := public.Thumbprint(gocrypto.SHA256)
+	a.NoError(err)
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	newRequest := func(scheme string, signer *jose.JSONWebKey, claims testDPoPClaims) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/lessons?page=2", nil)
+		req.Header.Set("Authorization", scheme+" "+token)
+		if signer != nil {
+			req.Header.Set(DPoPHeader, signDPoPProof(a, signer, "dpop+jwt", claims))
+		}
+		return req
+	}
+	claimsFor := func(method string, iat time.Time, ath string) testDPoPClaims {
+		claims := testDPoPClaimsFor(method, htu, iat)
+		claims.ATH = ath
+		return claims
+	}
+
+	req := newRequest("DPoP", key, claimsFor(http.MethodGet, time.Now(), ath))
+	a.NoError(VerifyDPoPRequest(ctx, req, htu, token, jkt, replay))
+	a.ErrorIs(VerifyDPoPRequest(ctx, req, htu, token, jkt, replay), ErrInvalidDPoPProof, "Replayed proof")
+
+	a.NoError(VerifyDPoPRequest(ctx, newRequest("Bearer", nil, testDPoPClaims{}), htu, token, "", replay), "Bearer token")
+
+	tests := map[string]struct {
+		req *http.Request
+		jkt string
+	}{
+		"bearer scheme":  {newRequest("Bearer", key, claimsFor(http.MethodGet, time.Now(), ath)), jkt},
+		"missing proof":  {newRequest("DPoP", nil, testDPoPClaims{}), jkt},
+		"other key":      {newRequest("DPoP", other, claimsFor(http.MethodGet, time.Now(), ath)), jkt},
+		"wrong htm":      {newRequest("DPoP", key, claimsFor(http.MethodPost, time.Now(), ath)), jkt},
+		"missing ath":    {newRequest("DPoP", key, claimsFor(http.MethodGet, time.Now(), "")), jkt},
+		"stale iat":      {newRequest("DPoP", key, claimsFor(http.MethodGet, time.Now().Add(-time.Hour), ath)), jkt},
+		"not DPoP-bound": {newRequest("DPoP", key, claimsFor(http.MethodGet, time.Now(), ath)), ""},
+	}
+	for name, test := range tests {
+		a.ErrorIs(VerifyDPoPRequest(ctx, test.req, htu, token, test.jkt, replay), ErrInvalidDPoPProof, name)
+	}
+}
+
+// Only for tests, as it is neither safe for concurrent use nor ever expires
+type memoryReplayCache map[string]bool
+
+func (c memoryReplayCache) Add(ctx context.Context, jti string, exp time.Time) error {
+	if c[jti] {
+		return ErrJTIExists
+	}
+	c[jti] = true
+	return nil
+}
+
+func generateDPoPKey(a *assert.Assertions) *jose.JSONWebKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	return &jose.JSONWebKey{Key: privateKey, Algorithm: string(jose.ES256)}
+}
+
+func testDPoPClaimsFor(method string, htu string, iat time.Time) testDPoPClaims {
+	return testDPoPClaims{
+		Claims: jwt.Claims{ID: uuid.NewString(), IssuedAt: jwt.NewNumericDate(iat)},
+		HTM:    method,
+		HTU:    htu,
+	}
+}
+
+func signDPoPProof(a *assert.Assertions, key *jose.JSONWebKey, typ string, claims testDPoPClaims) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key.Key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ)),
+	)
+	a.NoError(err)
+
+	proof, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	a.NoError(err)
+	return proof
+}
+
+// The proof is otherwise valid, but leaks the private key
+func signDPoPProofWithPrivateJWK(a *assert.Assertions, key *jose.JSONWebKey, claims testDPoPClaims) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key.Key},
+		(&jose.SignerOptions{}).WithType("dpop+jwt").WithHeader("jwk", key),
+	)
+	a.NoError(err)
+
+	proof, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	a.NoError(err)
+	return proof
+}
@@ -0,0 +1,102 @@
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// An account's subscription, which is included in its access tokens so that downstream services
+// don't each need to call the subscriptions service
+type Entitlements struct {
+	SubscriptionID string   `dynamodbav:"subscription_id"`
+	Entitlements   []string `dynamodbav:"entitlements"`
+}
+
+// Looks up the Entitlements of an account, see `Session.WithClient`
+type EntitlementProvider interface {
+	// Returns nil if the account has no subscription
+	GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error)
+}
+
+// What happens to a token request if its Entitlements can't be looked up
+type EntitlementFailurePolicy string
+
+const (
+	// The request fails with `temporarily_unavailable`, so tokens always have any entitlement claims
+	EntitlementFailClosed EntitlementFailurePolicy = "fail-closed"
+	// The token is issued without entitlement claims, as if the account had no subscription
+	EntitlementOmitClaims EntitlementFailurePolicy = "omit-claims"
+)
+
+// Applies `policy` to the errors of `provider`
+func WithEntitlementFailurePolicy(provider EntitlementProvider, policy EntitlementFailurePolicy) EntitlementProvider {
+	if policy == EntitlementOmitClaims {
+		return &omitClaimsEntitlementProvider{provider}
+	}
+	return provider
+}
+
+type omitClaimsEntitlementProvider struct {
+	EntitlementProvider
+}
+
+func (p *omitClaimsEntitlementProvider) GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error) {
+	entitlements, err := p.EntitlementProvider.GetEntitlements(ctx, accountID)
+	if err != nil {
+		log.Printf("WARN: Omitting entitlements of Account(id=%s): %v", accountID, err)
+		return nil, nil
+	}
+	return entitlements, nil
+}
+
+// Entitlements written by the subscriptions service, alongside the account's Clients
+type DynamoDBEntitlementProvider struct {
+	dynamodb *dynamodb.Client
+}
+
+var _ EntitlementProvider = (*DynamoDBEntitlementProvider)(nil)
+
+func NewDynamoDBEntitlementProvider(dynamodbClient *dynamodb.Client) *DynamoDBEntitlementProvider {
+	return &DynamoDBEntitlementProvider{
+		dynamodb: dynamodbClient,
+	}
+}
+
+func (p *DynamoDBEntitlementProvider) GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error) {
+	output, err := p.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("Account#%s", accountID)},
+			"sk": &types.AttributeValueMemberS{Value: "Subscription"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem Subscription: %w", err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	var entitlements Entitlements
+	if err := attributevalue.UnmarshalMap(output.Item, &entitlements); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap Subscription: %w", err)
+	}
+
+	return &entitlements, nil
+}
+
+// Fixed Entitlements by account ID, e.g. for tests
+type StaticEntitlementProvider map[string]*Entitlements
+
+var _ EntitlementProvider = StaticEntitlementProvider(nil)
+
+func (p StaticEntitlementProvider) GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error) {
+	return p[accountID], nil
+}
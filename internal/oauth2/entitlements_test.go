@@ -0,0 +1,77 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingEntitlementProvider struct{}
+
+func (p failingEntitlementProvider) GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error) {
+	return nil, errors.New("subscriptions service unavailable")
+}
+
+// Fails while `failing`, e.g. to fail a refresh but not the original authorization
+type toggledEntitlementProvider struct {
+	failing bool
+}
+
+func (p *toggledEntitlementProvider) GetEntitlements(ctx context.Context, accountID string) (*Entitlements, error) {
+	if p.failing {
+		return failingEntitlementProvider{}.GetEntitlements(ctx, accountID)
+	}
+	return nil, nil
+}
+
+func TestSessionWithClientEntitlements(t *testing.T) {
+	a := assert.New(t)
+
+	accountID := uuid.NewString()
+	entitlements := StaticEntitlementProvider{
+		accountID: {SubscriptionID: "subscription", Entitlements: []string{"lessons", "reports"}},
+	}
+
+	session := NewSession("")
+	a.NoError(session.WithClient(context.Background(), NewFositeClient(&client.Client{AccountID: accountID}), entitlements))
+
+	claims := session.GetExtraClaims()
+	a.Equal("subscription", claims["subscription_id"])
+	a.Equal([]string{"lessons", "reports"}, claims["entitlements"])
+}
+
+func TestSessionWithClientNoSubscription(t *testing.T) {
+	a := assert.New(t)
+
+	session := NewSession("")
+	a.NoError(session.WithClient(context.Background(), NewFositeClient(&client.Client{AccountID: uuid.NewString()}), StaticEntitlementProvider{}))
+
+	claims := session.GetExtraClaims()
+	a.NotContains(claims, "subscription_id")
+	a.NotContains(claims, "entitlements")
+}
+
+func TestEntitlementFailClosed(t *testing.T) {
+	a := assert.New(t)
+
+	entitlements := WithEntitlementFailurePolicy(failingEntitlementProvider{}, EntitlementFailClosed)
+
+	session := NewSession("")
+	err := session.WithClient(context.Background(), NewFositeClient(&client.Client{AccountID: uuid.NewString()}), entitlements)
+	a.ErrorIs(err, fosite.ErrTemporarilyUnavailable)
+}
+
+func TestEntitlementOmitClaims(t *testing.T) {
+	a := assert.New(t)
+
+	entitlements := WithEntitlementFailurePolicy(failingEntitlementProvider{}, EntitlementOmitClaims)
+
+	session := NewSession("")
+	a.NoError(session.WithClient(context.Background(), NewFositeClient(&client.Client{AccountID: uuid.NewString()}), entitlements))
+	a.NotContains(session.GetExtraClaims(), "subscription_id")
+}
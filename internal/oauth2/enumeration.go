@@ -0,0 +1,58 @@
+package oauth2
+
+import (
+	"context"
+	"log"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+type secretComparisonsContextKey struct{}
+
+// Counts the secrets `Hasher.Compare` compares, for `compareDummySecret`
+func withSecretComparisons(ctx context.Context) (context.Context, *int) {
+	compared := new(int)
+	return context.WithValue(ctx, secretComparisonsContextKey{}, compared), compared
+}
+
+func recordSecretComparison(ctx context.Context) {
+	if compared, ok := ctx.Value(secretComparisonsContextKey{}).(*int); ok {
+		*compared++
+	}
+}
+
+// Compares a presented secret with a dummy hash if fosite failed before comparing any, e.g. as the Client
+// doesn't exist, so response times don't reveal which do. Skipped if hashing is saturated.
+func compareDummySecret(ctx context.Context, secret string, compared int) {
+	if secret == "" || compared > 0 || hashingFailed(ctx) {
+		return
+	}
+	if err := crypto.CompareDummySecret(ctx, secret); err != nil {
+		if errors.Is(err, crypto.ErrHashingUnavailable) {
+			recordHashingError(ctx, err)
+		} else {
+			log.Printf("Error occurred in crypto.CompareDummySecret: %+v", err)
+		}
+	}
+}
+
+// Every failure has the error of an unknown Client, as fosite's hints would reveal which exist
+func normaliseClientError(err error) error {
+	if !errors.Is(err, fosite.ErrInvalidClient) {
+		return err
+	}
+	return errors.WithStack(fosite.ErrInvalidClient.WithWrap(err).WithDebug(err.Error()))
+}
+
+// The same as fosite's error for an introspecting Client with incorrect credentials
+var errIntrospectionCredentials = fosite.ErrRequestUnauthorized.WithHint("OAuth 2.0 Client credentials are invalid.")
+
+// Every failure of an introspecting Client has the error of incorrect credentials, see `normaliseClientError`
+func normaliseIntrospectionError(err error) error {
+	if !errors.Is(err, fosite.ErrRequestUnauthorized) {
+		return err
+	}
+	return errors.WithStack(errIntrospectionCredentials.WithWrap(err).WithDebug(err.Error()))
+}
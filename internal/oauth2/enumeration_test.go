@@ -0,0 +1,82 @@
+package oauth2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/utils"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// The errors of fosite's client authentication, see `fosite.Fosite.DefaultClientAuthenticationStrategy`
+func TestNormaliseClientError(t *testing.T) {
+	a := assert.New(t)
+
+	unknown := fosite.ErrorToRFC6749Error(normaliseClientError(errors.WithStack(fosite.ErrInvalidClient.WithWrap(fosite.ErrNotFound).WithDebug(fosite.ErrNotFound.Error()))))
+	for _, err := range []error{
+		errors.WithStack(fosite.ErrInvalidClient.WithWrap(errors.New("ERROR: hash does not match"))),
+		errors.WithStack(fosite.ErrInvalidClient.WithHintf("The OAuth 2.0 Client supports client authentication method '%s', but method 'client_secret_post' was requested.", "private_key_jwt")),
+		errors.WithStack(fosite.ErrInvalidClient.WithHint("The client certificate is not trusted.")),
+	} {
+		normalised := fosite.ErrorToRFC6749Error(normaliseClientError(err))
+		a.Equal(unknown.ErrorField, normalised.ErrorField, err.Error())
+		a.Equal(unknown.GetDescription(), normalised.GetDescription(), err.Error())
+		a.Equal(unknown.CodeField, normalised.CodeField, err.Error())
+		a.ErrorIs(normaliseClientError(err), fosite.ErrInvalidClient)
+	}
+
+	a.NoError(normaliseClientError(nil))
+	a.ErrorIs(normaliseClientError(fosite.ErrInvalidRequest), fosite.ErrInvalidRequest, "Not a failed authentication")
+}
+
+// The errors of fosite's introspection, see `fosite.Fosite.NewIntrospectionRequest`
+func TestNormaliseIntrospectionError(t *testing.T) {
+	a := assert.New(t)
+
+	unknown := normaliseIntrospectionError(errors.WithStack(fosite.ErrRequestUnauthorized.WithHint("Unable to find OAuth 2.0 Client from HTTP basic authorization header.").WithWrap(fosite.ErrNotFound)))
+	a.Equal(errIntrospectionCredentials.GetDescription(), fosite.ErrorToRFC6749Error(unknown).GetDescription())
+	a.ErrorIs(unknown, fosite.ErrRequestUnauthorized)
+
+	a.ErrorIs(normaliseIntrospectionError(errors.WithStack(fosite.ErrInactiveToken.WithWrap(fosite.ErrNotFound))), fosite.ErrInactiveToken, "Unknown token")
+	a.NoError(normaliseIntrospectionError(nil))
+}
+
+func TestHasherSecretComparisons(t *testing.T) {
+	a := assert.New(t)
+	hash := utils.Must(crypto.HashSecret(context.Background(), testSecret))
+
+	ctx, compared := withSecretComparisons(context.Background())
+	hasher := &Hasher{}
+
+	a.NoError(hasher.Compare(ctx, []byte(hash), []byte(testSecret)))
+	a.Error(hasher.Compare(ctx, []byte(hash), []byte("incorrect-password")))
+	a.Equal(2, *compared)
+
+	a.Error(hasher.Compare(ctx, []byte{}, []byte(testSecret)))
+	a.Equal(2, *compared, "A Client without a secret has no hash to compare")
+
+	compareDummySecret(ctx, testSecret, 0)
+	a.Equal(2, *compared, "Dummy comparisons aren't counted")
+}
+
+func TestCompareDummySecret(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	timed := func(secret string, compared int) time.Duration {
+		start := time.Now()
+		compareDummySecret(ctx, secret, compared)
+		return time.Since(start)
+	}
+
+	// The first creates the dummy hash
+	timed(testSecret, 0)
+	dummy := timed(testSecret, 0)
+
+	a.Less(timed("", 0)*10, dummy, "No secret was presented")
+	a.Less(timed(testSecret, 1)*10, dummy, "A secret was already compared")
+}
@@ -1,28 +1,153 @@
 package oauth2
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/KL-Engineering/oauth2-server/internal/account"
+	clientpkg "github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/julienschmidt/httprouter"
 	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2"
 )
 
 type Handler struct {
-	provider fosite.OAuth2Provider
+	provider            Provider
+	devices             *DeviceStore
+	dpop                *DPoPValidator
+	metadata            *Metadata
+	clients             *clientpkg.Repository
+	initialAccessTokens *account.InitialAccessTokenRepository
+	lockout             *clientLockout
+	// Limits concurrent rehashes, see `rehashSecret`
+	rehashes chan struct{}
+	opts     HandlerOptions
 }
 
-func NewHandler(provider fosite.OAuth2Provider) *Handler {
-	return &Handler{provider: provider}
+type HandlerOptions struct {
+	// Login and consent for the `authorization_code` grant
+	Consent ConsentStrategy
+	// Login and consent for the device authorization grant
+	DeviceVerification DeviceVerificationStrategy
+	// Where the end-user enters the user code of a device, which defaults to `/oauth2/device/verify`
+	DeviceVerificationURI string
+	// The subscription claims of every token issued by this handler, or nil for none
+	Entitlements EntitlementProvider
+	// Counts failed authentications of introspecting Clients, which fosite doesn't authenticate with
+	// the provider's strategy. Should match `ProviderOptions.Lockout`. Disabled if nil.
+	Lockout *lockout.Store
+	// Should match `ProviderOptions.TrustForwardedFor`
+	TrustForwardedFor bool
+	// The keys of trusted software publishers, whose software statements may be presented at
+	// `/oauth2/register`. Software statements are rejected if nil.
+	SoftwareStatementKeys *jose.JSONWebKeySet
+	// Verified Client secrets, which are invalidated when a registered Client is deleted. Should
+	// match `ProviderOptions.SecretCache`.
+	SecretCache *secretcache.Cache
+}
+
+func NewHandler(provider Provider, db *dynamodb.Client, opts HandlerOptions) *Handler {
+	if opts.DeviceVerificationURI == "" {
+		opts.DeviceVerificationURI = ISSUER + "/oauth2/device/verify"
+	}
+	return &Handler{
+		provider: provider,
+		devices:  NewDeviceStore(db),
+		dpop:     NewDPoPValidator(db),
+		metadata: NewMetadata(provider),
+		clients:  clientpkg.NewRepository(db),
+		lockout:  newClientLockout(opts.Lockout, opts.TrustForwardedFor),
+		rehashes: make(chan struct{}, maxConcurrentRehashes),
+		opts:     opts,
+
+		initialAccessTokens: account.NewInitialAccessTokenRepository(db),
+	}
 }
 
 func (h *Handler) SetupRouter(router *httprouter.Router) {
+	router.GET("/oauth2/auth", h.Authorize)
+	router.POST("/oauth2/auth", h.Authorize)
+	router.POST("/oauth2/device/code", h.DeviceCode)
+	router.GET("/oauth2/device/verify", h.VerifyDevice)
+	router.POST("/oauth2/device/verify", h.VerifyDevice)
+	router.GET("/.well-known/oauth-authorization-server", h.Metadata)
+	router.GET("/.well-known/openid-configuration", h.Metadata)
 	router.POST("/oauth2/token", h.Token)
+	router.POST("/oauth2/introspect", h.Introspect)
+	router.POST("/oauth2/revoke", h.Revoke)
+	router.POST("/oauth2/register", h.Register)
+	router.GET("/oauth2/register/:id", h.GetRegistration)
+	router.PUT("/oauth2/register/:id", h.UpdateRegistration)
+	router.DELETE("/oauth2/register/:id", h.DeleteRegistration)
 }
 
-func (h *Handler) Token(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	ctx := req.Context()
 
+	// Validates the Client, redirect URI, response type, scopes, audiences and PKCE code challenge
+	authorizeRequest, err := h.provider.NewAuthorizeRequest(ctx, req)
+	if err != nil {
+		log.Printf("Error occurred in NewAuthorizeRequest: %+v", err)
+		h.provider.WriteAuthorizeError(rw, authorizeRequest, err)
+		return
+	}
+
+	consent, err := h.opts.Consent.HandleAuthorizeRequest(rw, req, authorizeRequest)
+	if err != nil {
+		log.Printf("Error occurred in HandleAuthorizeRequest: %+v", err)
+		h.provider.WriteAuthorizeError(rw, authorizeRequest, err)
+		return
+	}
+	if consent == nil {
+		// The end-user has been handed off to login/consent
+		return
+	}
+
+	for _, scope := range consent.GrantedScopes {
+		authorizeRequest.GrantScope(scope)
+	}
+
+	for _, audience := range consent.GrantedAudience {
+		authorizeRequest.GrantAudience(audience)
+	}
+
+	// The token is issued to the Client, but on behalf of the end-user (and their account)
+	session := NewSession(consent.Subject)
+	if err := session.WithClient(ctx, authorizeRequest.GetClient(), nil); err != nil {
+		log.Printf("Error occurred in WithClient: %+v", err)
+		h.provider.WriteAuthorizeError(rw, authorizeRequest, err)
+		return
+	}
+	// The account's Entitlements are looked up when the code is exchanged, see `Token`
+	if err := session.WithEndUser(ctx, consent.Subject, consent.AccountID, nil); err != nil {
+		log.Printf("Error occurred in WithEndUser: %+v", err)
+		h.provider.WriteAuthorizeError(rw, authorizeRequest, err)
+		return
+	}
+
+	// Stores the authorization code (and PKCE code challenge) for the token endpoint
+	response, err := h.provider.NewAuthorizeResponse(ctx, authorizeRequest, session)
+	if err != nil {
+		log.Printf("Error occurred in NewAuthorizeResponse: %+v", err)
+		h.provider.WriteAuthorizeError(rw, authorizeRequest, err)
+		return
+	}
+
+	h.provider.WriteAuthorizeResponse(rw, authorizeRequest, response)
+}
+
+func (h *Handler) Token(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx, verified := withVerifiedSecret(req.Context())
+
 	session := NewSession("")
 
 	// This will create an access request object and iterate through the registered TokenEndpointHandlers to validate the request.
@@ -34,21 +159,77 @@ func (h *Handler) Token(rw http.ResponseWriter, req *http.Request, _ httprouter.
 	// * ...
 	if err != nil {
 		log.Printf("Error occurred in NewAccessRequest: %+v", err)
+		setRetryAfter(rw, err)
+		h.provider.WriteAccessError(rw, accessRequest, err)
+		return
+	}
+
+	if err := verifySubjectTokenCertificate(req, accessRequest); err != nil {
+		log.Printf("Error occurred in verifySubjectTokenCertificate: %+v", err)
+		h.provider.WriteAccessError(rw, accessRequest, err)
+		return
+	}
+
+	// Bind the token to the certificate of a mutual TLS Client, which may differ from the
+	// certificate of the original authorization (e.g. when refreshing)
+	if s, ok := accessRequest.GetSession().(*Session); ok {
+		if thumbprint := certificateBinding(req, accessRequest.GetClient()); thumbprint != "" {
+			s.CertificateThumbprint = thumbprint
+		} else if accessRequest.GetGrantTypes().ExactOne(clientpkg.TokenExchange) {
+			// An exchanged token is only bound to the subject token's certificate if this Client authenticated with it
+			s.CertificateThumbprint = ""
+		}
+	}
+
+	// Custom claims are those of the Client when the token is issued, which may have changed since
+	// authorization (e.g. when refreshing). An exchanged token keeps those of the subject token instead,
+	// see `Session.WithClaims`
+	if s, ok := accessRequest.GetSession().(*Session); ok && !accessRequest.GetGrantTypes().ExactOne(clientpkg.TokenExchange) {
+		s.CustomClaims = accessRequest.GetClient().(CustomFositeClient).GetCustomClaims()
+	}
+
+	if err := h.bindDPoP(ctx, req, accessRequest); err != nil {
+		log.Printf("Error occurred in bindDPoP: %+v", err)
 		h.provider.WriteAccessError(rw, accessRequest, err)
 		return
 	}
 
-	// If this is a client_credentials grant, grant all requested scopes
+	// If this is a client_credentials grant, grant all requested scopes and audiences
 	// NewAccessRequest validated that all requested scopes the client is allowed to perform
-	// based on configured scope matching strategy.
+	// based on configured scope matching strategy, and likewise for the audience matching strategy.
 	if accessRequest.GetGrantTypes().ExactOne("client_credentials") {
 		for _, scope := range accessRequest.GetRequestedScopes() {
 			accessRequest.GrantScope(scope)
 		}
 
+		for _, audience := range accessRequest.GetRequestedAudience() {
+			accessRequest.GrantAudience(audience)
+		}
+
 		client := accessRequest.GetClient()
 
-		session.WithClient(client)
+		if err := session.WithClient(ctx, client, nil); err != nil {
+			log.Printf("Error occurred in WithClient: %+v", err)
+			h.provider.WriteAccessError(rw, accessRequest, err)
+			return
+		}
+	}
+
+	// Entitlements are looked up for every token (applying the failure policy of `HandlerOptions.Entitlements`),
+	// as the account's subscription may have changed since the session was stored, e.g. when refreshing
+	if s, ok := accessRequest.GetSession().(*Session); ok {
+		if err := s.withEntitlements(ctx, h.opts.Entitlements); err != nil {
+			log.Printf("Error occurred in withEntitlements: %+v", err)
+			h.provider.WriteAccessError(rw, accessRequest, err)
+			return
+		}
+	}
+
+	// Resource indicators are checked against what was granted, so this must follow the grants above
+	if err := applyResourceIndicators(accessRequest); err != nil {
+		log.Printf("Error occurred in applyResourceIndicators: %+v", err)
+		h.provider.WriteAccessError(rw, accessRequest, err)
+		return
 	}
 
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
@@ -60,6 +241,272 @@ func (h *Handler) Token(rw http.ResponseWriter, req *http.Request, _ httprouter.
 		return
 	}
 
+	if s, ok := accessRequest.GetSession().(*Session); ok && s.DPoPJKT != "" {
+		response.SetTokenType(DPoPTokenType)
+	}
+
 	// All done, send the response.
 	h.provider.WriteAccessResponse(rw, accessRequest, response)
+
+	// The secret is known now the Client has authenticated, so its hash can be upgraded
+	h.rehashSecret(accessRequest.GetClient(), verified)
+}
+
+func (h *Handler) Introspect(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := req.Context()
+
+	session := NewSession("")
+
+	// fosite compares the secrets of introspecting Clients itself, rather than with `AuthenticateClient`,
+	// so they're locked out here
+	keys := h.lockout.keys(req)
+	if err := h.lockout.check(ctx, keys); err != nil {
+		log.Printf("Error occurred in clientLockout.check: %+v", err)
+		writeError(rw, err)
+		return
+	}
+
+	ctx, hashingError := withHashingErrors(ctx)
+	ctx, compared := withSecretComparisons(ctx)
+
+	// Authenticates the calling Client (HTTP Basic or Bearer token) before introspecting the token
+	response, err := h.provider.NewIntrospectionRequest(ctx, req, session)
+	// Only a Client authenticating with HTTP Basic compares a secret
+	if _, secret, ok := req.BasicAuth(); ok && fosite.AccessTokenFromRequest(req) == "" {
+		if errors.Is(err, fosite.ErrRequestUnauthorized) {
+			compareDummySecret(ctx, secret, *compared)
+		}
+		err = normaliseIntrospectionError(err)
+	}
+	err = hashingError(err)
+	if errors.Is(err, fosite.ErrRequestUnauthorized) {
+		h.lockout.recordFailure(ctx, keys)
+	} else if err == nil || errors.Is(err, fosite.ErrInactiveToken) {
+		h.lockout.reset(ctx, keys)
+	}
+	if err != nil {
+		log.Printf("Error occurred in NewIntrospectionRequest: %+v", err)
+		// Otherwise reported as an inactive token
+		if errors.Is(err, fosite.ErrTemporarilyUnavailable) {
+			writeError(rw, err)
+			return
+		}
+		h.provider.WriteIntrospectionError(rw, err)
+		return
+	}
+
+	h.provider.WriteIntrospectionResponse(rw, response)
+}
+
+func (h *Handler) Revoke(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := req.Context()
+
+	// Authenticates the calling Client, and checks the token was issued to it
+	err := h.provider.NewRevocationRequest(ctx, req)
+	if err != nil {
+		log.Printf("Error occurred in NewRevocationRequest: %+v", err)
+		// Otherwise reported as revoked (see https://datatracker.ietf.org/doc/html/rfc7009#section-2.2.1),
+		// or as a plain `invalid_client` without when to retry
+		var lockedOut *lockedOutError
+		if errors.Is(err, fosite.ErrTemporarilyUnavailable) || errors.As(err, &lockedOut) {
+			writeError(rw, err)
+			return
+		}
+	}
+
+	h.provider.WriteRevocationResponse(rw, err)
+}
+
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Device authorization endpoint, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.1
+func (h *Handler) DeviceCode(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := req.Context()
+
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, fosite.ErrInvalidRequest.WithWrap(err).WithHint("Unable to parse HTTP body, make sure to send a properly formatted form request body."))
+		return
+	}
+
+	// Devices are typically public Clients, which only identify themselves with `client_id`
+	client, err := h.provider.AuthenticateClient(ctx, req, req.PostForm)
+	if err != nil {
+		log.Printf("Error occurred in AuthenticateClient: %+v", err)
+		writeError(rw, err)
+		return
+	}
+
+	if !client.GetGrantTypes().Has(clientpkg.DeviceCode) {
+		writeError(rw, fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant '%s'.", clientpkg.DeviceCode))
+		return
+	}
+
+	scopes := fosite.RemoveEmpty(strings.Split(req.PostForm.Get("scope"), " "))
+	for _, scope := range scopes {
+		if !config.GetScopeStrategy()(client.GetScopes(), scope) {
+			writeError(rw, fosite.ErrInvalidScope.WithHintf("The OAuth 2.0 Client is not allowed to request scope '%s'.", scope))
+			return
+		}
+	}
+
+	audience := fosite.GetAudiences(req.PostForm)
+	if err := config.GetAudienceStrategy()(client.GetAudience(), audience); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	authorization, deviceCode, err := h.devices.Create(ctx, client.GetID(), scopes, audience)
+	if err != nil {
+		log.Printf("Error occurred in DeviceStore.Create: %+v", err)
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+
+	userCode := FormatUserCode(authorization.UserCode)
+
+	verificationURIComplete, err := url.Parse(h.opts.DeviceVerificationURI)
+	if err != nil {
+		log.Printf("Error occurred in url.Parse: %+v", err)
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+	query := verificationURIComplete.Query()
+	query.Set("user_code", userCode)
+	verificationURIComplete.RawQuery = query.Encode()
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	core.JSONResponse(rw, DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         h.opts.DeviceVerificationURI,
+		VerificationURIComplete: verificationURIComplete.String(),
+		ExpiresIn:               int64(time.Until(authorization.ExpiresAt).Seconds()),
+		Interval:                authorization.Interval,
+	})
+}
+
+// Where the (logged in) end-user approves a device, by its user code
+//
+// A GET only shows the request, which is approved (or denied) by a POST, see `DeviceVerificationStrategy`
+func (h *Handler) VerifyDevice(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := req.Context()
+
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, fosite.ErrInvalidRequest.WithWrap(err).WithHint("Unable to parse HTTP body, make sure to send a properly formatted form request body."))
+		return
+	}
+
+	// Only end-users may find out whether a user code is valid, see https://datatracker.ietf.org/doc/html/rfc8628#section-5.1
+	user, err := h.opts.DeviceVerification.AuthenticateDeviceRequest(rw, req)
+	if err != nil {
+		log.Printf("Error occurred in AuthenticateDeviceRequest: %+v", err)
+		writeError(rw, err)
+		return
+	}
+	if user == nil {
+		// The end-user has been handed off to login
+		return
+	}
+
+	userCode := req.Form.Get("user_code")
+	if userCode == "" && req.Method == http.MethodGet {
+		if _, err := h.opts.DeviceVerification.HandleDeviceRequest(rw, req, user, nil, nil); err != nil {
+			log.Printf("Error occurred in HandleDeviceRequest: %+v", err)
+			writeError(rw, err)
+		}
+		return
+	}
+
+	keys := h.lockout.userCodeKeys(req)
+	if err := h.lockout.checkUserCode(ctx, keys); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	authorization, err := h.devices.GetByUserCode(ctx, userCode)
+	if err != nil {
+		if errors.Is(err, fosite.ErrNotFound) {
+			h.lockout.recordFailure(ctx, keys)
+			writeError(rw, fosite.ErrInvalidRequest.WithHint("The 'user_code' is invalid or has expired."))
+		} else {
+			log.Printf("Error occurred in DeviceStore.GetByUserCode: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+		}
+		return
+	}
+
+	if authorization.Status != DeviceAuthorizationPending {
+		writeError(rw, fosite.ErrInvalidRequest.WithHint("The 'user_code' has already been used."))
+		return
+	}
+
+	client, err := h.clients.GetByID(ctx, authorization.ClientID)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			// The Client has since been deleted
+			writeError(rw, fosite.ErrInvalidRequest.WithHint("The 'user_code' is invalid or has expired."))
+		} else {
+			log.Printf("Error occurred in Repository.GetByID: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+		}
+		return
+	}
+
+	consent, err := h.opts.DeviceVerification.HandleDeviceRequest(rw, req, user, authorization, NewFositeClient(client))
+	if err != nil {
+		log.Printf("Error occurred in HandleDeviceRequest: %+v", err)
+		if errors.Is(err, fosite.ErrAccessDenied) {
+			if err := h.devices.Deny(ctx, authorization.DeviceCodeSignature); err != nil {
+				log.Printf("Error occurred in DeviceStore.Deny: %+v", err)
+			}
+		}
+		writeError(rw, err)
+		return
+	}
+	if consent == nil {
+		// The end-user has been handed off to login/consent
+		return
+	}
+
+	if err := h.devices.Approve(ctx, authorization.DeviceCodeSignature, consent); err != nil {
+		if errors.Is(err, ErrRequestInactive) {
+			writeError(rw, fosite.ErrInvalidRequest.WithHint("The 'user_code' has already been used."))
+		} else {
+			log.Printf("Error occurred in DeviceStore.Approve: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+		}
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Authorization server metadata, see https://datatracker.ietf.org/doc/html/rfc8414#section-3
+func (h *Handler) Metadata(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	core.JSONResponse(rw, h.metadata)
+}
+
+// How long Clients should wait to retry when secret hashing is saturated
+const hashingRetryAfter = time.Second
+
+// Writes an OAuth2 error response, for endpoints which fosite doesn't implement
+func writeError(rw http.ResponseWriter, err error) {
+	rfcerr := fosite.ErrorToRFC6749Error(err)
+
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	setRetryAfter(rw, err)
+	rw.WriteHeader(rfcerr.CodeField)
+	if err := json.NewEncoder(rw).Encode(rfcerr); err != nil {
+		log.Printf("Error occurred in writeError: %+v", err)
+	}
 }
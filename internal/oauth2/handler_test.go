@@ -2,31 +2,66 @@ package oauth2
 
 import (
 	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"html"
+	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/KL-Engineering/oauth2-server/internal/account"
 	"github.com/KL-Engineering/oauth2-server/internal/client"
 	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/KL-Engineering/oauth2-server/internal/storage"
 	"github.com/KL-Engineering/oauth2-server/internal/test"
 	"github.com/KL-Engineering/oauth2-server/internal/utils"
+	"github.com/alexedwards/argon2id"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
+	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 const (
 	testSecret = "pa$$word"
+	// At least 8 characters, as required by fosite
+	testState = "state-0123456789"
 )
 
+// Signs the platform sessions of end-users, see `sessionCookie`
+var testLoginKey = func() *jose.JSONWebKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &jose.JSONWebKey{Key: privateKey, KeyID: "login", Algorithm: "ES256", Use: "sig"}
+}()
+
 type Setup struct {
 	db *dynamodb.Client
 	r  *httprouter.Router
@@ -50,26 +85,1828 @@ func TestROPCInvalid(t *testing.T) {
 	a.Error(err)
 }
 
-func TestAuthorizationCodeInvalid(t *testing.T) {
+func TestAuthorizationCodeInvalid(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	s.r.GET("/callback", createCallbackHandler(a))
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+
+	config := newOAuth2Config(client.ID, srv.URL)
+
+	// The Client has no registered redirect URIs
+	url := config.AuthCodeURL("state")
+	response, err := http.Get(url)
+	a.Nil(err)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+}
+
+func TestAuthorizationCodePKCE(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	accountID := uuid.NewString()
+	verifier := generateCodeVerifier(a)
+
+	code := authorizeCode(a, authorize(a, config, accountID, verifier))
+
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal(accountID, claims["sub"])
+	a.Equal(accountID, claims["account_id"], "The end-user's account, not the Client's")
+	a.Equal(config.ClientID, claims["client_id"])
+
+	// Authorization codes can only be used once
+	_, err = config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.Error(err)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc9068#section-2
+func TestAccessTokenProfile(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	token := fetchRefreshableToken(a, config)
+
+	assertTokenHeaderValid(t, token.AccessToken)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal(ISSUER, claims["iss"])
+	a.Equal([]interface{}{ISSUER}, claims["aud"])
+	a.Equal(config.ClientID, claims["client_id"])
+	a.Equal("offline_access", claims["scope"])
+	a.True(utils.IsUUID(claims["jti"].(string)))
+	a.WithinDuration(time.Now(), test.ParseUnix(claims["auth_time"].(float64)), time.Second*5)
+
+	// The end-user hasn't authenticated again, and every token has its own `jti`
+	refreshed := decodeToken(a, refresh(a, config, token.RefreshToken))
+	refreshedClaims, err := crypto.DecodeJWTPayload(refreshed.AccessToken)
+	a.NoError(err)
+	a.Equal(claims["auth_time"], refreshedClaims["auth_time"])
+	a.NotEqual(claims["jti"], refreshedClaims["jti"])
+}
+
+func TestAuthorizationCodeIncorrectCodeVerifier(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+
+	code := authorizeCode(a, authorize(a, config, uuid.NewString(), generateCodeVerifier(a)))
+
+	_, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", generateCodeVerifier(a)))
+	a.Error(err)
+}
+
+func TestAuthorizationCodeWithoutPKCE(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+
+	response := authorize(a, config, uuid.NewString(), "")
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("invalid_request", location.Query().Get("error"))
+}
+
+func TestAuthorizationCodeLoginRequired(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+
+	response := authorize(a, config, "", generateCodeVerifier(a))
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("login_required", location.Query().Get("error"))
+}
+
+func TestAuthorizationCodeUntrustedHeader(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	challenge := sha256.Sum256([]byte(generateCodeVerifier(a)))
+
+	// Set by the microgateway on its own routes, but anyone can set it on this one
+	req, err := http.NewRequest(http.MethodGet, config.AuthCodeURL(
+		testState,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil)
+	a.NoError(err)
+	req.Header.Set(account.IDHeader, uuid.NewString())
+
+	response, err := noRedirectClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("login_required", location.Query().Get("error"))
+}
+
+func TestAuthorizationCodeConsentScopes(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access", "lessons.read")
+	accountID := uuid.NewString()
+	verifier := generateCodeVerifier(a)
+
+	page := requestAuthorization(a, config, accountID, verifier)
+	code := authorizeCode(a, submitConsent(a, page, accountID, url.Values{"consent": {"approve"}, "granted_scope": {"lessons.read"}}))
+
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+	a.Empty(token.RefreshToken, "offline_access wasn't approved")
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal("lessons.read", claims["scope"])
+}
+
+func TestAuthorizationCodeConsentDenied(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	accountID := uuid.NewString()
+
+	page := requestAuthorization(a, config, accountID, generateCodeVerifier(a))
+	response := submitConsent(a, page, accountID, url.Values{"consent": {"deny"}})
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("access_denied", location.Query().Get("error"))
+}
+
+func TestAuthorizationCodeConsentCSRF(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	verifier := generateCodeVerifier(a)
+
+	// The consent page of another end-user
+	page := requestAuthorization(a, config, uuid.NewString(), verifier)
+	response := submitConsent(a, page, uuid.NewString(), url.Values{"consent": {"approve"}})
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("request_forbidden", location.Query().Get("error"))
+	a.Empty(location.Query().Get("code"))
+
+	accountID := uuid.NewString()
+	page = requestAuthorization(a, config, accountID, verifier)
+	response = submitConsent(a, page, accountID, url.Values{"consent": {"approve"}, "csrf_token": {""}})
+
+	location, err = response.Location()
+	a.NoError(err)
+	a.Equal("request_forbidden", location.Query().Get("error"))
+}
+
+func TestAuthorizationCodeConsentRequired(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	config.Endpoint.AuthURL += "?prompt=none"
+
+	response := requestAuthorization(a, config, uuid.NewString(), generateCodeVerifier(a))
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal("consent_required", location.Query().Get("error"))
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	token := fetchRefreshableToken(a, config)
+
+	rotated := decodeToken(a, refresh(a, config, token.RefreshToken))
+	a.NotEmpty(rotated.AccessToken)
+	a.NotEmpty(rotated.RefreshToken)
+	a.NotEqual(token.RefreshToken, rotated.RefreshToken, "Refresh token is rotated")
+
+	// The rotated refresh token can be used in turn
+	decodeToken(a, refresh(a, config, rotated.RefreshToken))
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	token := fetchRefreshableToken(a, config)
+
+	rotated := decodeToken(a, refresh(a, config, token.RefreshToken))
+
+	res := refresh(a, config, token.RefreshToken)
+	a.NotEqual(http.StatusOK, res.StatusCode, "Reused refresh token is rejected")
+
+	res = refresh(a, config, rotated.RefreshToken)
+	a.NotEqual(http.StatusOK, res.StatusCode, "Whole token family is revoked on reuse")
+}
+
+func TestRefreshTokenWithoutOfflineAccess(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL)
+	verifier := generateCodeVerifier(a)
+	code := authorizeCode(a, authorize(a, config, uuid.NewString(), verifier))
+
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+	a.Empty(token.RefreshToken)
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	token := fetchRefreshableToken(a, config)
+
+	res, err := http.PostForm(fmt.Sprintf("%s/oauth2/revoke", srv.URL), url.Values{
+		"token":           {token.RefreshToken},
+		"token_type_hint": {"refresh_token"},
+		"client_id":       {config.ClientID},
+	})
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	res = refresh(a, config, token.RefreshToken)
+	a.NotEqual(http.StatusOK, res.StatusCode)
+}
+
+func TestDeviceCode(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+
+	response := pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("authorization_pending", decodeError(a, response))
+
+	accountID := uuid.NewString()
+	response = verifyDevice(a, srv.URL, device.UserCode, accountID)
+	a.Equal(http.StatusNoContent, response.StatusCode)
+
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal(http.StatusOK, response.StatusCode)
+	token := decodeToken(a, response)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal(accountID, claims["sub"])
+	a.Equal(c.ID, claims["client_id"])
+	a.Equal(c.AndroidID, claims["android_id"])
+
+	// `device_code` is single use
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_grant", decodeError(a, response))
+}
+
+func TestDeviceCodeSlowDown(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+
+	response := pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal("authorization_pending", decodeError(a, response))
+
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("slow_down", decodeError(a, response))
+}
+
+func TestDeviceCodeLoginRequired(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+
+	response := verifyDevice(a, srv.URL, device.UserCode, "")
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("login_required", decodeError(a, response))
+
+	// An invalid user code can't be told apart until the end-user has logged in
+	response = verifyDevice(a, srv.URL, "BCDF-GHJK", "")
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("login_required", decodeError(a, response))
+}
+
+func TestDeviceCodeUserCodeLockout(t *testing.T) {
+	a := assert.New(t)
+	db := utils.Must(storage.NewDynamoDBClient())
+	lockouts := lockout.NewStore(db, lockout.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	s := setupWithLockout(t, lockouts)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+	accountID := uuid.NewString()
+	// Unique per test run, so the lockout doesn't affect other tests
+	ip := uuid.NewString()
+
+	for i := 0; i < 2; i++ {
+		res := requestDeviceVerificationFrom(a, srv.URL, "BCDF-GHJK", accountID, ip)
+		a.Equal(http.StatusBadRequest, res.StatusCode, "Invalid user codes below the threshold")
+		a.Equal("invalid_request", decodeError(a, res))
+	}
+
+	res := requestDeviceVerificationFrom(a, srv.URL, device.UserCode, accountID, uuid.NewString())
+	a.Equal(http.StatusOK, res.StatusCode, "Other source IPs aren't locked out")
+
+	res = requestDeviceVerificationFrom(a, srv.URL, device.UserCode, accountID, ip)
+	a.Equal(http.StatusTooManyRequests, res.StatusCode, "Source IP is locked out, even with a valid user code")
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	a.NoError(err)
+	a.InDelta(60, retryAfter, 2)
+	a.Equal("invalid_request", decodeError(a, res))
+}
+
+func TestDeviceCodeVerificationIsReadOnly(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+
+	// e.g. a link (to the verification URI complete) on another site
+	response := requestDeviceVerification(a, srv.URL, device.UserCode, uuid.NewString())
+	a.Equal(http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	a.NoError(err)
+	a.Contains(string(body), device.UserCode)
+
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal("authorization_pending", decodeError(a, response))
+}
+
+func TestDeviceCodeVerificationCSRF(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+
+	// e.g. a form on another site, which the end-user's browser submits with their session
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/oauth2/device/verify", strings.NewReader(url.Values{
+		"user_code": {device.UserCode},
+		"consent":   {"approve"},
+	}.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessionCookie(a, testLoginKey, "user", uuid.NewString()))
+
+	response, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	a.Equal(http.StatusForbidden, response.StatusCode)
+	a.Equal("request_forbidden", decodeError(a, response))
+
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal("authorization_pending", decodeError(a, response))
+}
+
+func TestDeviceCodeDenied(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createDeviceClient(a, s.db)
+	device := requestDeviceCode(a, srv.URL, c.ID)
+	accountID := uuid.NewString()
+
+	page := requestDeviceVerification(a, srv.URL, device.UserCode, accountID)
+	response := submitConsent(a, page, accountID, url.Values{"consent": {"deny"}})
+	a.Equal(http.StatusForbidden, response.StatusCode)
+	a.Equal("access_denied", decodeError(a, response))
+
+	response = pollDeviceToken(a, srv.URL, c.ID, device.DeviceCode)
+	a.Equal("access_denied", decodeError(a, response))
+}
+
+func TestDeviceCodeUnauthorizedClient(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+
+	response := postForm(a, srv.URL+"/oauth2/device/code", c.ID, testSecret, url.Values{})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("unauthorized_client", decodeError(a, response))
+}
+
+func TestTokenExchange(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	// A token for service A, which calls service B on behalf of the end-user
+	config := newPublicOAuth2ConfigWithAudience(a, s.db, srv.URL, "https://a.kidsloop.live", "foo", "bar")
+	subject := fetchAccountToken(a, config)
+
+	service := createClientWithOptions(a, s.db, client.CreateOptions{
+		GrantTypes:       []string{client.TokenExchange},
+		AllowedScopes:    []string{"foo"},
+		AllowedAudiences: []string{"https://a.kidsloop.live", "https://b.kidsloop.live"},
+	})
+
+	response := exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{
+		"scope":    {"foo"},
+		"audience": {"https://b.kidsloop.live"},
+	})
+	a.Equal(http.StatusOK, response.StatusCode)
+	token := decodeToken(a, response)
+	a.Equal(AccessTokenType, token.Extra("issued_token_type"))
+
+	subjectClaims, err := crypto.DecodeJWTPayload(subject.AccessToken)
+	a.NoError(err)
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+
+	a.Equal(subjectClaims["sub"], claims["sub"])
+	a.Equal(subjectClaims["account_id"], claims["account_id"])
+	a.Equal(subjectClaims["android_id"], claims["android_id"])
+	a.Equal(service.ID, claims["client_id"])
+	a.Equal(map[string]interface{}{"sub": service.ID}, claims["act"])
+	a.Equal([]interface{}{"foo"}, claims["scp"])
+	a.Equal([]interface{}{"https://b.kidsloop.live"}, claims["aud"])
+	a.LessOrEqual(claims["exp"], subjectClaims["exp"])
+
+	// Exchanging again (by service B) nests the previous actor
+	other := createClientWithOptions(a, s.db, client.CreateOptions{
+		GrantTypes:       []string{client.TokenExchange},
+		AllowedScopes:    []string{"foo"},
+		AllowedAudiences: []string{"https://b.kidsloop.live"},
+	})
+
+	response = exchangeToken(a, srv.URL, other.ID, token.AccessToken, url.Values{})
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	claims, err = crypto.DecodeJWTPayload(decodeToken(a, response).AccessToken)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"sub": other.ID, "act": map[string]interface{}{"sub": service.ID}}, claims["act"])
+	a.Equal([]interface{}{"foo"}, claims["scp"])
+}
+
+func TestTokenExchangeScopeNotGranted(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2ConfigWithAudience(a, s.db, srv.URL, "https://a.kidsloop.live", "foo")
+	subject := fetchAccountToken(a, config)
+
+	service := createClientWithOptions(a, s.db, client.CreateOptions{
+		GrantTypes:       []string{client.TokenExchange},
+		AllowedScopes:    []string{"foo", "bar"},
+		AllowedAudiences: []string{"https://a.kidsloop.live"},
+	})
+
+	response := exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{"scope": {"bar"}})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_scope", decodeError(a, response))
+}
+
+func TestTokenExchangeNotAnAudience(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2ConfigWithAudience(a, s.db, srv.URL, "https://a.kidsloop.live", "foo")
+	subject := fetchAccountToken(a, config)
+
+	// Any service with the grant could otherwise act as any end-user whose token it has seen
+	service := createClientWithOptions(a, s.db, client.CreateOptions{
+		GrantTypes:       []string{client.TokenExchange},
+		AllowedScopes:    []string{"foo"},
+		AllowedAudiences: []string{"https://b.kidsloop.live"},
+	})
+
+	response := exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_request", decodeError(a, response))
+}
+
+func TestTokenExchangeRevokedSubjectToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+	subject := fetchToken(a, srv.URL, c.ID)
+
+	response := revoke(a, srv.URL, c.ID, testSecret, subject.AccessToken)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	service := createClientWithOptions(a, s.db, client.CreateOptions{GrantTypes: []string{client.TokenExchange}})
+
+	response = exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_request", decodeError(a, response))
+}
+
+func TestTokenExchangeDPoPBoundSubjectToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	service := createClientWithOptions(a, s.db, client.CreateOptions{GrantTypes: []string{client.TokenExchange}})
+	c := createClientWithOptions(a, s.db, client.CreateOptions{AllowedAudiences: []string{service.ID}})
+
+	key := generateDPoPKey(a)
+	form := url.Values{"grant_type": {"client_credentials"}, "audience": {service.ID}}
+	response := postFormWithDPoP(a, srv.URL+"/oauth2/token", c.ID, form, signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, TokenURL, time.Now())))
+	a.Equal(http.StatusOK, response.StatusCode)
+	subject := decodeToken(a, response)
+
+	// Otherwise a stolen DPoP-bound token could be exchanged for a bearer token
+	response = exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_dpop_proof", decodeError(a, response))
+
+	form = url.Values{"grant_type": {client.TokenExchange}, "subject_token": {subject.AccessToken}, "subject_token_type": {AccessTokenType}}
+	response = postFormWithDPoP(a, srv.URL+"/oauth2/token", service.ID, form, signDPoPProof(a, generateDPoPKey(a), "dpop+jwt", testDPoPClaimsFor(http.MethodPost, TokenURL, time.Now())))
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_dpop_proof", decodeError(a, response), "Another key")
+
+	response = postFormWithDPoP(a, srv.URL+"/oauth2/token", service.ID, form, signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, TokenURL, time.Now())))
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	claims, err := crypto.DecodeJWTPayload(decodeToken(a, response).AccessToken)
+	a.NoError(err)
+	subjectClaims, err := crypto.DecodeJWTPayload(subject.AccessToken)
+	a.NoError(err)
+	a.Equal(subjectClaims["cnf"], claims["cnf"], "The new token is bound to the same key")
+}
+
+func TestTokenExchangeUnauthorizedClient(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+	subject := fetchToken(a, srv.URL, c.ID)
+
+	response := exchangeToken(a, srv.URL, c.ID, subject.AccessToken, url.Values{})
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("unauthorized_client", decodeError(a, response))
+}
+
+func TestClientCredentialsInvalidCredentials(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: "incorrect-password",
+		Scopes:       []string{""},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	_, err := conf.Token(context.Background())
+	a.Error(err)
+}
+
+func TestClientCredentialsPreviousSecret(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+	repo := client.NewRepository(s.db)
+
+	newSecret := "n3w-" + testSecret
+	_, err := repo.Update(context.Background(), client.UpdateOptions{AccountID: c.AccountID, ID: c.ID, Secret: newSecret, SecretGracePeriod: time.Hour})
+	a.NoError(err)
+
+	for _, secret := range []string{testSecret, newSecret} {
+		response := postClientCredentialsFrom(a, srv.URL, c.ID, secret, uuid.NewString())
+		a.Equal(http.StatusOK, response.StatusCode, "Both secrets are accepted during the grace period")
+	}
+
+	_, err = repo.Update(context.Background(), client.UpdateOptions{AccountID: c.AccountID, ID: c.ID, RevokePreviousSecret: true})
+	a.NoError(err)
+
+	response := postClientCredentialsFrom(a, srv.URL, c.ID, testSecret, uuid.NewString())
+	a.Equal(http.StatusUnauthorized, response.StatusCode, "The previous secret is revoked")
+	response = postClientCredentialsFrom(a, srv.URL, c.ID, newSecret, uuid.NewString())
+	a.Equal(http.StatusOK, response.StatusCode)
+}
+
+func TestClientCredentialsRehashSecret(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+
+	// Stronger parameters than those the Client's secret was hashed with
+	params := *argon2id.DefaultParams
+	params.Iterations++
+	a.NoError(crypto.SetSecretHashParams(&params))
+	defer func() { a.NoError(crypto.SetSecretHashParams(argon2id.DefaultParams)) }()
+	a.True(crypto.NeedsRehash(c.SecretHash))
+
+	response := postClientCredentialsFrom(a, srv.URL, c.ID, testSecret, uuid.NewString())
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	// The hash is re-created after responding
+	var updated *client.Client
+	a.Eventually(func() bool {
+		updated = utils.Must(client.NewRepository(s.db).GetByID(context.Background(), c.ID))
+		return c.SecretHash != updated.SecretHash
+	}, time.Second*5, time.Millisecond*50, "The hash is re-created")
+	a.False(crypto.NeedsRehash(updated.SecretHash))
+	a.True(utils.Must(crypto.CompareSecret(context.Background(), testSecret, updated.SecretHash)))
+	a.Equal(c.SecretPrefix, updated.SecretPrefix, "The secret is unchanged")
+}
+
+func TestClientCredentialsSecretCache(t *testing.T) {
+	a := assert.New(t)
+	cache := utils.Must(secretcache.New(secretcache.DefaultPolicy))
+	s := setupWithOptions(t, ProviderOptions{SecretCache: cache})
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+
+	for i := 0; i < 2; i++ {
+		response := postClientCredentialsFrom(a, srv.URL, c.ID, testSecret, uuid.NewString())
+		a.Equal(http.StatusOK, response.StatusCode)
+	}
+	a.Equal(1, cache.Len(), "The secret is verified once")
+
+	// Even if the cache isn't invalidated (e.g. on another instance), the rotated hash doesn't match
+	_, err := client.NewRepository(s.db).Update(context.Background(), client.UpdateOptions{AccountID: c.AccountID, ID: c.ID, Secret: "n3w-" + testSecret})
+	a.NoError(err)
+
+	response := postClientCredentialsFrom(a, srv.URL, c.ID, testSecret, uuid.NewString())
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+}
+
+func TestClientCredentialsNonexistentClient(t *testing.T) {
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	conf := clientcredentials.Config{
+		ClientID:     uuid.NewString(),
+		ClientSecret: "pa$$word",
+		Scopes:       []string{""},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	_, err := conf.Token(context.Background())
+	assert.Error(t, err)
+}
+
+// Responses for a nonexistent Client and an incorrect secret can't be told apart, including by their time
+func TestClientCredentialsNonexistentClientTiming(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	basic := createClient(a, s.db)
+	post := createClientWithOptions(a, s.db, client.CreateOptions{TokenEndpointAuthMethod: client.ClientSecretPost})
+	public := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.None,
+		RedirectURIs:            []string{"https://app.kidsloop.live/callback"},
+	})
+	_, jwks := generateJWKS(a)
+	privateKeyJWT := createClientWithOptions(a, s.db, client.CreateOptions{TokenEndpointAuthMethod: client.PrivateKeyJWT, JWKS: jwks})
+
+	postSecret := func(clientID string) *http.Response {
+		form := url.Values{"grant_type": {"client_credentials"}, "client_id": {clientID}, "client_secret": {"incorrect-password"}}
+		res, err := http.PostForm(srv.URL+"/oauth2/token", form)
+		a.NoError(err)
+		return res
+	}
+	basicSecret := func(clientID string) *http.Response {
+		return postClientCredentialsFrom(a, srv.URL, clientID, "incorrect-password", uuid.NewString())
+	}
+
+	for _, tc := range []struct {
+		clientID string
+		request  func(clientID string) *http.Response
+		reason   string
+	}{
+		{clientID: basic.ID, request: basicSecret, reason: "client_secret_basic"},
+		{clientID: post.ID, request: postSecret, reason: "client_secret_post"},
+		{clientID: public.ID, request: basicSecret, reason: "A public Client, which has no secret"},
+		{clientID: privateKeyJWT.ID, request: basicSecret, reason: "A private_key_jwt Client, which has no secret"},
+		{clientID: privateKeyJWT.ID, request: postSecret, reason: "A private_key_jwt Client, which has no secret"},
+	} {
+		// Interleaved, so that any change in load affects both alike
+		var known, unknown []time.Duration
+		var knownBody, unknownBody string
+		for i := 0; i < 15; i++ {
+			start := time.Now()
+			res := tc.request(tc.clientID)
+			known = append(known, time.Since(start))
+			a.Equal(http.StatusUnauthorized, res.StatusCode, tc.reason)
+			knownBody = string(utils.Must(io.ReadAll(res.Body)))
+
+			start = time.Now()
+			res = tc.request(uuid.NewString())
+			unknown = append(unknown, time.Since(start))
+			a.Equal(http.StatusUnauthorized, res.StatusCode, tc.reason)
+			unknownBody = string(utils.Must(io.ReadAll(res.Body)))
+		}
+
+		a.Equal(unknownBody, knownBody, tc.reason)
+		a.InEpsilon(float64(medianDuration(known)), float64(medianDuration(unknown)), 0.5, "%s, known: %v, unknown: %v", tc.reason, known, unknown)
+	}
+}
+
+func TestClientCredentialsLockout(t *testing.T) {
+	a := assert.New(t)
+	db := utils.Must(storage.NewDynamoDBClient())
+	lockouts := lockout.NewStore(db, lockout.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	s := setupWithLockout(t, lockouts)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+	other := createClient(a, s.db)
+	// Unique per test run, so the IP lockout doesn't affect other tests
+	ip := uuid.NewString()
+
+	for i := 0; i < 2; i++ {
+		res := postClientCredentialsFrom(a, srv.URL, client.ID, "incorrect-password", ip)
+		a.Equal(http.StatusUnauthorized, res.StatusCode, "Failures below the threshold")
+		a.Empty(res.Header.Get("Retry-After"))
+	}
+
+	res := postClientCredentialsFrom(a, srv.URL, client.ID, testSecret, uuid.NewString())
+	a.Equal(http.StatusOK, res.StatusCode, "Client isn't locked out from other source IPs")
+
+	res = postClientCredentialsFrom(a, srv.URL, client.ID, testSecret, ip)
+	a.Equal(http.StatusTooManyRequests, res.StatusCode, "Client is locked out from the source IP, even with the correct secret")
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	a.NoError(err)
+	a.InDelta(60, retryAfter, 2)
+
+	body := map[string]interface{}{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal("invalid_client", body["error"])
+
+	res = postClientCredentialsFrom(a, srv.URL, other.ID, testSecret, ip)
+	a.Equal(http.StatusTooManyRequests, res.StatusCode, "Source IP is locked out, for every Client")
+
+	ctx := context.Background()
+	a.NoError(lockouts.ResetPartition(ctx, lockout.ClientPartition(client.ID)))
+	a.NoError(lockouts.Reset(ctx, lockout.IPKey(ip)))
+
+	res = postClientCredentialsFrom(a, srv.URL, client.ID, testSecret, ip)
+	a.Equal(http.StatusOK, res.StatusCode, "Lockout is cleared")
+}
+
+func TestClientCredentialsLockoutResetOnSuccess(t *testing.T) {
+	a := assert.New(t)
+	db := utils.Must(storage.NewDynamoDBClient())
+	lockouts := lockout.NewStore(db, lockout.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	s := setupWithLockout(t, lockouts)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+	ip := uuid.NewString()
+
+	res := postClientCredentialsFrom(a, srv.URL, client.ID, "incorrect-password", ip)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	res = postClientCredentialsFrom(a, srv.URL, client.ID, testSecret, ip)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	counter, err := lockouts.Get(context.Background(), lockout.ClientKey(client.ID, ip))
+	a.NoError(err)
+	a.Zero(counter.Failures, "Failures are forgotten once the Client authenticates")
+}
+
+// Introspection and revocation authenticate Clients outside of the token endpoint
+func TestIntrospectAndRevokeLockout(t *testing.T) {
+	a := assert.New(t)
+	db := utils.Must(storage.NewDynamoDBClient())
+	lockouts := lockout.NewStore(db, lockout.Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	s := setupWithLockout(t, lockouts)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, client.ID)
+	ip := uuid.NewString()
+	form := url.Values{"token": {token.AccessToken}}
+
+	res := postFormFrom(a, srv.URL+"/oauth2/introspect", client.ID, "incorrect-password", form, ip)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	res = postFormFrom(a, srv.URL+"/oauth2/revoke", client.ID, "incorrect-password", form, ip)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	for _, endpoint := range []string{"/oauth2/introspect", "/oauth2/revoke", "/oauth2/token"} {
+		res = postFormFrom(a, srv.URL+endpoint, client.ID, testSecret, url.Values{"token": {token.AccessToken}, "grant_type": {"client_credentials"}}, ip)
+		a.Equal(http.StatusTooManyRequests, res.StatusCode, endpoint)
+		a.NotEmpty(res.Header.Get("Retry-After"), endpoint)
+	}
+}
+
+func TestClientCredentialsInvalidOfflineAccess(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: testSecret,
+		Scopes:       []string{"offline_access"},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.Error(err)
+	a.Nil(tokenResponse)
+}
+
+func TestClientCredentialsValidAccessToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: testSecret,
+		Scopes:       []string{""},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.NoError(err)
+
+	a.Equal("bearer", tokenResponse.TokenType)
+
+	assertTokenPayloadValid(a, tokenResponse, client)
+
+	assertTokenHeaderValid(t, tokenResponse.AccessToken)
+
+	assertTokenSignatureValid(t, tokenResponse.AccessToken)
+}
+
+func TestClientCredentialsAllowedScope(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{AllowedScopes: []string{"foo", "bar.*"}})
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: testSecret,
+		Scopes:       []string{"foo", "bar.baz"},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(tokenResponse.AccessToken)
+	a.NoError(err)
+	a.Equal([]interface{}{"foo", "bar.baz"}, claims["scp"])
+}
+
+func TestClientCredentialsDisallowedScope(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{AllowedScopes: []string{"foo"}})
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: testSecret,
+		Scopes:       []string{"foo", "bar"},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.Error(err)
+	a.Nil(tokenResponse)
+}
+
+func TestClientCredentialsAllowedAudience(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		AllowedAudiences: []string{"https://a.kidsloop.live", "https://b.kidsloop.live"},
+	})
+
+	conf := clientcredentials.Config{
+		ClientID:       client.ID,
+		ClientSecret:   testSecret,
+		TokenURL:       fmt.Sprintf("%s/oauth2/token", srv.URL),
+		EndpointParams: url.Values{"audience": {"https://a.kidsloop.live"}},
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(tokenResponse.AccessToken)
+	a.NoError(err)
+	a.Equal([]interface{}{"https://a.kidsloop.live"}, claims["aud"], "Only the requested audience")
+}
+
+func TestClientCredentialsDisallowedAudience(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		AllowedAudiences: []string{"https://a.kidsloop.live"},
+	})
+
+	conf := clientcredentials.Config{
+		ClientID:       client.ID,
+		ClientSecret:   testSecret,
+		TokenURL:       fmt.Sprintf("%s/oauth2/token", srv.URL),
+		EndpointParams: url.Values{"audience": {"https://c.kidsloop.live"}},
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.Error(err)
+	a.Nil(tokenResponse)
+}
+
+func TestClientCredentialsResource(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		AllowedAudiences: []string{"https://a.kidsloop.live", "https://b.kidsloop.live", "https://c.kidsloop.live"},
+	})
+
+	conf := clientcredentials.Config{
+		ClientID:       client.ID,
+		ClientSecret:   testSecret,
+		TokenURL:       fmt.Sprintf("%s/oauth2/token", srv.URL),
+		EndpointParams: url.Values{"resource": {"https://a.kidsloop.live", "https://b.kidsloop.live"}},
+	}
+
+	tokenResponse, err := conf.Token(context.Background())
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(tokenResponse.AccessToken)
+	a.NoError(err)
+	a.Equal([]interface{}{"https://a.kidsloop.live", "https://b.kidsloop.live"}, claims["aud"], "Only the requested resources")
+}
+
+func TestClientCredentialsInvalidResource(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		AllowedAudiences: []string{"https://a.kidsloop.live"},
+	})
+
+	for _, resource := range []string{"https://c.kidsloop.live", "https://a.kidsloop.live#fragment"} {
+		form := url.Values{"grant_type": {"client_credentials"}, "resource": {resource}}
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/oauth2/token", srv.URL), strings.NewReader(form.Encode()))
+		a.NoError(err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, testSecret)
+
+		response, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		a.Equal(http.StatusBadRequest, response.StatusCode, resource)
+		a.Equal("invalid_target", decodeError(a, response), resource)
+	}
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	key, jwks := generateJWKS(a)
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.PrivateKeyJWT,
+		JWKS:                    jwks,
+	})
+
+	assertion := signClientAssertion(a, key, client.ID)
+
+	res := postClientAssertion(a, srv.URL, assertion)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+
+	claims, err := crypto.DecodeJWTPayload(body["access_token"].(string))
+	a.NoError(err)
+	a.Equal(client.ID, claims["sub"])
+
+	res = postClientAssertion(a, srv.URL, assertion)
+	a.Equal(http.StatusBadRequest, res.StatusCode, "Client assertion can't be replayed")
+}
+
+func TestPrivateKeyJWTInvalidSignature(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	_, jwks := generateJWKS(a)
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.PrivateKeyJWT,
+		JWKS:                    jwks,
+	})
+
+	otherKey, _ := generateJWKS(a)
+	assertion := signClientAssertion(a, otherKey, client.ID)
+
+	res := postClientAssertion(a, srv.URL, assertion)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestPrivateKeyJWTClientSecretRejected(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	_, jwks := generateJWKS(a)
+	client := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.PrivateKeyJWT,
+		JWKS:                    jwks,
+	})
+
+	conf := clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: testSecret,
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+
+	_, err := conf.Token(context.Background())
+	a.Error(err)
+}
+
+func TestSelfSignedTLSClientAuth(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	cert := generateCertificate(a, "CN=device", nil)
+	srv, httpClient := newTLSServer(s.r, cert)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod:     client.SelfSignedTLSClientAuth,
+		TLSClientAuthSPKIThumbprint: crypto.SPKIThumbprint(cert.Leaf),
+	})
+
+	response := postTLSClientCredentials(a, httpClient, srv.URL, c.ID)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	claims, err := crypto.DecodeJWTPayload(decodeToken(a, response).AccessToken)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"x5t#S256": crypto.CertificateThumbprint(cert.Leaf)}, claims["cnf"])
+}
+
+func TestSelfSignedTLSClientAuthIncorrectCertificate(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	cert := generateCertificate(a, "CN=device", nil)
+	srv, httpClient := newTLSServer(s.r, cert)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod:     client.SelfSignedTLSClientAuth,
+		TLSClientAuthSPKIThumbprint: crypto.SPKIThumbprint(generateCertificate(a, "CN=device", nil).Leaf),
+	})
+
+	response := postTLSClientCredentials(a, httpClient, srv.URL, c.ID)
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+	a.Equal("invalid_client", decodeError(a, response))
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	a := assert.New(t)
+
+	ca := generateCertificate(a, "CN=Test CA", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	s := setupWithOptions(t, ProviderOptions{ClientCAs: clientCAs})
+
+	cert := generateCertificate(a, "CN=partner.example.com,O=Partner", &ca)
+	srv, httpClient := newTLSServer(s.r, cert)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.TLSClientAuth,
+		TLSClientAuthSubjectDN:  "CN=partner.example.com,O=Partner",
+	})
+
+	response := postTLSClientCredentials(a, httpClient, srv.URL, c.ID)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	claims, err := crypto.DecodeJWTPayload(decodeToken(a, response).AccessToken)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"x5t#S256": crypto.CertificateThumbprint(cert.Leaf)}, claims["cnf"])
+}
+
+func TestTLSClientAuthUntrustedCertificate(t *testing.T) {
+	a := assert.New(t)
+
+	ca := generateCertificate(a, "CN=Test CA", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	s := setupWithOptions(t, ProviderOptions{ClientCAs: clientCAs})
+
+	// Same subject, but self-signed
+	cert := generateCertificate(a, "CN=partner.example.com,O=Partner", nil)
+	srv, httpClient := newTLSServer(s.r, cert)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.TLSClientAuth,
+		TLSClientAuthSubjectDN:  "CN=partner.example.com,O=Partner",
+	})
+
+	response := postTLSClientCredentials(a, httpClient, srv.URL, c.ID)
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+	a.Equal("invalid_client", decodeError(a, response))
+}
+
+func TestDPoP(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+	c := createClient(a, s.db)
+
+	key := generateDPoPKey(a)
+	proof := signDPoPProof(a, key, "dpop+jwt", testDPoPClaimsFor(http.MethodPost, TokenURL, time.Now()))
+
+	response := postDPoPClientCredentials(a, srv.URL, c.ID, proof)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	token := decodeToken(a, response)
+	a.Equal(DPoPTokenType, token.TokenType)
+
+	public := key.Public()
+	thumbprint, err := public.Thumbprint(gocrypto.SHA256)
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"jkt": base64.RawURLEncoding.EncodeToString(thumbprint)}, claims["cnf"])
+}
+
+func TestDPoPReplay(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+	c := createClient(a, s.db)
+
+	proof := signDPoPProof(a, generateDPoPKey(a), "dpop+jwt", testDPoPClaimsFor(http.MethodPost, TokenURL, time.Now()))
+
+	response := postDPoPClientCredentials(a, srv.URL, c.ID, proof)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	response = postDPoPClientCredentials(a, srv.URL, c.ID, proof)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_dpop_proof", decodeError(a, response))
+}
+
+func TestDPoPInvalidProof(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+	c := createClient(a, s.db)
+
+	proof := signDPoPProof(a, generateDPoPKey(a), "dpop+jwt", testDPoPClaimsFor(http.MethodPost, "https://example.com/oauth2/token", time.Now()))
+
+	response := postDPoPClientCredentials(a, srv.URL, c.ID, proof)
+	a.Equal(http.StatusBadRequest, response.StatusCode)
+	a.Equal("invalid_dpop_proof", decodeError(a, response))
+}
+
+func TestClientTokenLifespan(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{TokenLifespan: 300})
+
+	assertTokenLifespan(a, fetchToken(a, srv.URL, c.ID), time.Minute*5)
+}
+
+func TestAccountTokenLifespan(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	accountID := uuid.NewString()
+	a.NoError(account.NewSettingsRepository(s.db).Put(context.Background(), accountID, account.Settings{TokenLifespan: 3600}))
+
+	// The Client's own lifespan takes precedence over its account's
+	c := createClientWithOptions(a, s.db, client.CreateOptions{AccountID: accountID})
+	assertTokenLifespan(a, fetchToken(a, srv.URL, c.ID), time.Hour)
+
+	c = createClientWithOptions(a, s.db, client.CreateOptions{AccountID: accountID, TokenLifespan: 300})
+	assertTokenLifespan(a, fetchToken(a, srv.URL, c.ID), time.Minute*5)
+}
+
+func TestMaxTokenLifespan(t *testing.T) {
+	a := assert.New(t)
+	s := setupWithOptions(t, ProviderOptions{MaxAccessTokenLifespan: time.Hour})
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{TokenLifespan: 60 * 60 * 24})
+
+	assertTokenLifespan(a, fetchToken(a, srv.URL, c.ID), time.Hour)
+}
+
+func TestCustomClaims(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		CustomClaims: map[string]string{"region": "eu-west-2", "tenant": "acme-{{account_id}}"},
+	})
+
+	token := fetchToken(a, srv.URL, c.ID)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal("eu-west-2", claims["region"])
+	a.Equal("acme-"+c.AccountID, claims["tenant"])
+
+	response := introspect(a, srv.URL, c.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	var introspection map[string]interface{}
+	a.NoError(json.NewDecoder(response.Body).Decode(&introspection))
+	a.Equal("acme-"+c.AccountID, introspection["tenant"])
+}
+
+func TestTokenExchangeCustomClaims(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	service := createClientWithOptions(a, s.db, client.CreateOptions{
+		GrantTypes:   []string{client.TokenExchange},
+		CustomClaims: map[string]string{"region": "us-east-1", "partner": "service"},
+	})
+	c := createClientWithOptions(a, s.db, client.CreateOptions{
+		AllowedAudiences: []string{service.ID},
+		CustomClaims:     map[string]string{"region": "eu-west-2", "tenant": "acme-{{account_id}}"},
+	})
+
+	response := postForm(a, srv.URL+"/oauth2/token", c.ID, testSecret, url.Values{"grant_type": {"client_credentials"}, "audience": {service.ID}})
+	subject := decodeToken(a, response)
+
+	response = exchangeToken(a, srv.URL, service.ID, subject.AccessToken, url.Values{})
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	// The subject token's custom claims are kept, rather than replaced by the actor's
+	claims, err := crypto.DecodeJWTPayload(decodeToken(a, response).AccessToken)
+	a.NoError(err)
+	a.Equal("eu-west-2", claims["region"])
+	a.Equal("acme-"+c.AccountID, claims["tenant"])
+	a.NotContains(claims, "partner")
+}
+
+func TestEntitlementClaims(t *testing.T) {
+	a := assert.New(t)
+	accountID := uuid.NewString()
+	s := setupWithHandlerOptions(t, ProviderOptions{}, HandlerOptions{Entitlements: StaticEntitlementProvider{
+		accountID: {SubscriptionID: "subscription", Entitlements: []string{"lessons"}},
+	}})
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{AccountID: accountID})
+
+	token := fetchToken(a, srv.URL, c.ID)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal("subscription", claims["subscription_id"])
+	a.Equal([]interface{}{"lessons"}, claims["entitlements"])
+}
+
+func TestEntitlementClaimsRefresh(t *testing.T) {
+	a := assert.New(t)
+	accountID := uuid.NewString()
+	entitlements := StaticEntitlementProvider{
+		accountID: {SubscriptionID: "subscription", Entitlements: []string{"lessons"}},
+	}
+	s := setupWithHandlerOptions(t, ProviderOptions{}, HandlerOptions{Entitlements: entitlements})
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	verifier := generateCodeVerifier(a)
+	code := authorizeCode(a, authorize(a, config, accountID, verifier))
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.NoError(err)
+	a.Equal([]interface{}{"lessons"}, claims["entitlements"])
+
+	// The subscription changed after the refresh token was issued
+	entitlements[accountID] = &Entitlements{SubscriptionID: "upgraded", Entitlements: []string{"lessons", "reports"}}
+
+	claims, err = crypto.DecodeJWTPayload(decodeToken(a, refresh(a, config, token.RefreshToken)).AccessToken)
+	a.NoError(err)
+	a.Equal("upgraded", claims["subscription_id"])
+	a.Equal([]interface{}{"lessons", "reports"}, claims["entitlements"])
+}
+
+func TestEntitlementFailure(t *testing.T) {
+	a := assert.New(t)
+	provider := &toggledEntitlementProvider{}
+	s := setupWithHandlerOptions(t, ProviderOptions{}, HandlerOptions{Entitlements: provider})
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+
+	provider.failing = true
+	res, err := http.PostForm(fmt.Sprintf("%s/oauth2/token", srv.URL), url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.ID},
+		"client_secret": {testSecret},
+	})
+	a.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, res.StatusCode)
+
+	// Likewise when refreshing
+	provider.failing = false
+	config := newPublicOAuth2Config(a, s.db, srv.URL, "offline_access")
+	token := fetchRefreshableToken(a, config)
+
+	provider.failing = true
+	res = refresh(a, config, token.RefreshToken)
+	a.Equal(http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestOpaqueAccessToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClientWithOptions(a, s.db, client.CreateOptions{TokenFormat: client.OpaqueTokenFormat})
+	token := fetchToken(a, srv.URL, c.ID)
+
+	_, err := crypto.DecodeJWTPayload(token.AccessToken)
+	a.Error(err, "Not a JWT")
+
+	res := introspect(a, srv.URL, c.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(true, body["active"])
+	a.Equal(c.ID, body["client_id"])
+	a.Equal(c.AccountID, body["account_id"])
+
+	res = revoke(a, srv.URL, c.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	res = introspect(a, srv.URL, c.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	body = map[string]interface{}{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(false, body["active"])
+}
+
+func TestRegistration(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	accountID := uuid.NewString()
+	initialAccessToken, _, err := account.NewInitialAccessTokenRepository(s.db).Create(context.Background(), accountID, time.Hour, 1)
+	a.NoError(err)
+
+	res := sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), initialAccessToken, map[string]interface{}{
+		"client_name": "Partner",
+		"scope":       "read write",
+	})
+	a.Equal(http.StatusCreated, res.StatusCode)
+
+	var registration RegistrationResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&registration))
+	a.NotEmpty(registration.ClientID)
+	a.NotEmpty(registration.ClientSecret)
+	a.Equal(int64(0), *registration.ClientSecretExpiresAt)
+	a.NotEmpty(registration.RegistrationAccessToken)
+	a.Equal(RegistrationURL+"/"+registration.ClientID, registration.RegistrationClientURI)
+	a.Equal(client.ClientSecretBasic, registration.TokenEndpointAuthMethod)
+	a.Equal([]string{client.ClientCredentials}, registration.GrantTypes)
+	a.Equal("read write", registration.Scope)
+
+	registered, err := client.NewRepository(s.db).Get(context.Background(), client.GetOptions{AccountID: accountID, ID: registration.ClientID})
+	a.NoError(err, "Registered in the account of the initial access token")
+	a.Equal("Partner", registered.Name)
+
+	res = sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), initialAccessToken, map[string]interface{}{
+		"client_name": "Another",
+	})
+	a.Equal(http.StatusUnauthorized, res.StatusCode, "The initial access token may only register one Client")
+
+	conf := clientcredentials.Config{
+		ClientID:     registration.ClientID,
+		ClientSecret: registration.ClientSecret,
+		Scopes:       []string{"read"},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
+	}
+	_, err = conf.Token(context.Background())
+	a.NoError(err, "Registered Client can authenticate")
+
+	configurationURL := fmt.Sprintf("%s/oauth2/register/%s", srv.URL, registration.ClientID)
+
+	res = sendRegistration(a, http.MethodGet, configurationURL, registration.RegistrationAccessToken, nil)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var read RegistrationResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&read))
+	a.Equal(registration.ClientID, read.ClientID)
+	a.Empty(read.ClientSecret, "Secret is only returned when registered")
+	a.Equal("Partner", read.ClientName)
+
+	res = sendRegistration(a, http.MethodPut, configurationURL, registration.RegistrationAccessToken, map[string]interface{}{
+		"client_id":     registration.ClientID,
+		"client_secret": "incorrect-password",
+	})
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+	a.Equal("invalid_client_metadata", decodeError(a, res))
+
+	res = sendRegistration(a, http.MethodPut, configurationURL, registration.RegistrationAccessToken, map[string]interface{}{
+		"client_id":     registration.ClientID,
+		"client_secret": registration.ClientSecret,
+		"client_name":   "Renamed",
+		"scope":         "read",
+		"redirect_uris": []string{"https://partner.example.com/callback"},
+		"grant_types":   []string{client.AuthorizationCode, client.RefreshToken},
+	})
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var updated RegistrationResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&updated))
+	a.Equal("Renamed", updated.ClientName)
+	a.Equal("read", updated.Scope)
+	a.Equal([]string{client.AuthorizationCode, client.RefreshToken}, updated.GrantTypes)
+	a.Equal([]string{"code"}, updated.ResponseTypes)
+
+	res = sendRegistration(a, http.MethodDelete, configurationURL, registration.RegistrationAccessToken, nil)
+	a.Equal(http.StatusNoContent, res.StatusCode)
+
+	res = sendRegistration(a, http.MethodGet, configurationURL, registration.RegistrationAccessToken, nil)
+	a.Equal(http.StatusUnauthorized, res.StatusCode, "Client is deleted")
+}
+
+func TestRegistrationInvalidToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	res := sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), "invalid", map[string]interface{}{})
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	a.Equal(`Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+
+	c := createClient(a, s.db)
+	res = sendRegistration(a, http.MethodGet, fmt.Sprintf("%s/oauth2/register/%s", srv.URL, c.ID), "invalid", nil)
+	a.Equal(http.StatusUnauthorized, res.StatusCode, "Clients created by the admin API can't be managed")
+}
+
+func TestRegistrationInvalidMetadata(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	initialAccessToken, _, err := account.NewInitialAccessTokenRepository(s.db).Create(context.Background(), uuid.NewString(), time.Hour, 1)
+	a.NoError(err)
+
+	res := sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), initialAccessToken, map[string]interface{}{
+		"redirect_uris": []string{"http://partner.example.com/callback"},
+	})
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+
+	body := map[string]interface{}{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal("invalid_redirect_uri", body["error"])
+
+	res = sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), initialAccessToken, map[string]interface{}{
+		"software_statement": "not-a-jwt",
+	})
+	a.Equal(http.StatusBadRequest, res.StatusCode)
+
+	body = map[string]interface{}{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal("unapproved_software_statement", body["error"], "No trusted publishers are configured")
+
+	res = sendRegistration(a, http.MethodPost, fmt.Sprintf("%s/oauth2/register", srv.URL), initialAccessToken, map[string]interface{}{})
+	a.Equal(http.StatusCreated, res.StatusCode, "Rejected registrations don't count against the initial access token")
+}
+
+func TestIntrospectActiveToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, client.ID)
+
+	res := introspect(a, srv.URL, client.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+
+	a.Equal(true, body["active"])
+	a.Equal(client.ID, body["sub"])
+	a.Equal(client.ID, body["client_id"])
+	a.Equal(client.AccountID, body["account_id"])
+	a.Equal(client.AndroidID, body["android_id"])
+	a.WithinDuration(token.Expiry, test.ParseUnix(body["exp"].(float64)), time.Second)
+}
+
+func TestIntrospectTokenOfDisabledClient(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+	introspecting := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, c.ID)
+
+	disabled := true
+	_, err := client.NewRepository(s.db).Update(context.Background(), client.UpdateOptions{AccountID: c.AccountID, ID: c.ID, Disabled: &disabled})
+	a.NoError(err)
+
+	res := introspect(a, srv.URL, introspecting.ID, testSecret, token.AccessToken)
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(map[string]interface{}{"active": false}, body, "Tokens of a disabled Client are inactive")
+
+	res = postClientCredentialsFrom(a, srv.URL, c.ID, testSecret, uuid.NewString())
+	a.Equal(http.StatusUnauthorized, res.StatusCode, "A disabled Client can't authenticate")
+}
+
+func TestIntrospectTokenOfDeletedClient(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	c := createClient(a, s.db)
+	introspecting := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, c.ID)
+
+	a.NoError(client.NewRepository(s.db).Delete(context.Background(), client.DeleteOptions{AccountID: c.AccountID, ID: c.ID}))
+
+	res := introspect(a, srv.URL, introspecting.ID, testSecret, token.AccessToken)
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(map[string]interface{}{"active": false}, body, "Tokens of a deleted Client are inactive")
+}
+
+func TestIntrospectInvalidToken(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+
+	res := introspect(a, srv.URL, client.ID, testSecret, "not-a-token")
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+
+	a.Equal(map[string]interface{}{"active": false}, body)
+}
+
+func TestIntrospectInvalidClientCredentials(t *testing.T) {
+	a := assert.New(t)
+	s := setup(t)
+
+	srv := httptest.NewServer(s.r)
+	defer srv.Close()
+
+	client := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, client.ID)
+
+	res := introspect(a, srv.URL, client.ID, "incorrect-password", token.AccessToken)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestIntrospectNonexistentClient(t *testing.T) {
 	a := assert.New(t)
 	s := setup(t)
 
-	s.r.GET("/callback", createCallbackHandler(a))
-
 	srv := httptest.NewServer(s.r)
 	defer srv.Close()
 
-	client := createClient(a, s.db)
+	c := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, c.ID)
 
-	config := newOAuth2Config(client.ID, srv.URL)
+	res := introspect(a, srv.URL, c.ID, "incorrect-password", token.AccessToken)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	knownBody := utils.Must(io.ReadAll(res.Body))
 
-	url := config.AuthCodeURL("state")
-	response, err := http.Get(url)
-	a.Nil(err)
-	a.Equal(http.StatusNotFound, response.StatusCode)
+	res = introspect(a, srv.URL, uuid.NewString(), "incorrect-password", token.AccessToken)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	a.Equal(string(knownBody), string(utils.Must(io.ReadAll(res.Body))), "The same error as incorrect credentials")
+
+	public := createClientWithOptions(a, s.db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.None,
+		RedirectURIs:            []string{"https://app.kidsloop.live/callback"},
+	})
+	res = introspect(a, srv.URL, public.ID, "incorrect-password", token.AccessToken)
+	a.Equal(http.StatusUnauthorized, res.StatusCode)
+	a.Equal(string(knownBody), string(utils.Must(io.ReadAll(res.Body))), "A Client without a secret")
 }
 
-func TestClientCredentialsInvalidCredentials(t *testing.T) {
+func TestRevokeToken(t *testing.T) {
 	a := assert.New(t)
 	s := setup(t)
 
@@ -77,36 +1914,39 @@ func TestClientCredentialsInvalidCredentials(t *testing.T) {
 	defer srv.Close()
 
 	client := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, client.ID)
 
-	conf := clientcredentials.Config{
-		ClientID:     client.ID,
-		ClientSecret: "incorrect-password",
-		Scopes:       []string{""},
-		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
-	}
+	res := revoke(a, srv.URL, client.ID, testSecret, token.AccessToken)
+	a.Equal(http.StatusOK, res.StatusCode)
 
-	_, err := conf.Token(context.Background())
-	a.Error(err)
+	res = introspect(a, srv.URL, client.ID, testSecret, token.AccessToken)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(map[string]interface{}{"active": false}, body, "Revoked token is inactive")
 }
 
-func TestClientCredentialsNonexistentClient(t *testing.T) {
+func TestRevokeTokenOfAnotherClient(t *testing.T) {
+	a := assert.New(t)
 	s := setup(t)
 
 	srv := httptest.NewServer(s.r)
 	defer srv.Close()
 
-	conf := clientcredentials.Config{
-		ClientID:     uuid.NewString(),
-		ClientSecret: "pa$$word",
-		Scopes:       []string{""},
-		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
-	}
+	owner := createClient(a, s.db)
+	other := createClient(a, s.db)
+	token := fetchToken(a, srv.URL, owner.ID)
 
-	_, err := conf.Token(context.Background())
-	assert.Error(t, err)
+	revoke(a, srv.URL, other.ID, testSecret, token.AccessToken)
+
+	res := introspect(a, srv.URL, owner.ID, testSecret, token.AccessToken)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	a.Equal(true, body["active"], "Token can only be revoked by the Client it was issued to")
 }
 
-func TestClientCredentialsInvalidOfflineAccess(t *testing.T) {
+func TestRevokeInvalidToken(t *testing.T) {
 	a := assert.New(t)
 	s := setup(t)
 
@@ -115,47 +1955,65 @@ func TestClientCredentialsInvalidOfflineAccess(t *testing.T) {
 
 	client := createClient(a, s.db)
 
-	conf := clientcredentials.Config{
-		ClientID:     client.ID,
-		ClientSecret: testSecret,
-		Scopes:       []string{"offline_access"},
-		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
-	}
-
-	tokenResponse, err := conf.Token(context.Background())
-	a.Error(err)
-	a.Nil(tokenResponse)
+	res := revoke(a, srv.URL, client.ID, testSecret, "not-a-token")
+	a.Equal(http.StatusOK, res.StatusCode)
 }
 
-func TestClientCredentialsValidAccessToken(t *testing.T) {
+func TestMetadata(t *testing.T) {
 	a := assert.New(t)
 	s := setup(t)
 
 	srv := httptest.NewServer(s.r)
 	defer srv.Close()
 
-	client := createClient(a, s.db)
-
-	conf := clientcredentials.Config{
-		ClientID:     client.ID,
-		ClientSecret: testSecret,
-		Scopes:       []string{""},
-		TokenURL:     fmt.Sprintf("%s/oauth2/token", srv.URL),
-	}
+	for _, path := range []string{"/.well-known/oauth-authorization-server", "/.well-known/openid-configuration"} {
+		res, err := http.Get(srv.URL + path)
+		a.NoError(err)
+		a.Equal(http.StatusOK, res.StatusCode, path)
 
-	tokenResponse, err := conf.Token(context.Background())
-	a.NoError(err)
+		var metadata Metadata
+		a.NoError(json.NewDecoder(res.Body).Decode(&metadata))
+		res.Body.Close()
 
-	a.Equal("bearer", tokenResponse.TokenType)
+		a.Equal(ISSUER, metadata.Issuer)
+		a.Equal(TokenURL, metadata.TokenEndpoint)
+		a.Equal(ISSUER+"/.well-known/jwks.json", metadata.JWKSURI)
+		a.Equal(ISSUER+"/oauth2/auth", metadata.AuthorizationEndpoint)
+		a.Equal(ISSUER+"/oauth2/device/code", metadata.DeviceAuthorizationEndpoint)
+		a.Equal(ISSUER+"/oauth2/introspect", metadata.IntrospectionEndpoint)
+		a.Equal(ISSUER+"/oauth2/revoke", metadata.RevocationEndpoint)
+		a.Equal(ISSUER+"/oauth2/register", metadata.RegistrationEndpoint)
+		a.ElementsMatch(client.SupportedGrantTypes(), metadata.GrantTypesSupported)
+		a.Equal([]string{"code"}, metadata.ResponseTypesSupported)
+		a.Equal([]string{"S256"}, metadata.CodeChallengeMethodsSupported)
+		a.Contains(metadata.TokenEndpointAuthMethodsSupported, client.PrivateKeyJWT)
+		a.Contains(metadata.TokenEndpointAuthSigningAlgValuesSupported, "RS256")
+		a.Equal(DPoPSigningAlgs, metadata.DPoPSigningAlgValuesSupported)
+		// Required by OpenID Connect discovery
+		a.Equal([]string{"public"}, metadata.SubjectTypesSupported)
+		a.Equal([]string{"RS256"}, metadata.IDTokenSigningAlgValuesSupported)
+	}
+}
 
-	assertTokenPayloadValid(a, tokenResponse, client)
+func setup(t *testing.T) *Setup {
+	return setupWithOptions(t, ProviderOptions{})
+}
 
-	assertTokenHeaderValid(a, tokenResponse.AccessToken)
+func setupWithOptions(t *testing.T, opts ProviderOptions) *Setup {
+	return setupWithHandlerOptions(t, opts, HandlerOptions{SecretCache: opts.SecretCache})
+}
 
-	assertTokenSignatureValid(t, tokenResponse.AccessToken)
+// Locks out Clients at every endpoint, trusting the source IP of `X-Forwarded-For`
+func setupWithLockout(t *testing.T, lockouts *lockout.Store) *Setup {
+	return setupWithHandlerOptions(t,
+		ProviderOptions{Lockout: lockouts, TrustForwardedFor: true},
+		HandlerOptions{Lockout: lockouts, TrustForwardedFor: true},
+	)
 }
 
-func setup(t *testing.T) *Setup {
+// The Consent and DeviceVerification strategies of `handlerOpts` are always a `SessionConsentStrategy`,
+// which trusts sessions signed by `testLoginKey`
+func setupWithHandlerOptions(t *testing.T, opts ProviderOptions, handlerOpts HandlerOptions) *Setup {
 	db, err := storage.NewDynamoDBClient()
 	if err != nil {
 		t.Fatalf("err: %v", err)
@@ -163,13 +2021,21 @@ func setup(t *testing.T) *Setup {
 	// Temporarily chdir to project root, otherwise relative PEM filepaths
 	// can't be loaded
 	defer test.Chdir(t, "../..")()
-	p, err := NewProvider(db)
+	p, err := NewProvider(db, opts)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
 	r := httprouter.New()
-	NewHandler(p).SetupRouter(r)
+	consent := &SessionConsentStrategy{
+		Login: &LoginSession{
+			Keys: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{testLoginKey.Public()}},
+		},
+		CSRFKey: []byte("csrf"),
+	}
+	handlerOpts.Consent = consent
+	handlerOpts.DeviceVerification = consent
+	NewHandler(p, db, handlerOpts).SetupRouter(r)
 
 	return &Setup{
 		db,
@@ -178,17 +2044,233 @@ func setup(t *testing.T) *Setup {
 }
 
 func createClient(a *assert.Assertions, db *dynamodb.Client) *client.Client {
+	return createClientWithOptions(a, db, client.CreateOptions{})
+}
+
+// Create a Client with `testSecret`, and defaults for any other options which aren't specified
+func createClientWithOptions(a *assert.Assertions, db *dynamodb.Client, opts client.CreateOptions) *client.Client {
+	if opts.Secret == "" && opts.TokenEndpointAuthMethod != client.None {
+		opts.Secret = testSecret
+	}
+	if opts.Name == "" {
+		opts.Name = "Client"
+	}
+	if opts.AccountID == "" {
+		opts.AccountID = uuid.NewString()
+	}
+	if opts.AndroidID == "" {
+		opts.AndroidID = uuid.NewString()
+	}
+
 	r := client.NewRepository(db)
-	client, err := r.Create(context.Background(), client.CreateOptions{
-		Secret:    testSecret,
-		Name:      "Client",
-		AccountID: uuid.NewString(),
-		AndroidID: uuid.NewString(),
-	})
+	client, err := r.Create(context.Background(), opts)
 	a.NoError(err)
 	return client
 }
 
+func fetchToken(a *assert.Assertions, baseURL string, clientID string) *oauth2.Token {
+	conf := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: testSecret,
+		Scopes:       []string{""},
+		TokenURL:     fmt.Sprintf("%s/oauth2/token", baseURL),
+	}
+
+	token, err := conf.Token(context.Background())
+	a.NoError(err)
+	return token
+}
+
+func introspect(a *assert.Assertions, baseURL string, clientID string, clientSecret string, token string) *http.Response {
+	return postForm(a, fmt.Sprintf("%s/oauth2/introspect", baseURL), clientID, clientSecret, url.Values{"token": {token}})
+}
+
+func revoke(a *assert.Assertions, baseURL string, clientID string, clientSecret string, token string) *http.Response {
+	return postForm(a, fmt.Sprintf("%s/oauth2/revoke", baseURL), clientID, clientSecret, url.Values{"token": {token}})
+}
+
+// A request to the registration endpoint, authorized by an initial or registration access token
+func sendRegistration(a *assert.Assertions, method string, endpoint string, token string, body interface{}) *http.Response {
+	var reader io.Reader
+	if body != nil {
+		bytes, err := json.Marshal(body)
+		a.NoError(err)
+		reader = strings.NewReader(string(bytes))
+	}
+
+	req, err := http.NewRequest(method, endpoint, reader)
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+func postForm(a *assert.Assertions, endpoint string, clientID string, clientSecret string, form url.Values) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+func postFormWithDPoP(a *assert.Assertions, endpoint string, clientID string, form url.Values, proof string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(DPoPHeader, proof)
+	req.SetBasicAuth(clientID, testSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+// A certificate for `subject` (only the CN and O are used), signed by `parent` or otherwise self-signed
+func generateCertificate(a *assert.Assertions, subject string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+
+	name := pkix.Name{}
+	for _, rdn := range strings.Split(subject, ",") {
+		kv := strings.SplitN(rdn, "=", 2)
+		switch kv[0] {
+		case "CN":
+			name.CommonName = kv[1]
+		case "O":
+			name.Organization = []string{kv[1]}
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               name,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	issuer, issuerKey := template, interface{}(key)
+	if parent != nil {
+		issuer, issuerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	a.NoError(err)
+	leaf, err := x509.ParseCertificate(der)
+	a.NoError(err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// A TLS server which requests client certificates, and a client which presents `cert`
+func newTLSServer(handler http.Handler, cert tls.Certificate) (*httptest.Server, *http.Client) {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+
+	httpClient := srv.Client()
+	httpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return srv, httpClient
+}
+
+func postTLSClientCredentials(a *assert.Assertions, httpClient *http.Client, baseURL string, clientID string) *http.Response {
+	res, err := httpClient.PostForm(baseURL+"/oauth2/token", url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {clientID},
+	})
+	a.NoError(err)
+	return res
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// A `client_credentials` request which a trusted proxy forwarded from `ip`
+func postClientCredentialsFrom(a *assert.Assertions, baseURL string, clientID string, clientSecret string, ip string) *http.Response {
+	return postFormFrom(a, fmt.Sprintf("%s/oauth2/token", baseURL), clientID, clientSecret, url.Values{"grant_type": {"client_credentials"}}, ip)
+}
+
+// A request from the source IP `ip`, which requires `TrustForwardedFor`
+func postFormFrom(a *assert.Assertions, endpoint string, clientID string, clientSecret string, form url.Values, ip string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", ip)
+	req.SetBasicAuth(clientID, clientSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+func postDPoPClientCredentials(a *assert.Assertions, baseURL string, clientID string, proof string) *http.Response {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/oauth2/token", baseURL), strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(DPoPHeader, proof)
+	req.SetBasicAuth(clientID, testSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+func generateJWKS(a *assert.Assertions) (*jose.JSONWebKey, *client.JSONWebKeySet) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+
+	key := &jose.JSONWebKey{Key: privateKey, KeyID: uuid.NewString(), Algorithm: "RS256", Use: "sig"}
+	public := key.Public()
+
+	return key, &client.JSONWebKeySet{
+		JSONWebKeySet: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{public}},
+	}
+}
+
+func signClientAssertion(a *assert.Assertions, key *jose.JSONWebKey, clientID string) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	a.NoError(err)
+
+	now := time.Now()
+	assertion, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{TokenURL},
+		ID:       uuid.NewString(),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Minute * 5)),
+	}).CompactSerialize()
+	a.NoError(err)
+
+	return assertion
+}
+
+func postClientAssertion(a *assert.Assertions, baseURL string, assertion string) *http.Response {
+	res, err := http.PostForm(fmt.Sprintf("%s/oauth2/token", baseURL), url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	})
+	a.NoError(err)
+	return res
+}
+
 func newOAuth2Config(clientID string, baseURL string) oauth2.Config {
 	return oauth2.Config{
 		ClientID:     clientID,
@@ -203,6 +2285,247 @@ func newOAuth2Config(clientID string, baseURL string) oauth2.Config {
 	}
 }
 
+// An OAuth2 config for a new public Client, with a redirect URI of `/callback`, which is allowed
+// and requests `scopes`
+func newPublicOAuth2Config(a *assert.Assertions, db *dynamodb.Client, baseURL string, scopes ...string) oauth2.Config {
+	return newPublicOAuth2ConfigWithAudience(a, db, baseURL, "", scopes...)
+}
+
+// As `newPublicOAuth2Config`, but also requesting `audience` (if not empty), which is allowed
+func newPublicOAuth2ConfigWithAudience(a *assert.Assertions, db *dynamodb.Client, baseURL string, audience string, scopes ...string) oauth2.Config {
+	config := newOAuth2Config("", baseURL)
+	config.Scopes = scopes
+
+	opts := client.CreateOptions{
+		TokenEndpointAuthMethod: client.None,
+		RedirectURIs:            []string{config.RedirectURL},
+		AllowedScopes:           scopes,
+	}
+	if audience != "" {
+		opts.AllowedAudiences = []string{audience}
+		config.Endpoint.AuthURL += "?" + url.Values{"audience": {audience}}.Encode()
+	}
+	client := createClientWithOptions(a, db, opts)
+
+	config.ClientID = client.ID
+	config.ClientSecret = ""
+	config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	return config
+}
+
+func generateCodeVerifier(a *assert.Assertions) string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	a.NoError(err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Makes an authorization request (with a S256 code challenge, unless `verifier` is empty) as the
+// logged in `accountID`, approving every requested scope, without following the redirect
+func authorize(a *assert.Assertions, config oauth2.Config, accountID string, verifier string) *http.Response {
+	res := requestAuthorization(a, config, accountID, verifier)
+	if res.StatusCode != http.StatusOK {
+		return res
+	}
+	return submitConsent(a, res, accountID, url.Values{"consent": {"approve"}, "granted_scope": config.Scopes})
+}
+
+// Makes an authorization request, which is answered by the consent page if `accountID` is logged in
+func requestAuthorization(a *assert.Assertions, config oauth2.Config, accountID string, verifier string) *http.Response {
+	opts := []oauth2.AuthCodeOption{}
+	if verifier != "" {
+		challenge := sha256.Sum256([]byte(verifier))
+		opts = append(
+			opts,
+			oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, config.AuthCodeURL(testState, opts...), nil)
+	a.NoError(err)
+	if accountID != "" {
+		req.AddCookie(sessionCookie(a, testLoginKey, accountID, accountID))
+	}
+
+	res, err := noRedirectClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+var (
+	hiddenInputPattern = regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)">`)
+	formActionPattern  = regexp.MustCompile(`<form method="post" action="([^"]*)">`)
+)
+
+// Submits the consent page (along with `decision`) as `accountID`, without following the redirect
+func submitConsent(a *assert.Assertions, page *http.Response, accountID string, decision url.Values) *http.Response {
+	a.Equal(http.StatusOK, page.StatusCode)
+	a.Equal("DENY", page.Header.Get("X-Frame-Options"))
+	body, err := io.ReadAll(page.Body)
+	a.NoError(err)
+	page.Body.Close()
+
+	form := url.Values{}
+	for _, input := range hiddenInputPattern.FindAllStringSubmatch(string(body), -1) {
+		form.Add(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+	}
+	for name, values := range decision {
+		form[name] = values
+	}
+
+	action := formActionPattern.FindStringSubmatch(string(body))
+	a.Len(action, 2)
+	target, err := page.Request.URL.Parse(html.UnescapeString(action[1]))
+	a.NoError(err)
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessionCookie(a, testLoginKey, accountID, accountID))
+
+	res, err := noRedirectClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Returns the authorization code from the redirect to the Client
+func authorizeCode(a *assert.Assertions, response *http.Response) string {
+	a.Equal(http.StatusFound, response.StatusCode)
+
+	location, err := response.Location()
+	a.NoError(err)
+	a.Equal(testState, location.Query().Get("state"))
+
+	code := location.Query().Get("code")
+	a.NotEmpty(code)
+	return code
+}
+
+// Completes the authorization code grant, requesting a refresh token
+func fetchRefreshableToken(a *assert.Assertions, config oauth2.Config) *oauth2.Token {
+	verifier := generateCodeVerifier(a)
+	code := authorizeCode(a, authorize(a, config, uuid.NewString(), verifier))
+
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+	a.NotEmpty(token.RefreshToken)
+	return token
+}
+
+func refresh(a *assert.Assertions, config oauth2.Config, refreshToken string) *http.Response {
+	res, err := http.PostForm(config.Endpoint.TokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {config.ClientID},
+	})
+	a.NoError(err)
+	return res
+}
+
+func decodeToken(a *assert.Assertions, res *http.Response) *oauth2.Token {
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	a.NoError(json.NewDecoder(res.Body).Decode(&token))
+	return &oauth2.Token{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}
+}
+
+// An access token issued to a public Client, on behalf of a new end-user
+func fetchAccountToken(a *assert.Assertions, config oauth2.Config) *oauth2.Token {
+	verifier := generateCodeVerifier(a)
+	code := authorizeCode(a, authorize(a, config, uuid.NewString(), verifier))
+
+	token, err := config.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	a.NoError(err)
+	return token
+}
+
+func exchangeToken(a *assert.Assertions, baseURL string, clientID string, subjectToken string, form url.Values) *http.Response {
+	form.Set("grant_type", client.TokenExchange)
+	form.Set("subject_token", subjectToken)
+	form.Set("subject_token_type", AccessTokenType)
+	return postForm(a, baseURL+"/oauth2/token", clientID, testSecret, form)
+}
+
+func createDeviceClient(a *assert.Assertions, db *dynamodb.Client) *client.Client {
+	return createClientWithOptions(a, db, client.CreateOptions{
+		TokenEndpointAuthMethod: client.None,
+		GrantTypes:              []string{client.DeviceCode, client.RefreshToken},
+	})
+}
+
+func requestDeviceCode(a *assert.Assertions, baseURL string, clientID string) *DeviceCodeResponse {
+	res, err := http.PostForm(baseURL+"/oauth2/device/code", url.Values{"client_id": {clientID}})
+	a.NoError(err)
+	a.Equal(http.StatusOK, res.StatusCode)
+	defer res.Body.Close()
+
+	var device DeviceCodeResponse
+	a.NoError(json.NewDecoder(res.Body).Decode(&device))
+	return &device
+}
+
+func pollDeviceToken(a *assert.Assertions, baseURL string, clientID string, deviceCode string) *http.Response {
+	res, err := http.PostForm(baseURL+"/oauth2/token", url.Values{
+		"client_id":   {clientID},
+		"grant_type":  {client.DeviceCode},
+		"device_code": {deviceCode},
+	})
+	a.NoError(err)
+	return res
+}
+
+// Opens the verification URI (with the user code) and approves the device. An empty `accountID`
+// means the end-user isn't logged in.
+func verifyDevice(a *assert.Assertions, baseURL string, userCode string, accountID string) *http.Response {
+	res := requestDeviceVerification(a, baseURL, userCode, accountID)
+	if res.StatusCode != http.StatusOK {
+		return res
+	}
+	return submitConsent(a, res, accountID, url.Values{"consent": {"approve"}})
+}
+
+// Opens the verification URI, which is answered by the consent page if `accountID` is logged in
+func requestDeviceVerification(a *assert.Assertions, baseURL string, userCode string, accountID string) *http.Response {
+	return requestDeviceVerificationFrom(a, baseURL, userCode, accountID, "")
+}
+
+// Opens the verification URI from the source IP `ip` (if set), see `setupWithLockout`
+func requestDeviceVerificationFrom(a *assert.Assertions, baseURL string, userCode string, accountID string, ip string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/oauth2/device/verify?"+url.Values{"user_code": {userCode}}.Encode(), nil)
+	a.NoError(err)
+	if accountID != "" {
+		req.AddCookie(sessionCookie(a, testLoginKey, accountID, accountID))
+	}
+	if ip != "" {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	res, err := noRedirectClient.Do(req)
+	a.NoError(err)
+	return res
+}
+
+func decodeError(a *assert.Assertions, res *http.Response) string {
+	defer res.Body.Close()
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	a.NoError(json.NewDecoder(res.Body).Decode(&body))
+	return body.Error
+}
+
 func createCallbackHandler(a *assert.Assertions) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		reqDump, err := httputil.DumpRequestOut(r, true)
@@ -217,7 +2540,7 @@ func assertTokenPayloadValid(a *assert.Assertions, tokenResponse *oauth2.Token,
 	claims, err := crypto.DecodeJWTPayload(tokenResponse.AccessToken)
 	a.NoError(err)
 
-	a.Equal([]interface{}{}, claims["aud"], "audience is empty")
+	a.Equal([]interface{}{ISSUER}, claims["aud"], "audience defaults to the platform")
 
 	now := time.Now()
 	exp := test.ParseUnix(claims["exp"].(float64))
@@ -229,20 +2552,35 @@ func assertTokenPayloadValid(a *assert.Assertions, tokenResponse *oauth2.Token,
 	a.Equal("https://platform.kidsloop.live", claims["iss"])
 	a.True(utils.IsUUID(claims["jti"].(string)))
 	a.Equal([]interface{}{}, claims["scp"], "scopes is empty")
+	a.Equal("", claims["scope"])
 	a.Equal(client.ID, claims["sub"])
+	a.Equal(client.ID, claims["client_id"])
+	a.NotContains(claims, "auth_time", "no end-user authenticated")
 
 	a.Equal(client.AccountID, claims["account_id"])
 	a.Equal(client.AndroidID, claims["android_id"])
 	// TODO `subscription_id` claim
 }
 
-func assertTokenHeaderValid(a *assert.Assertions, token string) {
-	headers, err := crypto.DecodeJWTHeader(token)
+func assertTokenLifespan(a *assert.Assertions, token *oauth2.Token, lifespan time.Duration) {
+	a.WithinDuration(time.Now().Add(lifespan), token.Expiry, time.Second*5)
+
+	claims, err := crypto.DecodeJWTPayload(token.AccessToken)
 	a.NoError(err)
+	a.InDelta(lifespan.Seconds(), claims["exp"].(float64)-claims["iat"].(float64), 5)
+}
+
+func assertTokenHeaderValid(t *testing.T, token string) {
+	defer test.Chdir(t, "../..")()
+	jwks, err := crypto.JWKS()
+	assert.NoError(t, err)
+
+	headers, err := crypto.DecodeJWTHeader(token)
+	assert.NoError(t, err)
 
-	a.Equal("RS256", headers["alg"])
-	a.Equal("JWT", headers["typ"])
-	a.Equal(crypto.KID, headers["kid"])
+	assert.Equal(t, "RS256", headers["alg"])
+	assert.Equal(t, AccessTokenJWTType, headers["typ"])
+	assert.Equal(t, jwks.Keys[0].KeyID, headers["kid"])
 }
 
 func assertTokenSignatureValid(t *testing.T, rawToken string) {
@@ -0,0 +1,185 @@
+package oauth2
+
+import (
+	"context"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+)
+
+// Validates our (stateless) JWT access tokens for the introspection endpoint
+//
+// Unlike `fosite.StatelessJWTValidator` this also checks the token hasn't been revoked and its
+// Client still exists (and isn't disabled), so that introspection reflects server-side state rather than just the signature
+//
+// Opaque access tokens are looked up by their signature instead, see `client.OpaqueTokenFormat`
+type TokenIntrospector struct {
+	JWTStrategy         jwt.JWTStrategy
+	AccessTokenStrategy oauth2.AccessTokenStrategy
+	Store               *Store
+	ScopeStrategy       fosite.ScopeStrategy
+}
+
+var _ fosite.TokenIntrospector = (*TokenIntrospector)(nil)
+
+func TokenIntrospectionFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &TokenIntrospector{
+		JWTStrategy:         strategy.(jwt.JWTStrategy),
+		AccessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+		Store:               storage.(*Store),
+		ScopeStrategy:       config.GetScopeStrategy(),
+	}
+}
+
+func (i *TokenIntrospector) IntrospectToken(ctx context.Context, token string, tokenUse fosite.TokenUse, accessRequest fosite.AccessRequester, scopes []string) (fosite.TokenUse, error) {
+	if tokenUse != "" && tokenUse != fosite.AccessToken {
+		// Refresh tokens etc. are not JWTs, so leave them to any other registered introspector
+		return "", errors.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	if !isJWT(token) {
+		return i.introspectOpaqueToken(ctx, token, accessRequest, scopes)
+	}
+
+	claims, client, err := validateAccessToken(ctx, i.JWTStrategy, i.Store, token)
+	if err != nil {
+		return "", err
+	}
+
+	for _, scope := range scopes {
+		if !i.ScopeStrategy(claims.Scope, scope) {
+			return fosite.AccessToken, errors.WithStack(fosite.ErrInvalidScope.WithHintf("The request scope '%s' has not been granted.", scope))
+		}
+	}
+
+	// Everything else, including any subscription, is from the token's claims
+	session := NewSession(claims.Subject)
+	if err := session.WithClient(ctx, client, nil); err != nil {
+		return "", err
+	}
+	session.WithClaims(claims)
+	session.SetExpiresAt(fosite.AccessToken, claims.ExpiresAt)
+
+	accessRequest.Merge(&fosite.Request{
+		ID:                claims.JTI,
+		RequestedAt:       claims.IssuedAt,
+		Client:            client,
+		RequestedScope:    claims.Scope,
+		GrantedScope:      claims.Scope,
+		RequestedAudience: claims.Audience,
+		GrantedAudience:   claims.Audience,
+		Form:              make(map[string][]string),
+		Session:           session,
+	})
+
+	return fosite.AccessToken, nil
+}
+
+// The stored request has everything needed, but the token is inactive if its refresh token family
+// has since been revoked
+func (i *TokenIntrospector) introspectOpaqueToken(ctx context.Context, token string, accessRequest fosite.AccessRequester, scopes []string) (fosite.TokenUse, error) {
+	request, err := i.Store.GetAccessTokenSession(ctx, i.AccessTokenStrategy.AccessTokenSignature(token), nil)
+	if err != nil {
+		if errors.Is(err, fosite.ErrNotFound) || errors.Is(err, fosite.ErrInactiveToken) {
+			return "", errors.WithStack(fosite.ErrInactiveToken.WithWrap(err).WithDebug(err.Error()))
+		}
+		return "", errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if err := i.AccessTokenStrategy.ValidateAccessToken(ctx, request, token); err != nil {
+		return "", errors.WithStack(fosite.ErrInactiveToken.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	revoked, err := i.Store.refreshTokenFamilies.Contains(ctx, request.GetID())
+	if err != nil {
+		return "", errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+	if revoked {
+		return "", errors.WithStack(fosite.ErrInactiveToken.WithHint("The token has been revoked."))
+	}
+
+	for _, scope := range scopes {
+		if !i.ScopeStrategy(request.GetGrantedScopes(), scope) {
+			return fosite.AccessToken, errors.WithStack(fosite.ErrInvalidScope.WithHintf("The request scope '%s' has not been granted.", scope))
+		}
+	}
+
+	accessRequest.Merge(request)
+
+	// Like the `aud` of a JWT, see `Session.GetJWTClaims`
+	if session, ok := request.GetSession().(*Session); ok && len(session.Resources) > 0 {
+		if r, ok := accessRequest.(*fosite.AccessRequest); ok {
+			r.GrantedAudience = session.Resources
+		}
+	}
+
+	return fosite.AccessToken, nil
+}
+
+// Decodes one of our JWT access tokens, checking it hasn't been revoked and its Client still exists (and isn't disabled)
+//
+// Errors are `fosite.ErrInactiveToken`, or `fosite.ErrServerError` if the token's state can't be checked
+func validateAccessToken(ctx context.Context, strategy jwt.JWTStrategy, store *Store, token string) (jwt.JWTClaims, fosite.Client, error) {
+	claims := jwt.JWTClaims{}
+
+	t, err := strategy.Decode(ctx, token)
+	if err != nil {
+		return claims, nil, errors.WithStack(fosite.ErrInactiveToken.WithWrap(err).WithDebug(err.Error()))
+	}
+	if err := t.Claims.Valid(); err != nil {
+		return claims, nil, errors.WithStack(fosite.ErrInactiveToken.WithWrap(err).WithDebug(err.Error()))
+	}
+	if !isAccessTokenType(t.Header) {
+		return claims, nil, errors.WithStack(fosite.ErrInactiveToken.WithHint("The token is not an access token."))
+	}
+
+	claims.FromMapClaims(t.Claims)
+	claims.Audience = audienceFromClaims(t.Claims)
+
+	revoked, err := store.IsJTIRevoked(ctx, claims.JTI)
+	if err != nil {
+		return claims, nil, errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+	if revoked {
+		return claims, nil, errors.WithStack(fosite.ErrInactiveToken.WithHint("The token has been revoked."))
+	}
+
+	// The Client may have been deleted (or disabled) since the token was issued
+	client, err := store.GetClient(ctx, clientIDFromClaims(claims))
+	if err != nil {
+		return claims, nil, errors.WithStack(fosite.ErrInactiveToken.WithHint("The OAuth 2.0 Client which the token was issued to no longer exists or is disabled."))
+	}
+
+	return claims, client, nil
+}
+
+// The Client the token was issued to, which is only the `sub` if it wasn't on behalf of an end-user
+func clientIDFromClaims(claims jwt.JWTClaims) string {
+	if clientID, ok := claims.Extra["client_id"].(string); ok && clientID != "" {
+		return clientID
+	}
+	// Tokens issued before the `client_id` claim was added
+	return claims.Subject
+}
+
+// `jwt.JWTClaims.FromMapClaims` doesn't handle an `aud` array decoded from JSON
+func audienceFromClaims(claims jwt.MapClaims) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []string:
+		return aud
+	case []interface{}:
+		audience := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+		return audience
+	}
+	return []string{}
+}
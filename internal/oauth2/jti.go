@@ -0,0 +1,83 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	tableName = "authentication"
+
+	// Access tokens which have been revoked
+	denylistNamespace = "Denylist"
+	// `client_assertion` JWTs which have already been used to authenticate
+	clientAssertionNamespace = "ClientAssertion"
+	// Refresh token families (identified by the ID of the original request) which have been revoked
+	refreshTokenFamilyNamespace = "RevokedRefreshTokenFamily"
+)
+
+var ErrJTIExists = errors.New("jti already exists")
+
+// A set of JWTs, identified by their `jti` claim (or any other ID with an expiry)
+//
+// Each item expires (via DynamoDB TTL) when the JWT itself would have, so the set only
+// ever contains JWTs which would otherwise still be valid
+type JTIStore struct {
+	dynamodb  *dynamodb.Client
+	namespace string
+}
+
+func NewJTIStore(dynamodbClient *dynamodb.Client, namespace string) *JTIStore {
+	return &JTIStore{
+		dynamodb:  dynamodbClient,
+		namespace: namespace,
+	}
+}
+
+// Returns `ErrJTIExists` if the JTI is already in the set, and hasn't yet expired
+func (s *JTIStore) Add(ctx context.Context, jti string, exp time.Time) error {
+	item := storage.Key(s.namespace, jti)
+	item[storage.TTLAttribute] = storage.TTLValue(exp)
+
+	expr, err := expression.NewBuilder().WithCondition(storage.AbsentOrExpired()).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = s.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+			return ErrJTIExists
+		}
+		return fmt.Errorf("dynamodb.PutItem %s: %w", s.namespace, err)
+	}
+
+	return nil
+}
+
+func (s *JTIStore) Contains(ctx context.Context, jti string) (bool, error) {
+	output, err := s.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            storage.Key(s.namespace, jti),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("dynamodb.GetItem %s: %w", s.namespace, err)
+	}
+
+	return output.Item != nil && !storage.Expired(output.Item), nil
+}
@@ -0,0 +1,73 @@
+package oauth2
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/account"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// The cap on every access token's lifespan, unless configured otherwise by `ProviderOptions`
+const defaultMaxAccessTokenLifespan = time.Hour * 24
+
+// Resolves how long a Client's access tokens last: its own `token_lifespan`, otherwise its
+// account's default, otherwise `Default`, but never longer than `Max`
+type TokenLifespans struct {
+	accounts *account.SettingsRepository
+	Default  time.Duration
+	Max      time.Duration
+}
+
+func (l *TokenLifespans) AccessTokenLifespan(ctx context.Context, c fosite.Client) (time.Duration, error) {
+	lifespan := l.Default
+
+	if custom, ok := c.(CustomFositeClient); ok {
+		if clientLifespan := custom.GetTokenLifespan(); clientLifespan > 0 {
+			lifespan = clientLifespan
+		} else {
+			settings, err := l.accounts.Get(ctx, custom.GetAccountID())
+			if err != nil {
+				return 0, err
+			}
+			if settings.TokenLifespan > 0 {
+				lifespan = time.Duration(settings.TokenLifespan) * time.Second
+			}
+		}
+	}
+
+	if lifespan > l.Max {
+		lifespan = l.Max
+	}
+	return lifespan, nil
+}
+
+// Overrides the access token expiry set by a grant handler (from `compose.Config.AccessTokenLifespan`)
+// with that of the Client, see `TokenLifespans`
+//
+// fosite calls `HandleTokenEndpointRequest` before generating the token in `PopulateTokenEndpointResponse`,
+// so wrapping the former is enough for both the token and its `expires_in`
+type TokenLifespanHandler struct {
+	fosite.TokenEndpointHandler
+	Lifespans *TokenLifespans
+}
+
+func (h *TokenLifespanHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
+	if err := h.TokenEndpointHandler.HandleTokenEndpointRequest(ctx, request); err != nil {
+		return err
+	}
+
+	lifespan, err := h.Lifespans.AccessTokenLifespan(ctx, request.GetClient())
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	session, ok := request.GetSession().(*Session)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("Session is not an oauth2.Session."))
+	}
+	session.WithLifespan(lifespan)
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package oauth2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessTokenLifespanOfClient(t *testing.T) {
+	a := assert.New(t)
+	lifespans := &TokenLifespans{Default: time.Minute * 15, Max: time.Hour * 24}
+
+	lifespan, err := lifespans.AccessTokenLifespan(context.Background(), NewFositeClient(&client.Client{TokenLifespan: 300}))
+	a.NoError(err)
+	a.Equal(time.Minute*5, lifespan)
+}
+
+func TestAccessTokenLifespanCapped(t *testing.T) {
+	a := assert.New(t)
+	lifespans := &TokenLifespans{Default: time.Minute * 15, Max: time.Hour * 24}
+
+	lifespan, err := lifespans.AccessTokenLifespan(context.Background(), NewFositeJWKClient(&client.Client{TokenLifespan: 60 * 60 * 48}))
+	a.NoError(err)
+	a.Equal(time.Hour*24, lifespan)
+}
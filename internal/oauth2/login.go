@@ -0,0 +1,121 @@
+package oauth2
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	clientpkg "github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// The cookie of the platform's session, unless `LoginSession.Cookie` is set
+	DefaultSessionCookie = "access"
+
+	sessionLeeway = time.Minute
+)
+
+// An end-user authenticated by the platform's login
+type EndUser struct {
+	// The `sub` of tokens issued on the end-user's behalf
+	Subject   string
+	AccountID string
+}
+
+// The claims of the platform's session
+type sessionClaims struct {
+	josejwt.Claims
+	AccountID string `json:"account_id"`
+}
+
+// Authenticates end-users by the platform's session, a JWT signed by the platform's login (which
+// happens outside of this server) in a cookie
+//
+// If the end-user isn't logged in, they're redirected to `LoginURL` with a `return_to` of the
+// original request
+type LoginSession struct {
+	// The keys which sign session JWTs. Every end-user is logged out if nil.
+	Keys *jose.JSONWebKeySet
+	// The `iss` of session JWTs, which isn't checked if empty
+	Issuer   string
+	Cookie   string
+	LoginURL string
+}
+
+// Returns the logged in end-user, or redirects to login (if `redirect`) and returns nil
+func (s *LoginSession) Authenticate(rw http.ResponseWriter, req *http.Request, redirect bool) (*EndUser, error) {
+	user, err := s.verify(req)
+	if err != nil {
+		// An invalid (e.g. expired) session is the same as none, so the end-user logs in again
+		log.Printf("Error occurred in LoginSession.verify: %+v", err)
+	}
+	if user != nil {
+		return user, nil
+	}
+
+	if s.LoginURL == "" || !redirect {
+		return nil, errors.WithStack(fosite.ErrLoginRequired)
+	}
+
+	loginURL, err := url.Parse(s.LoginURL)
+	if err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+	query := loginURL.Query()
+	query.Set("return_to", ISSUER+req.URL.RequestURI())
+	loginURL.RawQuery = query.Encode()
+
+	http.Redirect(rw, req, loginURL.String(), http.StatusFound)
+	return nil, nil
+}
+
+// Returns nil (and no error) if there is no session
+func (s *LoginSession) verify(req *http.Request) (*EndUser, error) {
+	name := s.Cookie
+	if name == "" {
+		name = DefaultSessionCookie
+	}
+	cookie, err := req.Cookie(name)
+	if err != nil || s.Keys == nil {
+		return nil, nil
+	}
+
+	token, err := josejwt.ParseSigned(cookie.Value)
+	if err != nil {
+		return nil, errors.Wrap(err, "josejwt.ParseSigned")
+	}
+	if len(token.Headers) != 1 {
+		return nil, errors.New("session must have a single signature")
+	}
+
+	header := token.Headers[0]
+	if !fosite.Arguments(clientpkg.TokenEndpointAuthSigningAlgs()).Has(header.Algorithm) {
+		return nil, errors.Errorf("session algorithm '%s' is not supported", header.Algorithm)
+	}
+
+	var claims sessionClaims
+	if err := verifyJWT(token, s.Keys.Key(header.KeyID), &claims); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("session has no expiry")
+	}
+	if err := claims.ValidateWithLeeway(josejwt.Expected{Issuer: s.Issuer, Time: time.Now()}, sessionLeeway); err != nil {
+		return nil, errors.Wrap(err, "sessionClaims.Validate")
+	}
+	if claims.AccountID == "" {
+		return nil, errors.New("session has no account_id")
+	}
+
+	// End-users were previously identified by their account alone
+	subject := claims.Subject
+	if subject == "" {
+		subject = claims.AccountID
+	}
+	return &EndUser{Subject: subject, AccountID: claims.AccountID}, nil
+}
@@ -0,0 +1,105 @@
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// The platform login's key, and a LoginSession which trusts it
+func setupLoginSession(a *assert.Assertions) (*jose.JSONWebKey, *LoginSession) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+
+	key := &jose.JSONWebKey{Key: privateKey, KeyID: "login", Algorithm: "ES256", Use: "sig"}
+	login := &LoginSession{
+		Keys: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}},
+	}
+	return key, login
+}
+
+func signSession(a *assert.Assertions, key *jose.JSONWebKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	a.NoError(err)
+
+	session, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	a.NoError(err)
+	return session
+}
+
+// The session cookie of a logged in end-user, valid for 5 minutes
+func sessionCookie(a *assert.Assertions, key *jose.JSONWebKey, subject string, accountID string) *http.Cookie {
+	return &http.Cookie{
+		Name: DefaultSessionCookie,
+		Value: signSession(a, key, map[string]interface{}{
+			"sub":        subject,
+			"account_id": accountID,
+			"exp":        time.Now().Add(time.Minute * 5).Unix(),
+		}),
+	}
+}
+
+func TestLoginSession(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+
+	subject, accountID := uuid.NewString(), uuid.NewString()
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+	req.AddCookie(sessionCookie(a, key, subject, accountID))
+
+	user, err := login.Authenticate(httptest.NewRecorder(), req, false)
+	a.NoError(err)
+	a.Equal(&EndUser{Subject: subject, AccountID: accountID}, user)
+}
+
+func TestLoginSessionInvalid(t *testing.T) {
+	a := assert.New(t)
+	key, login := setupLoginSession(a)
+	otherKey, _ := setupLoginSession(a)
+
+	exp := time.Now().Add(time.Minute * 5).Unix()
+	for _, tc := range []struct {
+		key    *jose.JSONWebKey
+		claims map[string]interface{}
+		reason string
+	}{
+		{key: otherKey, claims: map[string]interface{}{"account_id": "account", "exp": exp}, reason: "Untrusted key"},
+		{key: key, claims: map[string]interface{}{"account_id": "account", "exp": time.Now().Add(-time.Hour).Unix()}, reason: "Expired"},
+		{key: key, claims: map[string]interface{}{"account_id": "account"}, reason: "No expiry"},
+		{key: key, claims: map[string]interface{}{"sub": "user", "exp": exp}, reason: "No account"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+		req.AddCookie(&http.Cookie{Name: DefaultSessionCookie, Value: signSession(a, tc.key, tc.claims)})
+
+		user, err := login.Authenticate(httptest.NewRecorder(), req, false)
+		a.Nil(user, tc.reason)
+		a.ErrorIs(err, fosite.ErrLoginRequired, tc.reason)
+	}
+}
+
+func TestLoginSessionRedirect(t *testing.T) {
+	a := assert.New(t)
+	_, login := setupLoginSession(a)
+	login.LoginURL = "https://login.kidsloop.live/?app=oauth2"
+
+	// The microgateway's header isn't a session
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/auth?client_id=abc", nil)
+	req.Header.Set("X-Account-ID", uuid.NewString())
+	rw := httptest.NewRecorder()
+
+	user, err := login.Authenticate(rw, req, true)
+	a.NoError(err)
+	a.Nil(user)
+	a.Equal(http.StatusFound, rw.Code)
+	a.Equal("https://login.kidsloop.live/?app=oauth2&return_to=https%3A%2F%2Fplatform.kidsloop.live%2Foauth2%2Fauth%3Fclient_id%3Dabc", rw.Header().Get("Location"))
+}
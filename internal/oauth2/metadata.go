@@ -0,0 +1,107 @@
+package oauth2
+
+import (
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+)
+
+// Authorization server metadata, see https://datatracker.ietf.org/doc/html/rfc8414#section-2
+//
+// Also includes the fields OpenID Connect discovery requires, as it is served at both well-known URIs,
+// see https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type Metadata struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint,omitempty"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint,omitempty"`
+	RegistrationEndpoint                       string   `json:"registration_endpoint,omitempty"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	IntrospectionEndpointAuthMethodsSupported  []string `json:"introspection_endpoint_auth_methods_supported,omitempty"`
+	RevocationEndpointAuthMethodsSupported     []string `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported,omitempty"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	// See https://datatracker.ietf.org/doc/html/rfc8705#section-3.3
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens"`
+	// See https://datatracker.ietf.org/doc/html/rfc9449#section-5.1
+	DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported"`
+}
+
+// Describes what the composed provider actually supports, rather than everything the Client
+// model allows, so that a grant is only advertised if one of its handlers is registered
+func NewMetadata(provider Provider) *Metadata {
+	metadata := &Metadata{
+		Issuer:                            ISSUER,
+		TokenEndpoint:                     TokenURL,
+		RegistrationEndpoint:              RegistrationURL,
+		JWKSURI:                           ISSUER + crypto.JWKSPath,
+		ResponseTypesSupported:            []string{},
+		GrantTypesSupported:               []string{},
+		TokenEndpointAuthMethodsSupported: client.TokenEndpointAuthMethods,
+		// Only used by `private_key_jwt`
+		TokenEndpointAuthSigningAlgValuesSupported: client.TokenEndpointAuthSigningAlgs(),
+		// Subjects are the same account ID for every Client
+		SubjectTypesSupported: []string{"public"},
+		// Tokens are signed by the keys of `crypto.JWKSPath`
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		// Tokens are bound to the certificate of mutual TLS Clients
+		TLSClientCertificateBoundAccessTokens: true,
+		DPoPSigningAlgValuesSupported:         DPoPSigningAlgs,
+	}
+
+	f, ok := provider.(*fosite.Fosite)
+	if !ok {
+		return metadata
+	}
+
+	for _, grantType := range client.SupportedGrantTypes() {
+		if canHandleGrantType(f, grantType) {
+			metadata.GrantTypesSupported = append(metadata.GrantTypesSupported, grantType)
+		}
+	}
+
+	if len(f.AuthorizeEndpointHandlers) > 0 {
+		metadata.AuthorizationEndpoint = ISSUER + "/oauth2/auth"
+		metadata.ResponseTypesSupported = append(metadata.ResponseTypesSupported, "code")
+		metadata.CodeChallengeMethodsSupported = []string{"S256"}
+		if config.EnablePKCEPlainChallengeMethod {
+			metadata.CodeChallengeMethodsSupported = append(metadata.CodeChallengeMethodsSupported, "plain")
+		}
+	}
+
+	if canHandleGrantType(f, client.DeviceCode) {
+		metadata.DeviceAuthorizationEndpoint = ISSUER + "/oauth2/device/code"
+	}
+
+	if len(f.TokenIntrospectionHandlers) > 0 {
+		metadata.IntrospectionEndpoint = ISSUER + "/oauth2/introspect"
+		// fosite only accepts HTTP Basic authentication (or a bearer token) for introspection
+		metadata.IntrospectionEndpointAuthMethodsSupported = []string{client.ClientSecretBasic}
+	}
+
+	if len(f.RevocationHandlers) > 0 {
+		metadata.RevocationEndpoint = ISSUER + "/oauth2/revoke"
+		metadata.RevocationEndpointAuthMethodsSupported = client.TokenEndpointAuthMethods
+	}
+
+	return metadata
+}
+
+func canHandleGrantType(f *fosite.Fosite, grantType string) bool {
+	request := fosite.NewAccessRequest(nil)
+	request.GrantTypes = fosite.Arguments{grantType}
+
+	for _, handler := range f.TokenEndpointHandlers {
+		if handler.CanHandleTokenEndpointRequest(request) {
+			return true
+		}
+	}
+	return false
+}
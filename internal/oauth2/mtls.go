@@ -0,0 +1,112 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// Authenticates `tls_client_auth` and `self_signed_tls_client_auth` Clients by the certificate
+// presented during the TLS handshake, see https://datatracker.ietf.org/doc/html/rfc8705#section-2
+//
+// Any other Client is left to `Fallback`, i.e. fosite's default client authentication
+type TLSClientAuthenticator struct {
+	Store *Store
+	// The CAs trusted to issue `tls_client_auth` certificates, which can't be used if nil
+	ClientCAs *x509.CertPool
+	Fallback  fosite.ClientAuthenticationStrategy
+}
+
+var _ fosite.ClientAuthenticationStrategy = (*TLSClientAuthenticator)(nil).AuthenticateClient
+
+func (a *TLSClientAuthenticator) AuthenticateClient(ctx context.Context, r *http.Request, form url.Values) (fosite.Client, error) {
+	// RFC 8705 requires the `client_id` parameter, as there are no other credentials
+	clientID := form.Get("client_id")
+	cert := peerCertificate(r)
+	if clientID == "" || cert == nil {
+		return a.Fallback(ctx, r, form)
+	}
+
+	model, err := a.Store.repo.GetByID(ctx, clientID)
+	if err != nil || model.Disabled || !client.IsTLSClientAuth(model.TokenEndpointAuthMethod) {
+		return a.Fallback(ctx, r, form)
+	}
+
+	switch model.TokenEndpointAuthMethod {
+	case client.TLSClientAuth:
+		if err := a.verify(r.TLS.PeerCertificates); err != nil {
+			return nil, errors.WithStack(fosite.ErrInvalidClient.WithHint("The client certificate is not trusted.").WithWrap(err).WithDebug(err.Error()))
+		}
+		if cert.Subject.String() != model.TLSClientAuthSubjectDN {
+			return nil, errors.WithStack(fosite.ErrInvalidClient.WithHint("The subject of the client certificate does not match the OAuth 2.0 Client's 'tls_client_auth_subject_dn'."))
+		}
+	case client.SelfSignedTLSClientAuth:
+		if crypto.SPKIThumbprint(cert) != model.TLSClientAuthSPKIThumbprint {
+			return nil, errors.WithStack(fosite.ErrInvalidClient.WithHint("The public key of the client certificate does not match the OAuth 2.0 Client's 'tls_client_auth_spki_thumbprint'."))
+		}
+	}
+
+	return NewFositeClient(model), nil
+}
+
+func (a *TLSClientAuthenticator) verify(chain []*x509.Certificate) error {
+	if a.ClientCAs == nil {
+		return errors.New("no client CAs are configured")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         a.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// The `x5t#S256` thumbprint to bind an access token to, if the Client authenticated with mutual TLS
+// (see https://datatracker.ietf.org/doc/html/rfc8705#section-3), otherwise an empty string
+func certificateBinding(r *http.Request, c fosite.Client) string {
+	cert := peerCertificate(r)
+	if cert == nil {
+		return ""
+	}
+
+	fc, ok := c.(*FositeClient)
+	if !ok || !client.IsTLSClientAuth(fc.model.TokenEndpointAuthMethod) {
+		return ""
+	}
+
+	return crypto.CertificateThumbprint(cert)
+}
+
+// A certificate-bound `subject_token` (see `TokenExchangeGrantHandler`) can only be exchanged over a
+// connection with the same certificate
+func verifySubjectTokenCertificate(r *http.Request, accessRequest fosite.AccessRequester) error {
+	session, ok := accessRequest.GetSession().(*Session)
+	if !ok || !accessRequest.GetGrantTypes().ExactOne(client.TokenExchange) || session.CertificateThumbprint == "" {
+		return nil
+	}
+
+	cert := peerCertificate(r)
+	if cert == nil || crypto.CertificateThumbprint(cert) != session.CertificateThumbprint {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'subject_token' is bound to a client certificate, which was not presented."))
+	}
+	return nil
+}
+
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
@@ -2,12 +2,16 @@ package oauth2
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/KL-Engineering/oauth2-server/internal/crypto"
-	"github.com/alexedwards/argon2id"
+	"github.com/KL-Engineering/oauth2-server/internal/lockout"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
@@ -18,37 +22,121 @@ import (
 
 const (
 	hmacSecretPath = "internal/crypto/hmac_secret"
+
+	// The (public) URL of the token endpoint, which `private_key_jwt` client assertions must
+	// use as their `aud` claim
+	TokenURL = ISSUER + "/oauth2/token"
 )
 
 var (
 	config = &compose.Config{
 		AccessTokenLifespan: time.Minute * 15,
+		// Refresh tokens are rotated on every use, so this is the maximum period of inactivity
+		RefreshTokenLifespan: time.Hour * 24 * 30,
+		// Requested scopes must match one of the Client's `AllowedScopes`, where a trailing
+		// `.*` grants every sub-scope, e.g. `clients.*` allows `clients.read`
+		ScopeStrategy: fosite.WildcardScopeStrategy,
+		// Requested audiences must exactly match one of the Client's `AllowedAudiences`
+		AudienceMatchingStrategy: fosite.ExactAudienceMatchingStrategy,
+		TokenURL:                 TokenURL,
+		// PKCE (with the S256 method) is mandatory for the `authorization_code` grant, as our
+		// public Clients (mobile apps) can't otherwise prove they initiated the request
+		EnforcePKCE: true,
 		// ...
 	}
 )
 
+// `fosite.OAuth2Provider` along with client authentication, for endpoints fosite doesn't
+// implement (e.g. device authorization)
+type Provider interface {
+	fosite.OAuth2Provider
+	AuthenticateClient(ctx context.Context, r *http.Request, form url.Values) (fosite.Client, error)
+}
+
+// Hashes and verifies Client secrets with argon2id, caching verified secrets if `Cache` isn't nil
 type Hasher struct {
+	Cache *secretcache.Cache
 }
 
 func (h *Hasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
-	s, err := argon2id.CreateHash(string(data), argon2id.DefaultParams)
+	s, err := crypto.HashSecret(ctx, string(data))
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: fosite.Hasher.Hash: %w", err)
 	}
 	return []byte(s), nil
 }
 
+// fosite doesn't say which Client the hash belongs to, so the cache relies on `withClientID`
 func (h *Hasher) Compare(ctx context.Context, hash, data []byte) error {
-	ok, err := argon2id.ComparePasswordAndHash(string(data), string(hash))
+	clientID := clientIDFromContext(ctx)
+	cached := h.Cache != nil && clientID != ""
+	if cached && h.Cache.Verified(clientID, string(hash), data) {
+		recordSecretComparison(ctx)
+		recordVerifiedSecret(ctx, string(hash), string(data))
+		return nil
+	}
+
+	ok, err := crypto.CompareSecret(ctx, string(data), string(hash))
 	if err != nil {
+		if errors.Is(err, crypto.ErrHashingUnavailable) {
+			recordHashingError(ctx, err)
+		}
 		return fmt.Errorf("ERROR: fosite.Hasher.Compare: %w", err)
 	}
+	// Not counted if the hash couldn't be compared, e.g. the empty hash of a Client without a secret
+	recordSecretComparison(ctx)
 	if !ok {
 		return errors.New("ERROR: hash does not match")
 	}
+	recordVerifiedSecret(ctx, string(hash), string(data))
+
+	if cached {
+		h.Cache.Add(clientID, string(hash), data)
+	}
 	return nil
 }
 
+type clientIDContextKey struct{}
+
+// The ID of the Client authenticating a request, for `Hasher.Compare`
+func withClientID(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, clientIDContextKey{}, clientID)
+}
+
+func clientIDFromContext(ctx context.Context) string {
+	clientID, _ := ctx.Value(clientIDContextKey{}).(string)
+	return clientID
+}
+
+type hashingErrorContextKey struct{}
+
+// Records secrets which couldn't be compared as hashing is saturated (see `crypto.HashLimits`), as fosite
+// goes on to compare the Client's rotated hashes and then reports the last failure as invalid credentials.
+//
+// The returned function reports an authentication error as temporarily unavailable (503) if it's due to
+// hashing, so the Client retries rather than being locked out.
+func withHashingErrors(ctx context.Context) (context.Context, func(error) error) {
+	var hashingErr error
+	ctx = context.WithValue(ctx, hashingErrorContextKey{}, &hashingErr)
+	return ctx, func(err error) error {
+		if err == nil || hashingErr == nil {
+			return err
+		}
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(hashingErr).WithHint("Too many requests are being processed, try again later."))
+	}
+}
+
+func recordHashingError(ctx context.Context, err error) {
+	if hashingErr, ok := ctx.Value(hashingErrorContextKey{}).(*error); ok {
+		*hashingErr = err
+	}
+}
+
+func hashingFailed(ctx context.Context) bool {
+	hashingErr, ok := ctx.Value(hashingErrorContextKey{}).(*error)
+	return ok && *hashingErr != nil
+}
+
 func LoadHMACSecret() ([]byte, error) {
 	bytes, err := ioutil.ReadFile(hmacSecretPath)
 	if err != nil {
@@ -58,8 +146,24 @@ func LoadHMACSecret() ([]byte, error) {
 	return bytes, nil
 }
 
-func NewProvider(db *dynamodb.Client) (fosite.OAuth2Provider, error) {
+type ProviderOptions struct {
+	// The CAs trusted to issue the certificates of `tls_client_auth` Clients
+	ClientCAs *x509.CertPool
+	// The cap on every access token's lifespan, which defaults to 24 hours
+	MaxAccessTokenLifespan time.Duration
+	// Caches verified Client secrets, which should match `HandlerOptions.SecretCache`. Disabled if nil.
+	SecretCache *secretcache.Cache
+	// Locks out Clients (per source IP) and source IPs which fail to authenticate too often. Disabled if nil.
+	Lockout *lockout.Store
+	// Whether the source IP is the last address of `X-Forwarded-For`, which must then be set by a proxy
+	TrustForwardedFor bool
+}
+
+func NewProvider(db *dynamodb.Client, opts ProviderOptions) (Provider, error) {
 	store := NewStore(db)
+	if opts.MaxAccessTokenLifespan > 0 {
+		store.lifespans.Max = opts.MaxAccessTokenLifespan
+	}
 
 	secret, err := LoadHMACSecret()
 	if err != nil {
@@ -71,20 +175,71 @@ func NewProvider(db *dynamodb.Client) (fosite.OAuth2Provider, error) {
 		return nil, fmt.Errorf("NewProvider: %w", err)
 	}
 
-	return compose.Compose(
+	// Every JWT has the `kid` of the private key, and access tokens are `at+jwt` (see `AccessTokenStrategy`)
+	signer, err := NewJWTSigningStrategy(privateKey, jwt.JWTHeaderTypeValue)
+	if err != nil {
+		return nil, fmt.Errorf("NewProvider: %w", err)
+	}
+	accessTokenSigner, err := NewJWTSigningStrategy(privateKey, AccessTokenJWTType)
+	if err != nil {
+		return nil, fmt.Errorf("NewProvider: %w", err)
+	}
+
+	openIDConnectStrategy := compose.NewOpenIDConnectStrategy(config, privateKey)
+	openIDConnectStrategy.JWTStrategy = signer
+
+	provider := compose.Compose(
 		config,
 		store,
 		&compose.CommonStrategy{
-			CoreStrategy: compose.NewOAuth2JWTStrategy(
-				privateKey,
+			CoreStrategy: NewAccessTokenStrategy(
+				accessTokenSigner,
 				compose.NewOAuth2HMACStrategy(config, secret, nil),
 			),
-			OpenIDConnectTokenStrategy: compose.NewOpenIDConnectStrategy(config, privateKey),
-			JWTStrategy: &jwt.RS256JWTStrategy{
-				PrivateKey: privateKey,
-			},
+			OpenIDConnectTokenStrategy: openIDConnectStrategy,
+			JWTStrategy:                signer,
 		},
-		&Hasher{},
+		&Hasher{Cache: opts.SecretCache},
 		compose.OAuth2ClientCredentialsGrantFactory,
-	), nil
+		compose.OAuth2AuthorizeExplicitFactory,
+		// Must come after the authorize explicit handler, as it relies on the authorization code
+		compose.OAuth2PKCEFactory,
+		compose.OAuth2RefreshTokenGrantFactory,
+		DeviceCodeGrantFactory,
+		TokenExchangeGrantFactory,
+		TokenIntrospectionFactory,
+		TokenRevocationFactory,
+	)
+
+	f := provider.(*fosite.Fosite)
+	authenticateClient := (&TLSClientAuthenticator{
+		Store:     store,
+		ClientCAs: opts.ClientCAs,
+		Fallback:  f.DefaultClientAuthenticationStrategy,
+	}).AuthenticateClient
+	lockouts := newClientLockout(opts.Lockout, opts.TrustForwardedFor)
+	f.ClientAuthenticationStrategy = lockouts.wrap(func(ctx context.Context, r *http.Request, form url.Values) (fosite.Client, error) {
+		clientID, secret := clientCredentialsFromRequest(r)
+		ctx, hashingError := withHashingErrors(withClientID(ctx, clientID))
+		ctx, compared := withSecretComparisons(ctx)
+		client, err := authenticateClient(ctx, r, form)
+		// Otherwise a Client without a secret (e.g. a public Client) would accept any, unlike one which doesn't exist
+		if err == nil && secret != "" && *compared == 0 {
+			client, err = nil, errors.WithStack(fosite.ErrInvalidClient.WithHint("The OAuth 2.0 Client doesn't use a secret, however one was provided in the request."))
+		}
+		if err != nil {
+			compareDummySecret(ctx, secret, *compared)
+		}
+		return client, hashingError(normaliseClientError(err))
+	})
+
+	// Access tokens last as long as their Client's `token_lifespan`, rather than `config.AccessTokenLifespan`.
+	// The token exchange handler resolves this itself, as it also caps the lifespan.
+	for i, handler := range f.TokenEndpointHandlers {
+		if _, ok := handler.(*TokenExchangeGrantHandler); !ok {
+			f.TokenEndpointHandlers[i] = &TokenLifespanHandler{TokenEndpointHandler: handler, Lifespans: store.lifespans}
+		}
+	}
+
+	return f, nil
 }
@@ -0,0 +1,70 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/secretcache"
+	"github.com/KL-Engineering/oauth2-server/internal/utils"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasherSecretCache(t *testing.T) {
+	a := assert.New(t)
+
+	cache := utils.Must(secretcache.New(secretcache.DefaultPolicy))
+	hasher := &Hasher{Cache: cache}
+	hash := []byte(utils.Must(crypto.HashSecret(context.Background(), testSecret)))
+
+	a.NoError(hasher.Compare(context.Background(), hash, []byte(testSecret)))
+	a.Zero(cache.Len(), "Not cached without the Client")
+
+	ctx := withClientID(context.Background(), "client")
+	a.Error(hasher.Compare(ctx, hash, []byte("incorrect-password")))
+	a.Zero(cache.Len(), "Failures aren't cached")
+
+	a.NoError(hasher.Compare(ctx, hash, []byte(testSecret)))
+	a.True(cache.Verified("client", string(hash), []byte(testSecret)))
+	a.NoError(hasher.Compare(ctx, hash, []byte(testSecret)))
+
+	a.Error(hasher.Compare(ctx, []byte(utils.Must(crypto.HashSecret(ctx, "n3w-"+testSecret))), []byte(testSecret)), "Another hash")
+}
+
+func TestHasherVerifiedSecret(t *testing.T) {
+	a := assert.New(t)
+	hash := utils.Must(crypto.HashSecret(context.Background(), testSecret))
+
+	ctx, verified := withVerifiedSecret(context.Background())
+	hasher := &Hasher{}
+
+	a.Error(hasher.Compare(ctx, []byte(hash), []byte("incorrect-password")))
+	a.Empty(verified.secret, "Failures aren't recorded")
+
+	a.NoError(hasher.Compare(ctx, []byte(hash), []byte(testSecret)))
+	a.Equal(verifiedSecret{hash: hash, secret: testSecret}, *verified)
+}
+
+func TestHashingErrors(t *testing.T) {
+	a := assert.New(t)
+
+	ctx, hashingError := withHashingErrors(context.Background())
+	a.NoError(hashingError(nil))
+	a.ErrorIs(hashingError(fosite.ErrInvalidClient), fosite.ErrInvalidClient, "Not due to hashing")
+
+	recordHashingError(ctx, fmt.Errorf("crypto.CompareSecret: %w", crypto.ErrHashingUnavailable))
+	a.NoError(hashingError(nil), "Authenticated with a rotated hash")
+
+	err := hashingError(fosite.ErrInvalidClient)
+	a.ErrorIs(err, fosite.ErrTemporarilyUnavailable)
+	a.ErrorIs(err, crypto.ErrHashingUnavailable)
+	a.False(errors.Is(err, fosite.ErrInvalidClient), "Not a failed authentication, e.g. for lockouts")
+	a.Equal(http.StatusServiceUnavailable, fosite.ErrorToRFC6749Error(err).CodeField)
+
+	// Without `withHashingErrors`
+	recordHashingError(context.Background(), crypto.ErrHashingUnavailable)
+}
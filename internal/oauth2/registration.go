@@ -0,0 +1,572 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	clientpkg "github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// The Dynamic Client Registration endpoint, see https://datatracker.ietf.org/doc/html/rfc7591#section-3
+	RegistrationURL = ISSUER + "/oauth2/register"
+
+	// Clock skew allowed when validating the `exp`, `nbf` and `iat` of a software statement
+	softwareStatementLeeway = time.Minute
+)
+
+// Errors of https://datatracker.ietf.org/doc/html/rfc7591#section-3.2.2
+var (
+	ErrInvalidRedirectURI = &fosite.RFC6749Error{
+		ErrorField:       "invalid_redirect_uri",
+		DescriptionField: "The value of one or more redirection URIs is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+	ErrInvalidClientMetadata = &fosite.RFC6749Error{
+		ErrorField:       "invalid_client_metadata",
+		DescriptionField: "The value of one of the client metadata fields is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+	ErrInvalidSoftwareStatement = &fosite.RFC6749Error{
+		ErrorField:       "invalid_software_statement",
+		DescriptionField: "The software statement presented is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+	ErrUnapprovedSoftwareStatement = &fosite.RFC6749Error{
+		ErrorField:       "unapproved_software_statement",
+		DescriptionField: "The software statement presented is not approved for use by this authorization server.",
+		CodeField:        http.StatusBadRequest,
+	}
+	// An invalid initial or registration access token, see https://datatracker.ietf.org/doc/html/rfc6750#section-3.1
+	ErrInvalidRegistrationToken = &fosite.RFC6749Error{
+		ErrorField:       "invalid_token",
+		DescriptionField: "The access token provided is expired, revoked, malformed, or invalid for other reasons.",
+		CodeField:        http.StatusUnauthorized,
+	}
+)
+
+// Client metadata, see https://datatracker.ietf.org/doc/html/rfc7591#section-2
+//
+// Also the body of an update, which replaces all of the Client's metadata, see
+// https://datatracker.ietf.org/doc/html/rfc7592#section-2.2
+type RegistrationRequest struct {
+	RedirectURIs                []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod     string   `json:"token_endpoint_auth_method"`
+	TokenEndpointAuthSigningAlg string   `json:"token_endpoint_auth_signing_alg"`
+	GrantTypes                  []string `json:"grant_types"`
+	ResponseTypes               []string `json:"response_types"`
+	ClientName                  string   `json:"client_name"`
+	// Space delimited
+	Scope             string                   `json:"scope"`
+	JWKS              *clientpkg.JSONWebKeySet `json:"jwks"`
+	JWKSURI           string                   `json:"jwks_uri"`
+	SoftwareID        string                   `json:"software_id"`
+	SoftwareVersion   string                   `json:"software_version"`
+	SoftwareStatement string                   `json:"software_statement"`
+	// See https://datatracker.ietf.org/doc/html/rfc8705#section-2.1.2
+	TLSClientAuthSubjectDN      string `json:"tls_client_auth_subject_dn"`
+	TLSClientAuthSPKIThumbprint string `json:"tls_client_auth_spki_thumbprint"`
+	// Only in updates, where they must match the Client's
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// See https://datatracker.ietf.org/doc/html/rfc7591#section-3.2.1
+type RegistrationResponse struct {
+	ClientID string `json:"client_id"`
+	// Only when registered, as only its hash is stored
+	ClientSecret string `json:"client_secret,omitempty"`
+	// Always 0 (i.e. never) when there's a secret
+	ClientSecretExpiresAt       *int64                   `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken     string                   `json:"registration_access_token"`
+	RegistrationClientURI       string                   `json:"registration_client_uri"`
+	RedirectURIs                []string                 `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod     string                   `json:"token_endpoint_auth_method"`
+	TokenEndpointAuthSigningAlg string                   `json:"token_endpoint_auth_signing_alg,omitempty"`
+	GrantTypes                  []string                 `json:"grant_types"`
+	ResponseTypes               []string                 `json:"response_types,omitempty"`
+	ClientName                  string                   `json:"client_name,omitempty"`
+	Scope                       string                   `json:"scope,omitempty"`
+	JWKS                        *clientpkg.JSONWebKeySet `json:"jwks,omitempty"`
+	JWKSURI                     string                   `json:"jwks_uri,omitempty"`
+	SoftwareID                  string                   `json:"software_id,omitempty"`
+	SoftwareVersion             string                   `json:"software_version,omitempty"`
+	SoftwareStatement           string                   `json:"software_statement,omitempty"`
+	TLSClientAuthSubjectDN      string                   `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSPKIThumbprint string                   `json:"tls_client_auth_spki_thumbprint,omitempty"`
+}
+
+func newRegistrationResponse(c *clientpkg.Client, registrationAccessToken string) RegistrationResponse {
+	method := c.TokenEndpointAuthMethod
+	if method == "" {
+		method = clientpkg.ClientSecretBasic
+	}
+
+	grantTypes := c.GetGrantTypes()
+	responseTypes := []string{}
+	for _, grantType := range grantTypes {
+		if grantType == clientpkg.AuthorizationCode {
+			responseTypes = append(responseTypes, "code")
+		}
+	}
+
+	return RegistrationResponse{
+		ClientID:                    c.ID,
+		RegistrationAccessToken:     registrationAccessToken,
+		RegistrationClientURI:       RegistrationURL + "/" + c.ID,
+		RedirectURIs:                c.RedirectURIs,
+		TokenEndpointAuthMethod:     method,
+		TokenEndpointAuthSigningAlg: c.TokenEndpointAuthSigningAlg,
+		GrantTypes:                  grantTypes,
+		ResponseTypes:               responseTypes,
+		ClientName:                  c.Name,
+		Scope:                       strings.Join(c.AllowedScopes, " "),
+		JWKS:                        c.JWKS,
+		JWKSURI:                     c.JWKSURI,
+		SoftwareID:                  c.SoftwareID,
+		SoftwareVersion:             c.SoftwareVersion,
+		SoftwareStatement:           c.SoftwareStatement,
+		TLSClientAuthSubjectDN:      c.TLSClientAuthSubjectDN,
+		TLSClientAuthSPKIThumbprint: c.TLSClientAuthSPKIThumbprint,
+	}
+}
+
+// Registers a Client in the account of the initial access token, see https://datatracker.ietf.org/doc/html/rfc7591
+//
+// Each token may only register as many Clients as it was issued for, see `account.InitialAccessToken`
+func (h *Handler) Register(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := req.Context()
+	token := bearerToken(req)
+
+	initialAccessToken, err := h.initialAccessTokens.Get(ctx, token)
+	if err != nil {
+		if err != core.ErrNotFound {
+			log.Printf("Error occurred in InitialAccessTokenRepository.Get: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+			return
+		}
+		writeRegistrationTokenError(rw)
+		return
+	}
+
+	var metadata RegistrationRequest
+	if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+		writeError(rw, ErrInvalidClientMetadata.WithWrap(err).WithHint("Unable to parse the client metadata."))
+		return
+	}
+
+	if err := h.applySoftwareStatement(&metadata); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	scopes, err := validateRegistration(&metadata)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	var secret string
+	if clientpkg.HasSecret(metadata.TokenEndpointAuthMethod) {
+		secret, err = crypto.GenerateSecret()
+		if err != nil {
+			log.Printf("Error occurred in crypto.GenerateSecret: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+			return
+		}
+	}
+
+	registrationAccessToken, err := crypto.GenerateSecret()
+	if err != nil {
+		log.Printf("Error occurred in crypto.GenerateSecret: %+v", err)
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+
+	// Only once the metadata is valid, so that a rejected registration doesn't count
+	if err := h.initialAccessTokens.Use(ctx, token); err != nil {
+		if err != core.ErrNotFound {
+			log.Printf("Error occurred in InitialAccessTokenRepository.Use: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+			return
+		}
+		writeRegistrationTokenError(rw)
+		return
+	}
+
+	client, err := h.clients.Create(ctx, clientpkg.CreateOptions{
+		Secret:        secret,
+		Name:          metadata.ClientName,
+		AndroidID:     uuid.NewString(),
+		AccountID:     initialAccessToken.AccountID,
+		AllowedScopes: scopes,
+
+		TokenEndpointAuthMethod:     metadata.TokenEndpointAuthMethod,
+		TokenEndpointAuthSigningAlg: metadata.TokenEndpointAuthSigningAlg,
+		JWKS:                        metadata.JWKS,
+		JWKSURI:                     metadata.JWKSURI,
+		RedirectURIs:                metadata.RedirectURIs,
+		GrantTypes:                  metadata.GrantTypes,
+		TLSClientAuthSubjectDN:      metadata.TLSClientAuthSubjectDN,
+		TLSClientAuthSPKIThumbprint: metadata.TLSClientAuthSPKIThumbprint,
+		RegistrationAccessToken:     registrationAccessToken,
+		SoftwareID:                  metadata.SoftwareID,
+		SoftwareVersion:             metadata.SoftwareVersion,
+		SoftwareStatement:           metadata.SoftwareStatement,
+	})
+	if err != nil {
+		log.Printf("Error occurred in Repository.Create: %+v", err)
+		if errors.Is(err, crypto.ErrHashingUnavailable) {
+			writeError(rw, fosite.ErrTemporarilyUnavailable.WithWrap(err))
+			return
+		}
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+
+	log.Printf("INFO: Registered Client(id=%s, account_id=%s)", client.ID, client.AccountID)
+
+	response := newRegistrationResponse(client, registrationAccessToken)
+	if secret != "" {
+		response.ClientSecret = secret
+		response.ClientSecretExpiresAt = new(int64)
+	}
+
+	writeRegistrationResponse(rw, http.StatusCreated, response)
+}
+
+// See https://datatracker.ietf.org/doc/html/rfc7592#section-2.1
+func (h *Handler) GetRegistration(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	client, token, ok := h.authenticateRegistration(rw, req, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	writeRegistrationResponse(rw, http.StatusOK, newRegistrationResponse(client, token))
+}
+
+// Replaces all of the Client's metadata, except its authentication method which can't be changed,
+// see https://datatracker.ietf.org/doc/html/rfc7592#section-2.2
+func (h *Handler) UpdateRegistration(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	ctx := req.Context()
+
+	existing, token, ok := h.authenticateRegistration(rw, req, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var metadata RegistrationRequest
+	if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+		writeError(rw, ErrInvalidClientMetadata.WithWrap(err).WithHint("Unable to parse the client metadata."))
+		return
+	}
+
+	if metadata.ClientID != existing.ID {
+		writeError(rw, ErrInvalidClientMetadata.WithHint("The 'client_id' does not match the client."))
+		return
+	}
+
+	if metadata.ClientSecret != "" {
+		match, err := compareRegistrationSecret(ctx, metadata.ClientSecret, existing.SecretHash)
+		if errors.Is(err, crypto.ErrHashingUnavailable) {
+			writeError(rw, fosite.ErrTemporarilyUnavailable.WithWrap(err))
+			return
+		}
+		if err != nil || !match {
+			writeError(rw, ErrInvalidClientMetadata.WithHint("The 'client_secret' does not match the client."))
+			return
+		}
+	}
+
+	if err := h.applySoftwareStatement(&metadata); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	// The method (and therefore whether the Client has a secret) is fixed at registration
+	if normalizeAuthMethod(metadata.TokenEndpointAuthMethod) != normalizeAuthMethod(existing.TokenEndpointAuthMethod) ||
+		metadata.TokenEndpointAuthSigningAlg != existing.TokenEndpointAuthSigningAlg ||
+		metadata.TLSClientAuthSubjectDN != existing.TLSClientAuthSubjectDN ||
+		metadata.TLSClientAuthSPKIThumbprint != existing.TLSClientAuthSPKIThumbprint {
+		writeError(rw, ErrInvalidClientMetadata.WithHint("The client's authentication can't be changed, register a new client instead."))
+		return
+	}
+	metadata.TokenEndpointAuthMethod = existing.TokenEndpointAuthMethod
+
+	scopes, err := validateRegistration(&metadata)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	// Omitted metadata is removed, rather than left unchanged
+	redirectURIs := metadata.RedirectURIs
+	if redirectURIs == nil {
+		redirectURIs = []string{}
+	}
+	grantTypes := metadata.GrantTypes
+	if grantTypes == nil {
+		grantTypes = []string{}
+	}
+
+	client, err := h.clients.Update(ctx, clientpkg.UpdateOptions{
+		AccountID:         existing.AccountID,
+		ID:                existing.ID,
+		Name:              metadata.ClientName,
+		AllowedScopes:     scopes,
+		JWKS:              metadata.JWKS,
+		JWKSURI:           metadata.JWKSURI,
+		RedirectURIs:      redirectURIs,
+		GrantTypes:        grantTypes,
+		SoftwareID:        metadata.SoftwareID,
+		SoftwareVersion:   metadata.SoftwareVersion,
+		SoftwareStatement: metadata.SoftwareStatement,
+	})
+	if err != nil {
+		if err == core.ErrNotFound {
+			writeRegistrationTokenError(rw)
+			return
+		}
+		log.Printf("Error occurred in Repository.Update: %+v", err)
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+
+	writeRegistrationResponse(rw, http.StatusOK, newRegistrationResponse(client, token))
+}
+
+// See https://datatracker.ietf.org/doc/html/rfc7592#section-2.3
+func (h *Handler) DeleteRegistration(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	ctx := req.Context()
+
+	client, _, ok := h.authenticateRegistration(rw, req, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	if err := h.clients.Delete(ctx, clientpkg.DeleteOptions{AccountID: client.AccountID, ID: client.ID}); err != nil {
+		if err == core.ErrNotFound {
+			writeRegistrationTokenError(rw)
+			return
+		}
+		log.Printf("Error occurred in Repository.Delete: %+v", err)
+		writeError(rw, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+
+	if h.opts.SecretCache != nil {
+		h.opts.SecretCache.Invalidate(client.ID)
+	}
+
+	log.Printf("INFO: Deleted registered Client(id=%s)", client.ID)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the Client and its registration access token, or writes an error response
+//
+// An unknown Client is indistinguishable from an invalid token, so Client IDs can't be enumerated
+func (h *Handler) authenticateRegistration(rw http.ResponseWriter, req *http.Request, id string) (*clientpkg.Client, string, bool) {
+	token := bearerToken(req)
+
+	client, err := h.clients.GetByID(req.Context(), id)
+	if err != nil {
+		if err != core.ErrNotFound {
+			log.Printf("Error occurred in Repository.GetByID: %+v", err)
+			writeError(rw, fosite.ErrServerError.WithWrap(err))
+			return nil, "", false
+		}
+		writeRegistrationTokenError(rw)
+		return nil, "", false
+	}
+
+	if !client.ValidRegistrationAccessToken(token) {
+		writeRegistrationTokenError(rw)
+		return nil, "", false
+	}
+
+	return client, token, true
+}
+
+// Compares the `client_secret` of an update, at the same cost (see `crypto.CompareDummySecret`) whether
+// or not the Client has a secret
+func compareRegistrationSecret(ctx context.Context, secret string, hash string) (bool, error) {
+	if hash == "" {
+		return false, crypto.CompareDummySecret(ctx, secret)
+	}
+	return crypto.CompareSecret(ctx, secret, hash)
+}
+
+// Validates the metadata of a registration or update, returning the requested scopes
+func validateRegistration(metadata *RegistrationRequest) ([]string, error) {
+	if !clientpkg.ValidRedirectURIs(metadata.RedirectURIs) {
+		return nil, errors.WithStack(ErrInvalidRedirectURI)
+	}
+
+	scopes := fosite.RemoveEmpty(strings.Split(metadata.Scope, " "))
+	if scopes == nil {
+		scopes = []string{}
+	}
+	if !clientpkg.ValidScopes(scopes) {
+		return nil, errors.WithStack(invalidMetadataError("scope"))
+	}
+
+	if param, ok := clientpkg.ValidateAuthentication(
+		metadata.TokenEndpointAuthMethod,
+		metadata.TokenEndpointAuthSigningAlg,
+		metadata.JWKS,
+		metadata.JWKSURI,
+	); !ok {
+		return nil, errors.WithStack(invalidMetadataError(param))
+	}
+
+	if param, ok := clientpkg.ValidateTLSClientAuth(
+		metadata.TokenEndpointAuthMethod,
+		metadata.TLSClientAuthSubjectDN,
+		metadata.TLSClientAuthSPKIThumbprint,
+	); !ok {
+		return nil, errors.WithStack(invalidMetadataError(param))
+	}
+
+	if param, ok := clientpkg.ValidateGrantTypes(
+		metadata.GrantTypes,
+		metadata.TokenEndpointAuthMethod,
+		metadata.RedirectURIs,
+	); !ok {
+		if param == "redirect_uris" {
+			return nil, errors.WithStack(ErrInvalidRedirectURI.WithHint("The 'authorization_code' grant requires at least one redirection URI."))
+		}
+		return nil, errors.WithStack(invalidMetadataError(param))
+	}
+
+	// Only the `code` response type is supported, which requires the `authorization_code` grant,
+	// see https://datatracker.ietf.org/doc/html/rfc7591#section-2.1
+	grantTypes := metadata.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = clientpkg.DefaultGrantTypes(metadata.TokenEndpointAuthMethod, metadata.RedirectURIs)
+	}
+	for _, responseType := range metadata.ResponseTypes {
+		if responseType != "code" || !fosite.Arguments(grantTypes).Has(clientpkg.AuthorizationCode) {
+			return nil, errors.WithStack(invalidMetadataError("response_types"))
+		}
+	}
+
+	return scopes, nil
+}
+
+func invalidMetadataError(param string) *fosite.RFC6749Error {
+	return ErrInvalidClientMetadata.WithHintf("'%s' not valid.", param)
+}
+
+// Verifies a software statement, whose claims take precedence over the rest of the metadata,
+// see https://datatracker.ietf.org/doc/html/rfc7591#section-2.3
+//
+// Statements must be signed by one of `HandlerOptions.SoftwareStatementKeys`
+func (h *Handler) applySoftwareStatement(metadata *RegistrationRequest) error {
+	if metadata.SoftwareStatement == "" {
+		return nil
+	}
+
+	if h.opts.SoftwareStatementKeys == nil {
+		return errors.WithStack(ErrUnapprovedSoftwareStatement.WithHint("Software statements are not accepted."))
+	}
+
+	token, err := josejwt.ParseSigned(metadata.SoftwareStatement)
+	if err != nil {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithWrap(err).WithDebug(err.Error()))
+	}
+	if len(token.Headers) != 1 {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithHint("The software statement must have a single signature."))
+	}
+
+	header := token.Headers[0]
+	if !fosite.Arguments(clientpkg.TokenEndpointAuthSigningAlgs()).Has(header.Algorithm) {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithHintf("The software statement algorithm '%s' is not supported.", header.Algorithm))
+	}
+
+	keys := h.opts.SoftwareStatementKeys.Key(header.KeyID)
+	if len(keys) == 0 {
+		return errors.WithStack(ErrUnapprovedSoftwareStatement.WithHint("The software statement is not signed by a trusted key."))
+	}
+
+	var registered josejwt.Claims
+	claims := map[string]interface{}{}
+	if err := verifyJWT(token, keys, &registered, &claims); err != nil {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithWrap(err).WithDebug(err.Error()))
+	}
+	if err := registered.ValidateWithLeeway(josejwt.Expected{Time: time.Now()}, softwareStatementLeeway); err != nil {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	// Only metadata can be asserted, not the credentials of an update
+	delete(claims, "client_id")
+	delete(claims, "client_secret")
+	delete(claims, "software_statement")
+
+	bytes, err := json.Marshal(claims)
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err))
+	}
+	// Fields which are claims are overwritten, and the rest are left as they were
+	if err := json.Unmarshal(bytes, metadata); err != nil {
+		return errors.WithStack(ErrInvalidSoftwareStatement.WithWrap(err).WithHint("The software statement contains invalid client metadata."))
+	}
+
+	return nil
+}
+
+// Keys may share a `kid` (or have none), so any of them may have signed the token
+func verifyJWT(token *josejwt.JSONWebToken, keys []jose.JSONWebKey, dest ...interface{}) error {
+	err := errors.New("no key with a matching 'kid'")
+	for _, key := range keys {
+		if err = token.Claims(key.Key, dest...); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("token.Claims: %w", err)
+}
+
+// `client_secret_basic` is the default, see https://datatracker.ietf.org/doc/html/rfc7591#section-2
+func normalizeAuthMethod(method string) string {
+	if method == "" {
+		return clientpkg.ClientSecretBasic
+	}
+	return method
+}
+
+// The token of the `Authorization: Bearer` header, or empty
+func bearerToken(req *http.Request) string {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || !strings.EqualFold(auth[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(auth[1])
+}
+
+func writeRegistrationTokenError(rw http.ResponseWriter) {
+	rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	writeError(rw, ErrInvalidRegistrationToken)
+}
+
+func writeRegistrationResponse(rw http.ResponseWriter, status int, response RegistrationResponse) {
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		log.Printf("Error occurred in writeRegistrationResponse: %+v", err)
+	}
+}
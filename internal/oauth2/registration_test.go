@@ -0,0 +1,144 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	clientpkg "github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// A publisher's key, and a Handler which trusts it
+func setupSoftwareStatement(a *assert.Assertions) (*jose.JSONWebKey, *Handler) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+
+	key := &jose.JSONWebKey{Key: privateKey, KeyID: "publisher", Algorithm: "ES256", Use: "sig"}
+	h := &Handler{opts: HandlerOptions{
+		SoftwareStatementKeys: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}},
+	}}
+	return key, h
+}
+
+func signSoftwareStatement(a *assert.Assertions, key *jose.JSONWebKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	a.NoError(err)
+
+	statement, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	a.NoError(err)
+	return statement
+}
+
+func TestApplySoftwareStatement(t *testing.T) {
+	a := assert.New(t)
+	key, h := setupSoftwareStatement(a)
+
+	statement := signSoftwareStatement(a, key, map[string]interface{}{
+		"iss":           "https://publisher.example.com",
+		"software_id":   "app",
+		"client_name":   "Publisher App",
+		"redirect_uris": []string{"https://app.example.com/callback"},
+		"client_id":     "ignored",
+	})
+
+	metadata := RegistrationRequest{
+		ClientName:        "Overridden",
+		Scope:             "read",
+		SoftwareStatement: statement,
+	}
+	a.NoError(h.applySoftwareStatement(&metadata))
+
+	a.Equal("Publisher App", metadata.ClientName, "Claims take precedence")
+	a.Equal("app", metadata.SoftwareID)
+	a.Equal([]string{"https://app.example.com/callback"}, metadata.RedirectURIs)
+	a.Equal("read", metadata.Scope, "Metadata which isn't asserted is unchanged")
+	a.Empty(metadata.ClientID, "Credentials can't be asserted")
+	a.Equal(statement, metadata.SoftwareStatement)
+}
+
+func TestApplySoftwareStatementInvalid(t *testing.T) {
+	a := assert.New(t)
+	key, h := setupSoftwareStatement(a)
+	untrusted, _ := setupSoftwareStatement(a)
+
+	expired := signSoftwareStatement(a, key, map[string]interface{}{
+		"software_id": "app",
+		"exp":         time.Now().Add(-time.Hour).Unix(),
+	})
+	err := h.applySoftwareStatement(&RegistrationRequest{SoftwareStatement: expired})
+	a.ErrorIs(err, ErrInvalidSoftwareStatement)
+
+	err = h.applySoftwareStatement(&RegistrationRequest{SoftwareStatement: "not-a-jwt"})
+	a.ErrorIs(err, ErrInvalidSoftwareStatement)
+
+	unapproved := signSoftwareStatement(a, untrusted, map[string]interface{}{"software_id": "app"})
+	err = h.applySoftwareStatement(&RegistrationRequest{SoftwareStatement: unapproved})
+	a.ErrorIs(err, ErrInvalidSoftwareStatement, "Same kid, but signed by another key")
+
+	err = (&Handler{}).applySoftwareStatement(&RegistrationRequest{SoftwareStatement: unapproved})
+	a.ErrorIs(err, ErrUnapprovedSoftwareStatement, "No trusted publishers")
+}
+
+func TestValidateRegistration(t *testing.T) {
+	a := assert.New(t)
+
+	scopes, err := validateRegistration(&RegistrationRequest{Scope: "read  write"})
+	a.NoError(err)
+	a.Equal([]string{"read", "write"}, scopes)
+
+	_, err = validateRegistration(&RegistrationRequest{RedirectURIs: []string{"http://example.com/callback"}})
+	a.ErrorIs(err, ErrInvalidRedirectURI)
+
+	_, err = validateRegistration(&RegistrationRequest{GrantTypes: []string{clientpkg.AuthorizationCode}})
+	a.ErrorIs(err, ErrInvalidRedirectURI, "The authorization_code grant requires a redirect URI")
+
+	_, err = validateRegistration(&RegistrationRequest{ResponseTypes: []string{"code"}})
+	a.ErrorIs(err, ErrInvalidClientMetadata, "The code response type requires the authorization_code grant")
+
+	_, err = validateRegistration(&RegistrationRequest{TokenEndpointAuthMethod: "unknown"})
+	a.ErrorIs(err, ErrInvalidClientMetadata)
+	a.Contains(fosite.ErrorToRFC6749Error(err).HintField, "token_endpoint_auth_method")
+}
+
+func TestCompareRegistrationSecret(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	hash, err := crypto.HashSecret(ctx, "secret")
+	a.NoError(err)
+
+	match, err := compareRegistrationSecret(ctx, "secret", hash)
+	a.NoError(err)
+	a.True(match)
+
+	match, err = compareRegistrationSecret(ctx, "incorrect", hash)
+	a.NoError(err)
+	a.False(match)
+
+	match, err = compareRegistrationSecret(ctx, "secret", "")
+	a.NoError(err, "A Client without a secret is compared with the dummy hash")
+	a.False(match)
+}
+
+func TestBearerToken(t *testing.T) {
+	a := assert.New(t)
+
+	req, err := http.NewRequest(http.MethodGet, RegistrationURL, nil)
+	a.NoError(err)
+	a.Empty(bearerToken(req))
+
+	req.Header.Set("Authorization", "bearer token")
+	a.Equal("token", bearerToken(req), "The scheme is case insensitive")
+
+	req.SetBasicAuth("client", "secret")
+	a.Empty(bearerToken(req))
+}
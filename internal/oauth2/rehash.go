@@ -0,0 +1,78 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	clientpkg "github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/core"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+)
+
+const (
+	// Rehashes running at once, beyond which they're skipped until the Client next authenticates
+	maxConcurrentRehashes = 4
+	rehashTimeout         = time.Second * 10
+)
+
+type verifiedSecretContextKey struct{}
+
+// A secret which `Hasher.Compare` verified, and the hash it matched
+type verifiedSecret struct {
+	hash   string
+	secret string
+}
+
+// Records the secret `Hasher.Compare` verifies, for `rehashSecret`
+func withVerifiedSecret(ctx context.Context) (context.Context, *verifiedSecret) {
+	verified := &verifiedSecret{}
+	return context.WithValue(ctx, verifiedSecretContextKey{}, verified), verified
+}
+
+func recordVerifiedSecret(ctx context.Context, hash string, secret string) {
+	if verified, ok := ctx.Value(verifiedSecretContextKey{}).(*verifiedSecret); ok {
+		*verified = verifiedSecret{hash: hash, secret: secret}
+	}
+}
+
+// Re-creates the hash of a Client's secret in the background if it has outdated parameters, see `crypto.NeedsRehash`
+func (h *Handler) rehashSecret(c fosite.Client, verified *verifiedSecret) {
+	client, ok := c.(*FositeClient)
+	// The Client may have authenticated with its previous secret, see `FositeClient.GetRotatedHashes`
+	if !ok || verified.secret == "" || verified.hash != client.model.SecretHash || !crypto.NeedsRehash(verified.hash) {
+		return
+	}
+
+	select {
+	case h.rehashes <- struct{}{}:
+	default:
+		return
+	}
+
+	go func() {
+		defer func() { <-h.rehashes }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), rehashTimeout)
+		defer cancel()
+
+		hash, err := crypto.HashSecret(ctx, verified.secret)
+		if err != nil {
+			log.Printf("Error occurred in crypto.HashSecret: %+v", err)
+			return
+		}
+
+		err = h.clients.RehashSecret(ctx, clientpkg.RehashSecretOptions{
+			AccountID: client.model.AccountID,
+			ID:        client.model.ID,
+			Hash:      verified.hash,
+			NewHash:   hash,
+		})
+		// Not found if the secret was rotated concurrently, whose hash is up to date anyway
+		if err != nil && !errors.Is(err, core.ErrNotFound) {
+			log.Printf("Error occurred in RehashSecret: %+v", err)
+		}
+	}()
+}
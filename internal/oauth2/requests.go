@@ -0,0 +1,216 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/ory/fosite"
+)
+
+const (
+	// Authorization requests, keyed by the signature of their authorization code
+	authorizeCodeNamespace = "AuthorizeCode"
+	// PKCE code challenges, keyed by the signature of their authorization code
+	pkceNamespace = "PKCE"
+	// Refresh token requests, keyed by the signature of the refresh token
+	refreshTokenNamespace = "RefreshToken"
+	// Requests of opaque access tokens, keyed by the signature of the access token
+	accessTokenNamespace = "AccessToken"
+)
+
+// Returned (along with the request itself) when a request has been invalidated, e.g. an
+// authorization code which has already been exchanged
+var ErrRequestInactive = errors.New("request is inactive")
+
+// The persisted form of a `fosite.Requester`
+type storedRequest struct {
+	ID                string    `dynamodbav:"request_id"`
+	ClientID          string    `dynamodbav:"client_id"`
+	RequestedAt       time.Time `dynamodbav:"requested_at"`
+	RequestedScope    []string  `dynamodbav:"requested_scope"`
+	GrantedScope      []string  `dynamodbav:"granted_scope"`
+	RequestedAudience []string  `dynamodbav:"requested_audience"`
+	GrantedAudience   []string  `dynamodbav:"granted_audience"`
+	// URL encoded
+	Form string `dynamodbav:"form"`
+	// JSON encoded `Session`
+	Session string `dynamodbav:"session"`
+	Active  bool   `dynamodbav:"active"`
+	TTL     int64  `dynamodbav:"ttl,omitempty"`
+}
+
+// Stores `fosite.Requester`s (and their Session), identified by a token signature
+//
+// Each item expires (via DynamoDB TTL) along with the token it belongs to
+type RequestStore struct {
+	dynamodb  *dynamodb.Client
+	namespace string
+	clients   fosite.ClientManager
+}
+
+func NewRequestStore(dynamodbClient *dynamodb.Client, namespace string, clients fosite.ClientManager) *RequestStore {
+	return &RequestStore{
+		dynamodb:  dynamodbClient,
+		namespace: namespace,
+		clients:   clients,
+	}
+}
+
+// A zero `exp` never expires
+func (s *RequestStore) Create(ctx context.Context, signature string, request fosite.Requester, exp time.Time) error {
+	session, err := json.Marshal(request.GetSession())
+	if err != nil {
+		return fmt.Errorf("json.Marshal Session: %w", err)
+	}
+
+	stored := storedRequest{
+		ID:                request.GetID(),
+		ClientID:          request.GetClient().GetID(),
+		RequestedAt:       request.GetRequestedAt(),
+		RequestedScope:    request.GetRequestedScopes(),
+		GrantedScope:      request.GetGrantedScopes(),
+		RequestedAudience: request.GetRequestedAudience(),
+		GrantedAudience:   request.GetGrantedAudience(),
+		Form:              request.GetRequestForm().Encode(),
+		Session:           string(session),
+		Active:            true,
+	}
+	if !exp.IsZero() {
+		stored.TTL = exp.Unix()
+	}
+
+	item, err := attributevalue.MarshalMap(stored)
+	if err != nil {
+		return fmt.Errorf("attributevalue.MarshalMap %s: %w", s.namespace, err)
+	}
+	for k, v := range storage.Key(s.namespace, signature) {
+		item[k] = v
+	}
+
+	_, err = s.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.PutItem %s: %w", s.namespace, err)
+	}
+
+	return nil
+}
+
+// Hydrates a copy of `session` (or a new Session if nil) with the stored Session
+//
+// `session` itself is left unchanged, as fosite passes the session of the current request, which
+// may have since been modified (e.g. bound to a key) before its token is generated
+//
+// Returns `fosite.ErrNotFound` if there is no such (unexpired) request, or the request along
+// with `ErrRequestInactive` if it has been invalidated
+func (s *RequestStore) Get(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	output, err := s.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            storage.Key(s.namespace, signature),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.GetItem %s: %w", s.namespace, err)
+	}
+
+	if output.Item == nil || storage.Expired(output.Item) {
+		return nil, fosite.ErrNotFound
+	}
+
+	var stored storedRequest
+	if err := attributevalue.UnmarshalMap(output.Item, &stored); err != nil {
+		return nil, fmt.Errorf("dynamodb.UnmarshalMap %s: %w", s.namespace, err)
+	}
+
+	client, err := s.clients.GetClient(ctx, stored.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	form, err := url.ParseQuery(stored.Form)
+	if err != nil {
+		return nil, fmt.Errorf("url.ParseQuery %s: %w", s.namespace, err)
+	}
+
+	if session == nil {
+		session = NewSession("")
+	} else {
+		session = session.Clone()
+	}
+	if err := json.Unmarshal([]byte(stored.Session), session); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal Session: %w", err)
+	}
+
+	request := &fosite.Request{
+		ID:                stored.ID,
+		RequestedAt:       stored.RequestedAt,
+		Client:            client,
+		RequestedScope:    stored.RequestedScope,
+		GrantedScope:      stored.GrantedScope,
+		RequestedAudience: stored.RequestedAudience,
+		GrantedAudience:   stored.GrantedAudience,
+		Form:              form,
+		Session:           session,
+	}
+
+	if !stored.Active {
+		return request, ErrRequestInactive
+	}
+
+	return request, nil
+}
+
+// Subsequent calls to `Get` return `ErrRequestInactive`
+//
+// Conditional write, so that of concurrent requests only one can invalidate (i.e. use) the request
+func (s *RequestStore) Invalidate(ctx context.Context, signature string) error {
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.Name("active").Equal(expression.Value(true)),
+	).WithUpdate(
+		expression.Set(expression.Name("active"), expression.Value(false)),
+	).Build()
+	if err != nil {
+		return fmt.Errorf("expression.NewBuilder: %w", err)
+	}
+
+	_, err = s.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       storage.Key(s.namespace, signature),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		if apiErr := new(types.ConditionalCheckFailedException); errors.As(err, &apiErr) {
+			return ErrRequestInactive
+		}
+		return fmt.Errorf("dynamodb.UpdateItem %s: %w", s.namespace, err)
+	}
+
+	return nil
+}
+
+func (s *RequestStore) Delete(ctx context.Context, signature string) error {
+	_, err := s.dynamodb.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       storage.Key(s.namespace, signature),
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb.DeleteItem %s: %w", s.namespace, err)
+	}
+
+	return nil
+}
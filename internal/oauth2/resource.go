@@ -0,0 +1,86 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// See https://datatracker.ietf.org/doc/html/rfc8707#section-2
+var ErrInvalidTarget = &fosite.RFC6749Error{
+	ErrorField:       "invalid_target",
+	DescriptionField: "The requested resource is invalid, missing, unknown, or malformed.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// Parses the `resource` parameters of a token request, each of which must be an absolute URI
+// without a fragment, see https://datatracker.ietf.org/doc/html/rfc8707#section-2
+func resourcesFromForm(form url.Values) ([]string, error) {
+	var resources []string
+	for _, resource := range form["resource"] {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || strings.Contains(resource, "#") {
+			return nil, errors.WithStack(ErrInvalidTarget.WithHintf("The resource '%s' must be an absolute URI without a fragment.", resource))
+		}
+		if !fosite.Arguments(resources).Has(resource) {
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// Restricts the access token of a token request to its resource indicators, which supersede the
+// `audience` parameter
+//
+// Each resource must be one of the Client's audiences. Grants without an earlier authorization (by
+// the end-user or a subject token) are granted the resources, whereas the others may only narrow
+// what was granted. The grant's audience is unchanged, so that a refresh token can still be used for
+// any of it, and the `aud` of the access token is instead set by `Session.GetJWTClaims`
+func applyResourceIndicators(request fosite.AccessRequester) error {
+	session, ok := request.GetSession().(*Session)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("Session is not an oauth2.Session."))
+	}
+	// The session of a refresh token is that of the previous token request
+	session.Resources = nil
+
+	form := request.GetRequestForm()
+	resources, err := resourcesFromForm(form)
+	if err != nil {
+		return err
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+	if len(fosite.GetAudiences(form)) > 0 {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'resource' and 'audience' parameters can't both be used."))
+	}
+
+	audiences := request.GetClient().GetAudience()
+	for _, resource := range resources {
+		if !audiences.Has(resource) {
+			return errors.WithStack(ErrInvalidTarget.WithHintf("The OAuth 2.0 Client is not allowed to request the resource '%s'.", resource))
+		}
+	}
+
+	grantTypes := request.GetGrantTypes()
+	if grantTypes.ExactOne(client.ClientCredentials) || grantTypes.ExactOne(client.TokenExchange) {
+		for _, resource := range resources {
+			request.GrantAudience(resource)
+		}
+	} else {
+		granted := request.GetGrantedAudience()
+		for _, resource := range resources {
+			if !granted.Has(resource) {
+				return errors.WithStack(ErrInvalidTarget.WithHintf("The resource '%s' has not been granted.", resource))
+			}
+		}
+	}
+
+	session.Resources = resources
+	return nil
+}
@@ -0,0 +1,70 @@
+package oauth2
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourcesFromForm(t *testing.T) {
+	a := assert.New(t)
+
+	resources, err := resourcesFromForm(url.Values{"resource": {"https://api.example.com", "urn:example:api", "https://api.example.com"}})
+	a.NoError(err)
+	a.Equal([]string{"https://api.example.com", "urn:example:api"}, resources, "Duplicates are ignored")
+
+	resources, err = resourcesFromForm(url.Values{})
+	a.NoError(err)
+	a.Empty(resources)
+
+	for _, resource := range []string{"", "api.example.com", "/api", "https://api.example.com#fragment"} {
+		_, err := resourcesFromForm(url.Values{"resource": {resource}})
+		a.ErrorIs(err, ErrInvalidTarget, resource)
+	}
+}
+
+func newResourceRequest(grantType string, form url.Values) *fosite.AccessRequest {
+	request := fosite.NewAccessRequest(NewSession("subject"))
+	request.GrantTypes = fosite.Arguments{grantType}
+	request.Form = form
+	request.Client = &fosite.DefaultClient{Audience: []string{"https://a.example.com", "https://b.example.com"}}
+	return request
+}
+
+func TestApplyResourceIndicators(t *testing.T) {
+	a := assert.New(t)
+
+	request := newResourceRequest("client_credentials", url.Values{"resource": {"https://a.example.com"}})
+	a.NoError(applyResourceIndicators(request))
+	a.Equal(fosite.Arguments{"https://a.example.com"}, request.GetGrantedAudience(), "Granted without an earlier authorization")
+	a.Equal([]string{"https://a.example.com"}, request.GetSession().(*Session).Resources)
+
+	request = newResourceRequest("refresh_token", url.Values{"resource": {"https://a.example.com"}})
+	request.GrantAudience("https://a.example.com")
+	request.GrantAudience("https://b.example.com")
+	request.GetSession().(*Session).Resources = []string{"https://b.example.com"}
+	a.NoError(applyResourceIndicators(request))
+	a.Equal(fosite.Arguments{"https://a.example.com", "https://b.example.com"}, request.GetGrantedAudience(), "The grant is unchanged")
+	a.Equal([]string{"https://a.example.com"}, request.GetSession().(*Session).Resources, "Replaces those of the previous token request")
+
+	request = newResourceRequest("refresh_token", url.Values{})
+	request.GetSession().(*Session).Resources = []string{"https://b.example.com"}
+	a.NoError(applyResourceIndicators(request))
+	a.Empty(request.GetSession().(*Session).Resources, "Reset without resources")
+}
+
+func TestApplyResourceIndicatorsInvalid(t *testing.T) {
+	a := assert.New(t)
+
+	request := newResourceRequest("client_credentials", url.Values{"resource": {"https://c.example.com"}})
+	a.ErrorIs(applyResourceIndicators(request), ErrInvalidTarget, "Not one of the Client's audiences")
+
+	request = newResourceRequest("refresh_token", url.Values{"resource": {"https://b.example.com"}})
+	request.GrantAudience("https://a.example.com")
+	a.ErrorIs(applyResourceIndicators(request), ErrInvalidTarget, "Not granted")
+
+	request = newResourceRequest("client_credentials", url.Values{"resource": {"https://a.example.com"}, "audience": {"https://b.example.com"}})
+	a.ErrorIs(applyResourceIndicators(request), fosite.ErrInvalidRequest)
+}
@@ -0,0 +1,138 @@
+package oauth2
+
+import (
+	"context"
+	"log"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+)
+
+// Revokes our (stateless) JWT access tokens by adding their `jti` to the denylist (see `JTIStore`),
+// opaque access tokens by deleting them, and refresh tokens by revoking their whole family
+type TokenRevoker struct {
+	JWTStrategy          jwt.JWTStrategy
+	AccessTokenStrategy  oauth2.AccessTokenStrategy
+	RefreshTokenStrategy oauth2.RefreshTokenStrategy
+	Store                *Store
+}
+
+var _ fosite.RevocationHandler = (*TokenRevoker)(nil)
+
+func TokenRevocationFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &TokenRevoker{
+		JWTStrategy:          strategy.(jwt.JWTStrategy),
+		AccessTokenStrategy:  strategy.(oauth2.AccessTokenStrategy),
+		RefreshTokenStrategy: strategy.(oauth2.RefreshTokenStrategy),
+		Store:                storage.(*Store),
+	}
+}
+
+// RevokeToken implements https://datatracker.ietf.org/doc/html/rfc7009#section-2.1
+func (r *TokenRevoker) RevokeToken(ctx context.Context, token string, tokenType fosite.TokenType, client fosite.Client) error {
+	// The `token_type_hint` is only a hint, so fall back to the other type of token
+	revokers := []func(context.Context, string, fosite.Client) error{r.revokeAccessToken, r.revokeRefreshToken}
+	if tokenType == fosite.RefreshToken {
+		revokers = []func(context.Context, string, fosite.Client) error{r.revokeRefreshToken, r.revokeAccessToken}
+	}
+
+	for _, revoke := range revokers {
+		if err := revoke(ctx, token, client); !errors.Is(err, fosite.ErrNotFound) {
+			return err
+		}
+	}
+
+	// Invalid, expired or foreign tokens can't be used anyway, and per RFC7009 these are
+	// not an error from the perspective of the client
+	log.Printf("INFO: Ignoring revocation of invalid token")
+	return nil
+}
+
+// Returns `fosite.ErrNotFound` if the token isn't a valid JWT access token
+func (r *TokenRevoker) revokeAccessToken(ctx context.Context, token string, client fosite.Client) error {
+	if !isJWT(token) {
+		return r.revokeOpaqueAccessToken(ctx, token, client)
+	}
+
+	t, err := r.JWTStrategy.Decode(ctx, token)
+	if err != nil {
+		return errors.WithStack(fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error()))
+	}
+	if !isAccessTokenType(t.Header) {
+		return errors.WithStack(fosite.ErrNotFound.WithHint("The token is not an access token."))
+	}
+
+	claims := jwt.JWTClaims{}
+	claims.FromMapClaims(t.Claims)
+
+	if clientIDFromClaims(claims) != client.GetID() {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHint("The token was not issued to the OAuth 2.0 Client making the revocation request."))
+	}
+
+	if claims.JTI == "" || claims.ExpiresAt.IsZero() {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The token is missing the 'jti' or 'exp' claim."))
+	}
+
+	if err := r.Store.RevokeJTI(ctx, claims.JTI, claims.ExpiresAt); err != nil {
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	return nil
+}
+
+// Returns `fosite.ErrNotFound` if there is no such opaque access token
+func (r *TokenRevoker) revokeOpaqueAccessToken(ctx context.Context, token string, client fosite.Client) error {
+	signature := r.AccessTokenStrategy.AccessTokenSignature(token)
+	if signature == "" {
+		return errors.WithStack(fosite.ErrNotFound)
+	}
+
+	request, err := r.Store.GetAccessTokenSession(ctx, signature, nil)
+	if err != nil {
+		if errors.Is(err, fosite.ErrNotFound) || errors.Is(err, fosite.ErrInactiveToken) {
+			return errors.WithStack(fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error()))
+		}
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if request.GetClient().GetID() != client.GetID() {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHint("The token was not issued to the OAuth 2.0 Client making the revocation request."))
+	}
+
+	if err := r.Store.DeleteAccessTokenSession(ctx, signature); err != nil {
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	return nil
+}
+
+// Revokes the whole family, as the refresh token may already have been rotated
+//
+// Returns `fosite.ErrNotFound` if there is no such refresh token
+func (r *TokenRevoker) revokeRefreshToken(ctx context.Context, token string, client fosite.Client) error {
+	signature := r.RefreshTokenStrategy.RefreshTokenSignature(token)
+	if signature == "" {
+		return errors.WithStack(fosite.ErrNotFound)
+	}
+
+	request, err := r.Store.GetRefreshTokenSession(ctx, signature, nil)
+	if err != nil && !errors.Is(err, fosite.ErrInactiveToken) {
+		if errors.Is(err, fosite.ErrNotFound) {
+			return err
+		}
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if request.GetClient().GetID() != client.GetID() {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHint("The token was not issued to the OAuth 2.0 Client making the revocation request."))
+	}
+
+	if err := r.Store.RevokeRefreshToken(ctx, request.GetID()); err != nil {
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	return nil
+}
@@ -1,14 +1,16 @@
 package oauth2
 
 import (
+	"context"
 	"time"
 
-	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/KL-Engineering/oauth2-server/internal/client"
 	"github.com/mohae/deepcopy"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/openid"
 	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -18,10 +20,23 @@ const (
 type Session struct {
 	*openid.DefaultSession `json:"idToken"`
 	Extra                  map[string]interface{} `json:"extra"`
-	KID                    string
+	ClientID               string
 	AccountID              string
 	AndroidID              string
-	// TODO: SubscriptionID
+	// The `act` claim of an exchanged token, see https://datatracker.ietf.org/doc/html/rfc8693#section-4.1
+	Actor map[string]interface{}
+	// The `x5t#S256` of the certificate a mutual TLS Client authenticated with, which the token is bound to
+	CertificateThumbprint string
+	// The JWK thumbprint of the DPoP proof's key, which the token is bound to
+	DPoPJKT string
+	// The Client's extra claims, whose templates are expanded when the token is issued
+	CustomClaims map[string]string
+	// The subscription of the account, see `EntitlementProvider`
+	SubscriptionID string
+	Entitlements   []string
+	// The resource indicators of the token request, which are the access token's audience rather
+	// than the whole granted audience, see `applyResourceIndicators`
+	Resources []string
 }
 
 func NewSession(subject string) *Session {
@@ -31,7 +46,7 @@ func NewSession(subject string) *Session {
 				Issuer:      ISSUER,
 				Subject:     subject,
 				Audience:    []string{ISSUER},
-				ExpiresAt:   time.Now().Add(time.Hour * 1),
+				ExpiresAt:   time.Now().Add(config.AccessTokenLifespan),
 				IssuedAt:    time.Now(),
 				RequestedAt: time.Now(),
 				AuthTime:    time.Now(),
@@ -45,46 +60,192 @@ func NewSession(subject string) *Session {
 	}
 }
 
-// Populate Session object based on OAuth2 Client
-func (s *Session) WithClient(client fosite.Client) {
+// Populate Session object based on OAuth2 Client, including the Entitlements of its account (unless
+// `entitlements` is nil)
+//
+// The subject defaults to the Client itself, see `WithEndUser` if acting on behalf of an end-user
+func (s *Session) WithClient(ctx context.Context, client fosite.Client, entitlements EntitlementProvider) error {
 	s.Subject = client.GetID()
-	// TODO remove hardcode
-	s.KID = crypto.KID
+	s.ClientID = client.GetID()
 
 	s.AccountID = client.(CustomFositeClient).GetAccountID()
 	s.AndroidID = client.(CustomFositeClient).GetAndroidID()
+
+	return s.withEntitlements(ctx, entitlements)
+}
+
+// Acts on behalf of an end-user, whose account (and its Entitlements) replaces the Client's
+func (s *Session) WithEndUser(ctx context.Context, subject string, accountID string, entitlements EntitlementProvider) error {
+	s.SetSubject(subject)
+	s.AccountID = accountID
+
+	return s.withEntitlements(ctx, entitlements)
+}
+
+func (s *Session) withEntitlements(ctx context.Context, entitlements EntitlementProvider) error {
+	s.SubscriptionID = ""
+	s.Entitlements = nil
+	if entitlements == nil {
+		return nil
+	}
+
+	e, err := entitlements.GetEntitlements(ctx, s.AccountID)
+	if err != nil {
+		return errors.WithStack(fosite.ErrTemporarilyUnavailable.WithHint("Unable to look up the subscription of the account.").WithWrap(err).WithDebug(err.Error()))
+	}
+	if e != nil {
+		s.SubscriptionID = e.SubscriptionID
+		s.Entitlements = e.Entitlements
+	}
+	return nil
+}
+
+// Populate Session from the claims of one of our access tokens, which may have been issued on
+// behalf of someone other than the Client
+func (s *Session) WithClaims(claims jwt.JWTClaims) {
+	s.Subject = claims.Subject
+	if accountID, ok := claims.Extra["account_id"].(string); ok {
+		s.AccountID = accountID
+	}
+	if androidID, ok := claims.Extra["android_id"].(string); ok {
+		s.AndroidID = androidID
+	}
+	if actor, ok := claims.Extra["act"].(map[string]interface{}); ok {
+		s.Actor = actor
+	}
+	// The end-user authenticated when the subject token was issued, not now
+	s.DefaultSession.Claims.AuthTime = time.Time{}
+	if authTime, ok := claims.Extra["auth_time"].(float64); ok {
+		s.DefaultSession.Claims.AuthTime = time.Unix(int64(authTime), 0).UTC()
+	}
+	if cnf, ok := claims.Extra["cnf"].(map[string]interface{}); ok {
+		s.CertificateThumbprint, _ = cnf["x5t#S256"].(string)
+		s.DPoPJKT, _ = cnf["jkt"].(string)
+	}
+	if subscriptionID, ok := claims.Extra["subscription_id"].(string); ok {
+		s.SubscriptionID = subscriptionID
+		s.Entitlements = nil
+		if entitlements, ok := claims.Extra["entitlements"].([]interface{}); ok {
+			for _, entitlement := range entitlements {
+				if entitlement, ok := entitlement.(string); ok {
+					s.Entitlements = append(s.Entitlements, entitlement)
+				}
+			}
+		}
+	}
+	// Any other claim is a (since expanded) custom claim
+	s.CustomClaims = map[string]string{}
+	for name, value := range claims.Extra {
+		if value, ok := value.(string); ok && !client.IsReservedClaim(name) {
+			s.CustomClaims[name] = value
+		}
+	}
+}
+
+// The access token (and the ID token claims) expire after `lifespan`, see `TokenLifespans`
+func (s *Session) WithLifespan(lifespan time.Duration) {
+	exp := time.Now().UTC().Add(lifespan).Round(time.Second)
+	s.SetExpiresAt(fosite.AccessToken, exp)
+	s.DefaultSession.Claims.ExpiresAt = exp
 }
 
 func (s *Session) GetJWTClaims() jwt.JWTClaimsContainer {
+	exp := s.GetExpiresAt(fosite.AccessToken)
+	if exp.IsZero() {
+		exp = s.DefaultSession.Claims.ExpiresAt
+	}
+
 	claims := &jwt.JWTClaims{
 		Subject:   s.Subject,
-		Audience:  s.DefaultSession.Claims.Audience,
 		Issuer:    s.DefaultSession.Claims.Issuer,
-		ExpiresAt: s.GetExpiresAt(fosite.AccessToken),
+		ExpiresAt: exp,
 		IssuedAt:  time.Now(),
 
-		// The JTI MUST NOT BE FIXED or refreshing tokens will yield the SAME token
+		// The JTI MUST NOT BE FIXED or refreshing tokens will yield the SAME token, so is left to
+		// `jwt.JWTClaims.ToMap` to generate (a UUID) for each token
 		// JTI:       s.JTI,
 
-		// These are set by the DefaultJWTStrategy
+		// These are set by the DefaultJWTStrategy, from the granted scopes/audiences, except that
+		// `resourceClaims` keeps the audience to the requested resources
 		// Scope:     s.Scope,
+		// Audience:  s.Audience,
 
 		// Setting these here will cause the token to have the same iat/nbf values always
 		// IssuedAt:  s.DefaultSession.Claims.IssuedAt,
 		// NotBefore: s.DefaultSession.Claims.IssuedAt,
 	}
 
-	if claims.Extra == nil {
-		claims.Extra = make(map[string]interface{})
+	claims.Extra = s.GetExtraClaims()
+	if len(s.Resources) > 0 {
+		claims.Audience = s.Resources
+		return &resourceClaims{JWTClaims: claims}
+	}
+	return claims
+}
+
+// Claims whose `aud` is the resource indicators, which `DefaultJWTStrategy` would otherwise
+// overwrite with the granted audience
+type resourceClaims struct {
+	*jwt.JWTClaims
+}
+
+func (c *resourceClaims) With(expiry time.Time, scope, audience []string) jwt.JWTClaimsContainer {
+	resources := c.Audience
+	c.JWTClaims.With(expiry, scope, audience)
+	c.Audience = resources
+	return c
+}
+
+// Custom claims, shared by the JWT and the introspection response
+func (s *Session) GetExtraClaims() map[string]interface{} {
+	claims := map[string]interface{}{}
+
+	// Reserved claims can't be custom claims, but are set afterwards regardless
+	variables := map[string]string{
+		"sub":        s.Subject,
+		"client_id":  s.ClientID,
+		"account_id": s.AccountID,
+		"android_id": s.AndroidID,
+	}
+	for name, value := range s.CustomClaims {
+		claims[name] = client.ExpandClaimTemplate(value, variables)
+	}
+
+	claims["client_id"] = s.ClientID
+	claims["account_id"] = s.AccountID
+	claims["android_id"] = s.AndroidID
+	// Only tokens issued on behalf of an end-user have an `auth_time`, see https://datatracker.ietf.org/doc/html/rfc9068#section-2.2.1
+	if s.Subject != s.ClientID && !s.DefaultSession.Claims.AuthTime.IsZero() {
+		claims["auth_time"] = s.DefaultSession.Claims.AuthTime.Unix()
+	}
+	if s.SubscriptionID != "" {
+		claims["subscription_id"] = s.SubscriptionID
+		claims["entitlements"] = s.Entitlements
+		if s.Entitlements == nil {
+			claims["entitlements"] = []string{}
+		}
+	}
+	if s.Actor != nil {
+		claims["act"] = s.Actor
+	}
+	// Confirmation of the key the token is bound to, see https://datatracker.ietf.org/doc/html/rfc7800#section-3.1
+	cnf := map[string]interface{}{}
+	if s.CertificateThumbprint != "" {
+		cnf["x5t#S256"] = s.CertificateThumbprint
+	}
+	if s.DPoPJKT != "" {
+		cnf["jkt"] = s.DPoPJKT
+	}
+	if len(cnf) > 0 {
+		claims["cnf"] = cnf
 	}
-	claims.Extra["account_id"] = s.AccountID
-	claims.Extra["android_id"] = s.AndroidID
 	return claims
 }
 
+// The `kid` and `typ` are set by `JWTSigningStrategy`
 func (s *Session) GetJWTHeader() *jwt.Headers {
 	return &jwt.Headers{
-		Extra: map[string]interface{}{"kid": s.KID},
+		Extra: map[string]interface{}{},
 	}
 }
 
@@ -0,0 +1,74 @@
+package oauth2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionCustomClaims(t *testing.T) {
+	a := assert.New(t)
+
+	session := NewSession("subject")
+	session.ClientID = "client"
+	session.AccountID = "account"
+	session.CustomClaims = map[string]string{
+		"region": "eu-west-2",
+		"tenant": "acme-{{account_id}}",
+		// Not allowed by `client.ValidateCustomClaims`, but can't override the actual claim regardless
+		"client_id": "another-client",
+	}
+
+	claims := session.GetExtraClaims()
+	a.Equal("eu-west-2", claims["region"])
+	a.Equal("acme-account", claims["tenant"])
+	a.Equal("client", claims["client_id"])
+}
+
+func TestSessionWithClaimsCustomClaims(t *testing.T) {
+	a := assert.New(t)
+
+	session := NewSession("")
+	session.WithClaims(jwt.JWTClaims{
+		Subject: "subject",
+		Extra: map[string]interface{}{
+			"client_id":  "client",
+			"account_id": "account",
+			"region":     "eu-west-2",
+		},
+	})
+
+	a.Equal(map[string]string{"region": "eu-west-2"}, session.CustomClaims)
+}
+
+func TestSessionAuthTime(t *testing.T) {
+	a := assert.New(t)
+
+	session := NewSession("account")
+	session.ClientID = "client"
+	a.Equal(session.DefaultSession.Claims.AuthTime.Unix(), session.GetExtraClaims()["auth_time"])
+
+	// Not on behalf of an end-user
+	session.Subject = "client"
+	a.NotContains(session.GetExtraClaims(), "auth_time")
+
+	// Kept from the subject token of an exchange
+	exchanged := NewSession("")
+	exchanged.ClientID = "another-client"
+	exchanged.WithClaims(jwt.JWTClaims{Subject: "account", Extra: map[string]interface{}{"auth_time": float64(1650000000)}})
+	a.Equal(int64(1650000000), exchanged.GetExtraClaims()["auth_time"])
+}
+
+func TestSessionResourcesAudience(t *testing.T) {
+	a := assert.New(t)
+
+	session := NewSession("subject")
+	claims := session.GetJWTClaims().With(time.Now(), nil, []string{"https://a.example.com", "https://b.example.com"})
+	a.Equal([]string{"https://a.example.com", "https://b.example.com"}, claims.ToMapClaims()["aud"], "Granted audience")
+
+	session.Resources = []string{"https://a.example.com"}
+	claims = session.GetJWTClaims().With(time.Now(), nil, []string{"https://a.example.com", "https://b.example.com"})
+	a.Equal([]string{"https://a.example.com"}, claims.ToMapClaims()["aud"], "Narrowed to the resources")
+}
@@ -4,57 +4,222 @@ import (
 	"context"
 	"time"
 
+	"github.com/KL-Engineering/oauth2-server/internal/account"
 	"github.com/KL-Engineering/oauth2-server/internal/client"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/pkce"
+	"github.com/pkg/errors"
 )
 
-// The required sub-interfaces for `client_credentials` grant with JWTs
+// The required sub-interfaces for the `client_credentials` grant with JWTs, and the
+// `authorization_code` grant with PKCE
 type FositeStore interface {
 	fosite.ClientManager
-	oauth2.AccessTokenStorage
+	oauth2.CoreStorage
+	oauth2.TokenRevocationStorage
+	pkce.PKCERequestStorage
 }
 
 type Store struct {
-	repo *client.Repository
+	repo             *client.Repository
+	denylist         *JTIStore
+	clientAssertions *JTIStore
+	authorizeCodes   *RequestStore
+	pkceRequests     *RequestStore
+	refreshTokens    *RequestStore
+	// Only opaque access tokens are stored, as JWTs are stateless
+	accessTokens *RequestStore
+	// Every refresh token issued from the same authorization shares its request ID, so revoking
+	// that ID revokes the whole family of rotated refresh tokens
+	refreshTokenFamilies *JTIStore
+	devices              *DeviceStore
+	lifespans            *TokenLifespans
 }
 
 var _ FositeStore = (*Store)(nil)
 
 func NewStore(db *dynamodb.Client) *Store {
 	// TODO pass the repository directly (or some kind of "Registry" object which includes the repository)
-	return &Store{repo: client.NewRepository(db)}
+	s := &Store{
+		repo:             client.NewRepository(db),
+		denylist:         NewJTIStore(db, denylistNamespace),
+		clientAssertions: NewJTIStore(db, clientAssertionNamespace),
+
+		refreshTokenFamilies: NewJTIStore(db, refreshTokenFamilyNamespace),
+		devices:              NewDeviceStore(db),
+		lifespans: &TokenLifespans{
+			accounts: account.NewSettingsRepository(db),
+			Default:  config.AccessTokenLifespan,
+			Max:      defaultMaxAccessTokenLifespan,
+		},
+	}
+	s.authorizeCodes = NewRequestStore(db, authorizeCodeNamespace, s)
+	s.pkceRequests = NewRequestStore(db, pkceNamespace, s)
+	s.refreshTokens = NewRequestStore(db, refreshTokenNamespace, s)
+	s.accessTokens = NewRequestStore(db, accessTokenNamespace, s)
+	return s
 }
 
 func (s *Store) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	client, err := s.repo.GetByID(ctx, id)
-	if err != nil {
+	model, err := s.repo.GetByID(ctx, id)
+	// A disabled Client is the same as one which doesn't exist
+	if err != nil || model.Disabled {
 		return nil, fosite.ErrNotFound
 	}
-	return NewFositeClient(client), nil
+	if model.TokenEndpointAuthMethod == client.PrivateKeyJWT {
+		return NewFositeJWKClient(model), nil
+	}
+	return NewFositeClient(model), nil
 }
 
-// NB: No-op as we haven't implemented JTI based blacklists
-func (s *Store) ClientAssertionJWTValid(_ context.Context, jti string) error {
+// Prevents replay of `private_key_jwt` client assertions
+func (s *Store) ClientAssertionJWTValid(ctx context.Context, jti string) error {
+	used, err := s.clientAssertions.Contains(ctx, jti)
+	if err != nil {
+		return err
+	}
+	if used {
+		return fosite.ErrJTIKnown
+	}
 	return nil
 }
 
-// NB: No-op as we haven't implemented JTI based blacklists
-func (s *Store) SetClientAssertionJWT(_ context.Context, jti string, exp time.Time) error {
+func (s *Store) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
+	// Conditional write, so concurrent requests with the same assertion can't both succeed
+	if err := s.clientAssertions.Add(ctx, jti, exp); err != nil {
+		if errors.Is(err, ErrJTIExists) {
+			return errors.WithStack(fosite.ErrJTIKnown)
+		}
+		return err
+	}
 	return nil
 }
 
-// NB: No-op as we are using stateless JWTs
+// NB: No-op for JWTs, which are stateless, so only the access tokens of Clients with a `token_format`
+// of `opaque` are stored
 func (s *Store) CreateAccessTokenSession(ctx context.Context, signature string, request fosite.Requester) (err error) {
-	return nil
+	if !isOpaqueTokenClient(request.GetClient()) {
+		return nil
+	}
+	return s.accessTokens.Create(ctx, signature, request, request.GetSession().GetExpiresAt(fosite.AccessToken))
 }
 
-// NB: No-op as we are using stateless JWTs
 func (s *Store) DeleteAccessTokenSession(ctx context.Context, signature string) error {
-	return nil
+	return s.accessTokens.Delete(ctx, signature)
 }
 
+// Returns `fosite.ErrNotFound` if there is no such opaque access token, e.g. for a JWT
 func (s *Store) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
-	return &fosite.Request{Session: session}, nil
+	request, err := s.accessTokens.Get(ctx, signature, session)
+	if errors.Is(err, ErrRequestInactive) {
+		return request, errors.WithStack(fosite.ErrInactiveToken)
+	}
+	return request, err
+}
+
+func (s *Store) CreateAuthorizeCodeSession(ctx context.Context, code string, request fosite.Requester) error {
+	return s.authorizeCodes.Create(ctx, code, request, request.GetSession().GetExpiresAt(fosite.AuthorizeCode))
+}
+
+func (s *Store) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	request, err := s.authorizeCodes.Get(ctx, code, session)
+	if errors.Is(err, ErrRequestInactive) {
+		// fosite requires the request to be returned as well, to detect reuse of the code
+		return request, errors.WithStack(fosite.ErrInvalidatedAuthorizeCode)
+	}
+	return request, err
+}
+
+func (s *Store) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	return s.authorizeCodes.Invalidate(ctx, code)
+}
+
+func (s *Store) CreatePKCERequestSession(ctx context.Context, signature string, request fosite.Requester) error {
+	return s.pkceRequests.Create(ctx, signature, request, request.GetSession().GetExpiresAt(fosite.AuthorizeCode))
+}
+
+func (s *Store) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	return s.pkceRequests.Get(ctx, signature, session)
+}
+
+func (s *Store) DeletePKCERequestSession(ctx context.Context, signature string) error {
+	return s.pkceRequests.Delete(ctx, signature)
+}
+
+func (s *Store) CreateRefreshTokenSession(ctx context.Context, signature string, request fosite.Requester) error {
+	return s.refreshTokens.Create(ctx, signature, request, request.GetSession().GetExpiresAt(fosite.RefreshToken))
+}
+
+// Returns the request along with `fosite.ErrInactiveToken` if the refresh token has already been
+// used (or its family revoked), which fosite treats as reuse and so revokes the family
+func (s *Store) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, err := s.refreshTokens.Get(ctx, signature, session)
+	if errors.Is(err, ErrRequestInactive) {
+		return request, errors.WithStack(fosite.ErrInactiveToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.refreshTokenFamilies.Contains(ctx, request.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return request, errors.WithStack(fosite.ErrInactiveToken.WithHint("The refresh token has been revoked."))
+	}
+
+	return request, nil
+}
+
+func (s *Store) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	return s.refreshTokens.Delete(ctx, signature)
+}
+
+// Revokes every refresh token issued from the same authorization
+func (s *Store) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	// The most recently rotated refresh token in the family can't outlive this
+	exp := time.Now().Add(config.GetRefreshTokenLifespan())
+	if err := s.refreshTokenFamilies.Add(ctx, requestID, exp); err != nil && !errors.Is(err, ErrJTIExists) {
+		return err
+	}
+	return nil
+}
+
+// Rotation: called when a refresh token is used, so that any further use is detected as reuse
+//
+// NB: There is no grace period, so a Client must not use the same refresh token concurrently
+func (s *Store) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, requestID string, signature string) error {
+	if err := s.refreshTokens.Invalidate(ctx, signature); err != nil {
+		if errors.Is(err, ErrRequestInactive) {
+			// Another request used the token first
+			return errors.WithStack(fosite.ErrInactiveToken)
+		}
+		return err
+	}
+	return nil
+}
+
+// NB: No-op as we are using stateless JWTs, which can only be revoked by their `jti`, so access
+// tokens of a revoked refresh token family remain valid until they (shortly) expire
+//
+// Opaque access tokens are introspected, so are inactive as soon as their family is revoked,
+// see `TokenIntrospector`
+func (s *Store) RevokeAccessToken(ctx context.Context, requestID string) error {
+	return nil
+}
+
+// Revoke an access token until its expiry
+func (s *Store) RevokeJTI(ctx context.Context, jti string, exp time.Time) error {
+	// Already revoked
+	if err := s.denylist.Add(ctx, jti, exp); err != nil && !errors.Is(err, ErrJTIExists) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) IsJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	return s.denylist.Contains(ctx, jti)
 }
@@ -0,0 +1,198 @@
+package oauth2
+
+import (
+	"context"
+	"time"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+)
+
+// Token types accepted as the `subject_token`, see https://datatracker.ietf.org/doc/html/rfc8693#section-3
+const (
+	AccessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	JWTTokenType    = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// Exchanges one of our access tokens (the `subject_token`) for another, typically with a narrower
+// scope and aimed at another audience, so that a service can call another on behalf of the token's subject
+//
+// The authenticated Client is the actor, and is recorded in the `act` claim (nesting any previous actor).
+// It must be one of the subject token's audiences (see `mayAct`), so a token can only be exchanged by
+// the services it was aimed at. The `account_id` and `android_id` of the subject token are kept.
+//
+// fosite doesn't implement https://datatracker.ietf.org/doc/html/rfc8693, so this mirrors its
+// `ClientCredentialsGrantHandler`
+type TokenExchangeGrantHandler struct {
+	AccessTokenStrategy      oauth2.AccessTokenStrategy
+	JWTStrategy              jwt.JWTStrategy
+	Store                    *Store
+	ScopeStrategy            fosite.ScopeStrategy
+	AudienceMatchingStrategy fosite.AudienceMatchingStrategy
+}
+
+var _ fosite.TokenEndpointHandler = (*TokenExchangeGrantHandler)(nil)
+
+func TokenExchangeGrantFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &TokenExchangeGrantHandler{
+		AccessTokenStrategy:      strategy.(oauth2.AccessTokenStrategy),
+		JWTStrategy:              strategy.(jwt.JWTStrategy),
+		Store:                    storage.(*Store),
+		ScopeStrategy:            config.GetScopeStrategy(),
+		AudienceMatchingStrategy: config.GetAudienceStrategy(),
+	}
+}
+
+func (h *TokenExchangeGrantHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
+	if !h.CanHandleTokenEndpointRequest(request) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	actor := request.GetClient()
+	if !actor.GetGrantTypes().Has(client.TokenExchange) {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant '%s'.", client.TokenExchange))
+	}
+
+	form := request.GetRequestForm()
+
+	subjectToken := form.Get("subject_token")
+	if subjectToken == "" {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'subject_token' parameter is required."))
+	}
+
+	switch form.Get("subject_token_type") {
+	case AccessTokenType, JWTTokenType:
+	default:
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHintf("The 'subject_token_type' must be '%s' or '%s'.", AccessTokenType, JWTTokenType))
+	}
+
+	if requestedTokenType := form.Get("requested_token_type"); requestedTokenType != "" && requestedTokenType != AccessTokenType {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHintf("The 'requested_token_type' must be '%s'.", AccessTokenType))
+	}
+
+	// The actor is always the authenticated Client
+	if form.Get("actor_token") != "" {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'actor_token' parameter is not supported."))
+	}
+
+	// The claims of an opaque token are only available by introspection
+	if !isJWT(subjectToken) {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'subject_token' must be a JWT, not an opaque access token."))
+	}
+
+	subject, _, err := validateAccessToken(ctx, h.JWTStrategy, h.Store, subjectToken)
+	if errors.Is(err, fosite.ErrInactiveToken) {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The 'subject_token' is invalid, expired or revoked.").WithWrap(err).WithDebug(err.Error()))
+	} else if err != nil {
+		return err
+	}
+
+	if !mayAct(subject, actor) {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The OAuth 2.0 Client is not an audience of the 'subject_token', nor allowed to act by its 'may_act' claim."))
+	}
+
+	// Down-scoping: the new token can't have any scope which the subject token didn't, and
+	// defaults to those of the subject token's scopes which the actor is allowed
+	if len(request.GetRequestedScopes()) == 0 {
+		for _, scope := range subject.Scope {
+			if h.ScopeStrategy(actor.GetScopes(), scope) {
+				request.GrantScope(scope)
+			}
+		}
+	} else {
+		for _, scope := range request.GetRequestedScopes() {
+			if !h.ScopeStrategy(subject.Scope, scope) {
+				return errors.WithStack(fosite.ErrInvalidScope.WithHintf("The 'subject_token' has not been granted scope '%s'.", scope))
+			}
+			if !h.ScopeStrategy(actor.GetScopes(), scope) {
+				return errors.WithStack(fosite.ErrInvalidScope.WithHintf("The OAuth 2.0 Client is not allowed to request scope '%s'.", scope))
+			}
+			request.GrantScope(scope)
+		}
+	}
+
+	// The new token is aimed at the requested audience, which the actor must be allowed
+	if err := h.AudienceMatchingStrategy(actor.GetAudience(), request.GetRequestedAudience()); err != nil {
+		return err
+	}
+	for _, audience := range request.GetRequestedAudience() {
+		request.GrantAudience(audience)
+	}
+
+	session, ok := request.GetSession().(*Session)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("Session is not an oauth2.Session."))
+	}
+
+	// The subscription (looked up by `Handler.Token`) is that of the subject token's account, rather than the actor's
+	if err := session.WithClient(ctx, actor, nil); err != nil {
+		return err
+	}
+	// This includes the subject token's `cnf`, which `Handler.Token` checks this request proves possession of,
+	// before binding the new token to this request's key (if any)
+	session.WithClaims(subject)
+	session.Actor = map[string]interface{}{"sub": actor.GetID()}
+	if subject.Extra["act"] != nil {
+		session.Actor["act"] = subject.Extra["act"]
+	}
+
+	// The new token lasts as long as the actor's tokens, but can't outlive the subject token
+	lifespan, err := h.Store.lifespans.AccessTokenLifespan(ctx, actor)
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+	session.WithLifespan(lifespan)
+	if subject.ExpiresAt.Before(session.GetExpiresAt(fosite.AccessToken)) {
+		session.SetExpiresAt(fosite.AccessToken, subject.ExpiresAt)
+	}
+
+	return nil
+}
+
+// Whether the actor is an audience of the subject token, either by its ID or one of its own allowed
+// audiences (i.e. the services it calls on behalf of the subject), or is the `sub` of its `may_act` claim,
+// see https://datatracker.ietf.org/doc/html/rfc8693#section-4.4
+func mayAct(subject jwt.JWTClaims, actor fosite.Client) bool {
+	audience := fosite.Arguments(subject.Audience)
+	if audience.Has(actor.GetID()) || audience.HasOneOf(actor.GetAudience()...) {
+		return true
+	}
+
+	mayAct, ok := subject.Extra["may_act"].(map[string]interface{})
+	return ok && mayAct["sub"] == actor.GetID()
+}
+
+func (h *TokenExchangeGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !h.CanHandleTokenEndpointRequest(requester) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	accessToken, accessSignature, err := h.AccessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if err := h.Store.CreateAccessTokenSession(ctx, accessSignature, requester.Sanitize([]string{})); err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	responder.SetAccessToken(accessToken)
+	responder.SetTokenType("bearer")
+	responder.SetExpiresIn(time.Until(requester.GetSession().GetExpiresAt(fosite.AccessToken)).Round(time.Second))
+	responder.SetScopes(requester.GetGrantedScopes())
+	responder.SetExtra("issued_token_type", AccessTokenType)
+
+	return nil
+}
+
+func (h *TokenExchangeGrantHandler) CanSkipClientAuth(requester fosite.AccessRequester) bool {
+	return false
+}
+
+func (h *TokenExchangeGrantHandler) CanHandleTokenEndpointRequest(requester fosite.AccessRequester) bool {
+	return requester.GetGrantTypes().ExactOne(client.TokenExchange)
+}
@@ -0,0 +1,62 @@
+package oauth2
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KL-Engineering/oauth2-server/internal/client"
+	"github.com/KL-Engineering/oauth2-server/internal/crypto"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMayAct(t *testing.T) {
+	a := assert.New(t)
+
+	actor := NewFositeClient(&client.Client{ID: "service", AllowedAudiences: []string{"https://a.kidsloop.live"}})
+
+	a.True(mayAct(jwt.JWTClaims{Audience: []string{"service"}}, actor))
+	a.True(mayAct(jwt.JWTClaims{Audience: []string{ISSUER, "https://a.kidsloop.live"}}, actor))
+	a.True(mayAct(jwt.JWTClaims{
+		Audience: []string{ISSUER},
+		Extra:    map[string]interface{}{"may_act": map[string]interface{}{"sub": "service"}},
+	}, actor))
+
+	a.False(mayAct(jwt.JWTClaims{Audience: []string{ISSUER}}, actor), "Aimed at another service")
+	a.False(mayAct(jwt.JWTClaims{
+		Audience: []string{ISSUER},
+		Extra:    map[string]interface{}{"may_act": map[string]interface{}{"sub": "other"}},
+	}, actor))
+	a.False(mayAct(jwt.JWTClaims{
+		Audience: []string{ISSUER},
+		Extra:    map[string]interface{}{"may_act": "service"},
+	}, actor))
+}
+
+func TestVerifySubjectTokenCertificate(t *testing.T) {
+	a := assert.New(t)
+
+	cert := generateCertificate(a, "CN=service", nil)
+	other := generateCertificate(a, "CN=other", nil)
+
+	request := fosite.NewAccessRequest(&Session{CertificateThumbprint: crypto.CertificateThumbprint(cert.Leaf)})
+	request.GrantTypes = fosite.Arguments{client.TokenExchange}
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/token", nil)
+	a.ErrorIs(verifySubjectTokenCertificate(req, request), fosite.ErrInvalidRequest, "No certificate")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other.Leaf}}
+	a.ErrorIs(verifySubjectTokenCertificate(req, request), fosite.ErrInvalidRequest, "Another certificate")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	a.NoError(verifySubjectTokenCertificate(req, request))
+
+	// Only the subject token's binding is checked, not that of (e.g.) a refresh token
+	request.GrantTypes = fosite.Arguments{client.RefreshToken}
+	req.TLS = nil
+	a.NoError(verifySubjectTokenCertificate(req, request))
+}
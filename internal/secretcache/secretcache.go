@@ -0,0 +1,178 @@
+package secretcache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Published at `/metrics`, and shared by every Cache of the process
+var (
+	metrics       = expvar.NewMap("secret_cache")
+	hits          = new(expvar.Int)
+	misses        = new(expvar.Int)
+	evictions     = new(expvar.Int)
+	invalidations = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("hits", hits)
+	metrics.Set("misses", misses)
+	metrics.Set("evictions", evictions)
+	metrics.Set("invalidations", invalidations)
+	metrics.Set("hit_rate", expvar.Func(func() interface{} {
+		h, m := hits.Value(), misses.Value()
+		if h+m == 0 {
+			return 0.0
+		}
+		return float64(h) / float64(h+m)
+	}))
+}
+
+// How long verifications are cached, and how many
+type Policy struct {
+	// Caching is disabled if 0
+	TTL        time.Duration
+	MaxEntries int
+}
+
+var DefaultPolicy = Policy{
+	TTL:        time.Second * 30,
+	MaxEntries: 10000,
+}
+
+type entry struct {
+	// The hash the secret was verified against
+	hash      string
+	expiresAt time.Time
+}
+
+// Caches successful verifications of Client secrets, so that busy Clients don't run argon2id on
+// every request
+//
+// Entries are keyed by the Client ID and an HMAC of the presented secret (with a random key, which
+// never leaves the process), so the cache holds nothing that's cheaper to brute-force than the hash.
+// An entry only matches the hash it was verified against, so a rotated secret can't match on any
+// instance, even before `Invalidate` (which only reaches this process) or the TTL.
+type Cache struct {
+	policy Policy
+	key    []byte
+
+	mu sync.Mutex
+	// Client ID => digest => entry, so a Client's entries (e.g. its current and previous secret)
+	// can be invalidated together
+	entries map[string]map[string]entry
+	size    int
+}
+
+func New(policy Policy) (*Cache, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	return &Cache{
+		policy:  policy,
+		key:     key,
+		entries: map[string]map[string]entry{},
+	}, nil
+}
+
+func (c *Cache) digest(secret []byte) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(secret)
+	return string(mac.Sum(nil))
+}
+
+// Whether `secret` was recently verified against `hash`, one of the Client's (current) hashes
+func (c *Cache) Verified(clientID string, hash string, secret []byte) bool {
+	if c.policy.TTL <= 0 {
+		return false
+	}
+	digest := c.digest(secret)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[clientID][digest]
+	if ok && time.Now().After(e.expiresAt) {
+		c.remove(clientID, digest)
+		ok = false
+	}
+	if !ok || e.hash != hash {
+		misses.Add(1)
+		return false
+	}
+	hits.Add(1)
+	return true
+}
+
+// Records that `secret` was verified against `hash`
+func (c *Cache) Add(clientID string, hash string, secret []byte) {
+	if c.policy.TTL <= 0 {
+		return
+	}
+	digest := c.digest(secret)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[clientID][digest]; !ok {
+		if c.size >= c.policy.MaxEntries {
+			c.evict()
+		}
+		if c.entries[clientID] == nil {
+			c.entries[clientID] = map[string]entry{}
+		}
+		c.size++
+	}
+	c.entries[clientID][digest] = entry{hash: hash, expiresAt: time.Now().Add(c.policy.TTL)}
+}
+
+// Forgets every verification of a Client, e.g. when its secret is rotated or it is deleted
+func (c *Cache) Invalidate(clientID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n := len(c.entries[clientID]); n > 0 {
+		c.size -= n
+		invalidations.Add(int64(n))
+	}
+	delete(c.entries, clientID)
+}
+
+// Removes an arbitrary entry (as map iteration is random), which is cheaper than finding the oldest.
+// Expired entries are otherwise removed when looked up.
+//
+// Must be called with the lock held
+func (c *Cache) evict() {
+	for clientID, digests := range c.entries {
+		for digest := range digests {
+			c.remove(clientID, digest)
+			return
+		}
+	}
+}
+
+// Must be called with the lock held
+func (c *Cache) remove(clientID string, digest string) {
+	if _, ok := c.entries[clientID][digest]; !ok {
+		return
+	}
+	delete(c.entries[clientID], digest)
+	if len(c.entries[clientID]) == 0 {
+		delete(c.entries, clientID)
+	}
+	c.size--
+	evictions.Add(1)
+}
+
+// The number of cached verifications, including expired ones yet to be evicted
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
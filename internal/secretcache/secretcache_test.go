@@ -0,0 +1,79 @@
+package secretcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	a := assert.New(t)
+
+	cache, err := New(DefaultPolicy)
+	a.NoError(err)
+
+	a.False(cache.Verified("client", "hash", []byte("secret")), "Not cached")
+
+	cache.Add("client", "hash", []byte("secret"))
+	a.True(cache.Verified("client", "hash", []byte("secret")))
+
+	a.False(cache.Verified("client", "hash", []byte("another-secret")))
+	a.False(cache.Verified("client", "rotated-hash", []byte("secret")), "Only matches the hash it was verified against")
+	a.False(cache.Verified("another-client", "hash", []byte("secret")))
+
+	cache.Invalidate("client")
+	a.False(cache.Verified("client", "hash", []byte("secret")), "Invalidated")
+	a.Zero(cache.Len())
+}
+
+func TestCacheExpiry(t *testing.T) {
+	a := assert.New(t)
+
+	cache, err := New(Policy{TTL: time.Millisecond, MaxEntries: 10})
+	a.NoError(err)
+
+	cache.Add("client", "hash", []byte("secret"))
+	time.Sleep(time.Millisecond * 5)
+	a.False(cache.Verified("client", "hash", []byte("secret")), "Expired")
+	a.Zero(cache.Len(), "Removed when looked up")
+}
+
+func TestCacheBounded(t *testing.T) {
+	a := assert.New(t)
+
+	cache, err := New(Policy{TTL: time.Minute, MaxEntries: 2})
+	a.NoError(err)
+
+	for _, clientID := range []string{"a", "b", "c"} {
+		cache.Add(clientID, "hash", []byte("secret"))
+	}
+	a.Equal(2, cache.Len())
+	a.True(cache.Verified("c", "hash", []byte("secret")), "The latest entry is kept")
+}
+
+func TestCacheDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	cache, err := New(Policy{})
+	a.NoError(err)
+
+	cache.Add("client", "hash", []byte("secret"))
+	a.False(cache.Verified("client", "hash", []byte("secret")))
+}
+
+func TestMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	cache, err := New(DefaultPolicy)
+	a.NoError(err)
+
+	h, m := hits.Value(), misses.Value()
+	cache.Verified("client", "hash", []byte("secret"))
+	cache.Add("client", "hash", []byte("secret"))
+	cache.Verified("client", "hash", []byte("secret"))
+
+	a.Equal(h+1, hits.Value())
+	a.Equal(m+1, misses.Value())
+	a.Contains(metrics.String(), `"hit_rate"`)
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The attribute (in Unix time) after which DynamoDB TTL deletes an item
+//
+// DynamoDB TTL deletion is lazy, so items may outlive their expiry, and must be checked when read
+// (see `Expired`) or overwritten (see `AbsentOrExpired`)
+const TTLAttribute = "ttl"
+
+// The partition and sort key of an item, e.g. "Denylist#<jti>"
+func Key(namespace string, id string) map[string]types.AttributeValue {
+	key := fmt.Sprintf("%s#%s", namespace, id)
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: key},
+		"sk": &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+func TTLValue(exp time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(exp.Unix(), 10)}
+}
+
+// Whether an item has expired, but not yet been deleted. An item without a TTL never expires.
+func Expired(item map[string]types.AttributeValue) bool {
+	ttl, ok := item[TTLAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	exp, err := strconv.ParseInt(ttl.Value, 10, 64)
+	return err == nil && exp < time.Now().Unix()
+}
+
+// The condition of an item which doesn't exist, or has expired, e.g. to only create an item once
+func AbsentOrExpired() expression.ConditionBuilder {
+	return expression.AttributeNotExists(expression.Name("pk")).Or(
+		expression.Name(TTLAttribute).LessThan(expression.Value(time.Now().Unix())),
+	)
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpired(t *testing.T) {
+	a := assert.New(t)
+
+	item := Key("Namespace", "id")
+	a.Equal(&types.AttributeValueMemberS{Value: "Namespace#id"}, item["pk"])
+	a.Equal(item["pk"], item["sk"])
+	a.False(Expired(item), "No TTL")
+
+	item[TTLAttribute] = TTLValue(time.Now().Add(time.Minute))
+	a.False(Expired(item))
+
+	item[TTLAttribute] = TTLValue(time.Now().Add(-time.Minute))
+	a.True(Expired(item), "Not yet deleted")
+}
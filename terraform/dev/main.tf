@@ -21,4 +21,9 @@ resource "aws_dynamodb_table" "authentication" {
     name = "sk"
     type = "S"
   }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
 }